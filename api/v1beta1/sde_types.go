@@ -18,6 +18,7 @@ package v1beta1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -29,6 +30,334 @@ type SdeSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	DatabaseCount int64 `json:"databaseCount"`
+
+	// DatabaseServer is the name of the SdeDatabaseServer to use. When empty,
+	// connection details come from the namespace's <ns>-db-configmap and
+	// <ns>-database-secrets.
+	//+optional
+	DatabaseServer string `json:"databaseServer,omitempty"`
+
+	// AdoptUnowned claims databases matching AdoptPattern that have no owner
+	// comment yet. Use it once when moving existing databases under the
+	// controller.
+	//+optional
+	AdoptUnowned bool `json:"adoptUnowned,omitempty"`
+
+	// AdoptPattern is a regular expression matched against the whole
+	// database name, selecting the uncommented databases AdoptUnowned claims,
+	// for example "sde_5\.[0-9]+\.[0-9]+". It is required with AdoptUnowned
+	// so a shared server's other uncommented databases are never claimed.
+	//+optional
+	AdoptPattern string `json:"adoptPattern,omitempty"`
+
+	// TargetVersion is the SDE version whose database should exist. When it
+	// changes, the controller creates sde_<targetVersion> from a template.
+	//+kubebuilder:validation:Pattern=`^[0-9A-Za-z][0-9A-Za-z._-]*$`
+	//+kubebuilder:validation:MaxLength=59
+	//+optional
+	TargetVersion string `json:"targetVersion,omitempty"`
+
+	// Versioning decides how database names are ordered from oldest to newest.
+	//+optional
+	Versioning *VersioningSpec `json:"versioning,omitempty"`
+
+	// Provisioning controls how new version databases are created.
+	//+optional
+	Provisioning *ProvisioningSpec `json:"provisioning,omitempty"`
+
+	// Cleanup tunes how retention drops databases.
+	//+optional
+	Cleanup *CleanupSpec `json:"cleanup,omitempty"`
+
+	// Approval decides whether retention drops run on their own or wait for a
+	// human to approve the plan by setting the sde.domain/approve-plan
+	// annotation to the plan hash shown in status.
+	//+kubebuilder:default=Automatic
+	//+optional
+	Approval ApprovalMode `json:"approval,omitempty"`
+
+	// Suspend stops all provisioning, migration and retention for this Sde
+	// until it is cleared.
+	//+optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Retention adds policies on top of DatabaseCount. A database is dropped
+	// when any policy selects it.
+	//+optional
+	Retention *RetentionSpec `json:"retention,omitempty"`
+
+	// Notifications are HTTP endpoints that receive a JSON summary of
+	// retention plans and cleanup runs. Deliveries are retried in the
+	// background and their state is kept in the <name>-notifications ConfigMap.
+	//+listType=map
+	//+listMapKey=name
+	//+optional
+	Notifications []Notification `json:"notifications,omitempty"`
+
+	// Migration is the pod template run as a Job against each newly
+	// provisioned database. Connection details are injected as DATABASE_*
+	// environment variables; the Job logs in as the Sde's job role, never as
+	// the server's admin user. The database only counts as live once it succeeds.
+	// The schema is left open to keep the CRD small enough for kubectl apply.
+	//+kubebuilder:validation:Schemaless
+	//+kubebuilder:validation:Type=object
+	//+kubebuilder:pruning:PreserveUnknownFields
+	//+optional
+	Migration *corev1.PodTemplateSpec `json:"migration,omitempty"`
+}
+
+// ApprovalMode is how retention plans are approved
+// +kubebuilder:validation:Enum=Automatic;Manual
+type ApprovalMode string
+
+const (
+	ApprovalAutomatic ApprovalMode = "Automatic"
+	ApprovalManual    ApprovalMode = "Manual"
+)
+
+// NotificationEvent selects which summaries an endpoint receives
+// +kubebuilder:validation:Enum=Planned;Dropped;Failed
+type NotificationEvent string
+
+const (
+	// NotifyPlanned is sent when retention plans a new set of drops
+	NotifyPlanned NotificationEvent = "Planned"
+	// NotifyDropped is sent after a cleanup run that dropped databases
+	NotifyDropped NotificationEvent = "Dropped"
+	// NotifyFailed is sent after a cleanup run that left planned databases
+	// in place because they failed, were skipped or were blocked
+	NotifyFailed NotificationEvent = "Failed"
+)
+
+// Notification is an HTTP endpoint posted to after retention events
+type Notification struct {
+	// Name identifies the endpoint in the recorded delivery state.
+	//+kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	Name string `json:"name"`
+
+	// URL receives a POST for every matching event.
+	//+kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
+
+	// SigningKey references a key of a Secret in the Sde's namespace. When
+	// set, every request carries X-Sde-Timestamp and an X-Sde-Signature of
+	// "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>".
+	//+optional
+	SigningKey *corev1.SecretKeySelector `json:"signingKey,omitempty"`
+
+	// Events filters what is sent. Defaults to Dropped and Failed.
+	//+optional
+	Events []NotificationEvent `json:"events,omitempty"`
+
+	// Template is a Go text/template rendering the JSON body. It is given
+	// .Events, .Sde, .Namespace, .Time, .PlanHash, .Planned, .Dropped,
+	// .Failed and .ReclaimedBytes; the json function quotes any value.
+	// The default body is the summary itself as JSON.
+	//+optional
+	Template string `json:"template,omitempty"`
+}
+
+// RunNowAnnotation triggers an immediate reconcile whenever its value
+// changes, also retrying an Sde that stopped on a permanent error
+const RunNowAnnotation = "sde.domain/run-now"
+
+// ApprovePlanAnnotation approves the retention plan whose hash it holds
+const ApprovePlanAnnotation = "sde.domain/approve-plan"
+
+// VersionScheme parses the version part of sde_<version> database names
+// +kubebuilder:validation:Enum=semver;calver;numeric;lexical
+type VersionScheme string
+
+const (
+	// SchemeSemver reads 5.3.4. Pre-releases such as 5.3.4_rc1 sort before the
+	// release and hotfixes such as 5.3.4_hf1 after it.
+	SchemeSemver VersionScheme = "semver"
+	// SchemeCalver reads 2024, 2024.05 or 2024.05.17, also written 20240517,
+	// with the same suffix rules as semver
+	SchemeCalver VersionScheme = "calver"
+	// SchemeNumeric reads a single integer such as 42
+	SchemeNumeric VersionScheme = "numeric"
+	// SchemeLexical orders names as plain strings
+	SchemeLexical VersionScheme = "lexical"
+)
+
+// UnparsablePolicy decides what retention does with names the scheme cannot parse
+// +kubebuilder:validation:Enum=Keep;Ignore;DropFirst
+type UnparsablePolicy string
+
+const (
+	// UnparsableKeep sorts them as newest: they count towards DatabaseCount
+	// but are dropped last
+	UnparsableKeep UnparsablePolicy = "Keep"
+	// UnparsableIgnore leaves them out of retention entirely
+	UnparsableIgnore UnparsablePolicy = "Ignore"
+	// UnparsableDropFirst sorts them as oldest, so they are dropped first
+	UnparsableDropFirst UnparsablePolicy = "DropFirst"
+)
+
+// VersioningSpec defines how database names are ordered
+type VersioningSpec struct {
+	//+kubebuilder:default=semver
+	//+optional
+	Scheme VersionScheme `json:"scheme,omitempty"`
+
+	//+kubebuilder:default=Keep
+	//+optional
+	Unparsable UnparsablePolicy `json:"unparsable,omitempty"`
+}
+
+// CleanupSpec defines how retention drops databases
+type CleanupSpec struct {
+	// FailureBudget is how many drops may fail in one run before the remaining
+	// candidates are skipped until the next run.
+	//+kubebuilder:default=3
+	//+kubebuilder:validation:Minimum=0
+	//+optional
+	FailureBudget *int32 `json:"failureBudget,omitempty"`
+
+	// RolePattern selects roles removed once their database is dropped. It is
+	// a regular expression matched against the whole role name, where
+	// "{version}" stands for the dropped database's version, for example
+	// "sde_{version}_(ro|rw)". It must contain "{version}", so only the
+	// dropped version's roles match. Roles that still own objects or hold
+	// privileges anywhere on the server are kept.
+	//+kubebuilder:validation:Pattern=`\{version\}`
+	//+optional
+	RolePattern string `json:"rolePattern,omitempty"`
+
+	// BlockerPolicy decides what happens to a database with prepared
+	// transactions, active replication slots, client sessions or the template
+	// flag. Report leaves it in place; Resolve rolls back, terminates and
+	// clears them, then drops the database.
+	//+kubebuilder:default=Report
+	//+optional
+	BlockerPolicy BlockerPolicy `json:"blockerPolicy,omitempty"`
+}
+
+// BlockerPolicy is how cleanup deals with blockers
+// +kubebuilder:validation:Enum=Report;Resolve
+type BlockerPolicy string
+
+const (
+	BlockerReport  BlockerPolicy = "Report"
+	BlockerResolve BlockerPolicy = "Resolve"
+)
+
+// RetentionSpec defines additional retention policies
+type RetentionSpec struct {
+	// MaxTotalSize is the disk budget for the Sde's databases, as reported by
+	// pg_database_size. The oldest databases are dropped until the total fits.
+	//+optional
+	MaxTotalSize *resource.Quantity `json:"maxTotalSize,omitempty"`
+
+	// MinCount is how many live databases the size budget always keeps, even
+	// when the budget is still exceeded.
+	//+kubebuilder:default=1
+	//+kubebuilder:validation:Minimum=0
+	//+optional
+	MinCount *int32 `json:"minCount,omitempty"`
+
+	// Idle flags or drops databases nobody has used for a while.
+	//+optional
+	Idle *IdlePolicy `json:"idle,omitempty"`
+
+	// ReleaseLines keeps the newest databases of each major or minor line.
+	//+optional
+	ReleaseLines *ReleaseLinesPolicy `json:"releaseLines,omitempty"`
+
+	// Lifecycle keeps every database whose version the SdeRelease catalog
+	// lists as supported and drops versions past their end of life. Versions
+	// missing from the catalog fall back to DatabaseCount.
+	//+optional
+	Lifecycle *LifecyclePolicy `json:"lifecycle,omitempty"`
+}
+
+// LifecyclePolicy drives retention from SdeRelease end-of-life dates
+type LifecyclePolicy struct {
+	// GracePeriod is how long a database is kept after its version's end of life.
+	//+optional
+	GracePeriod metav1.Duration `json:"gracePeriod,omitempty"`
+
+	// ReleaseSelector limits the catalog to matching SdeReleases. All are used when empty.
+	//+optional
+	ReleaseSelector *metav1.LabelSelector `json:"releaseSelector,omitempty"`
+}
+
+// LineGrouping is the version component databases are grouped by
+// +kubebuilder:validation:Enum=Major;Minor
+type LineGrouping string
+
+const (
+	GroupByMajor LineGrouping = "Major"
+	GroupByMinor LineGrouping = "Minor"
+)
+
+// ReleaseLinesPolicy keeps, for example, the latest 2 patches of each of the
+// last 3 minor lines. Versions the scheme cannot split into lines, such as
+// lexical names, are left to the other policies.
+type ReleaseLinesPolicy struct {
+	//+kubebuilder:default=Minor
+	//+optional
+	By LineGrouping `json:"by,omitempty"`
+
+	// PerLine is how many of the newest databases each kept line retains.
+	//+kubebuilder:default=2
+	//+kubebuilder:validation:Minimum=1
+	//+optional
+	PerLine *int32 `json:"perLine,omitempty"`
+
+	// Lines is how many of the newest lines are kept. Older lines are dropped.
+	//+kubebuilder:default=3
+	//+kubebuilder:validation:Minimum=1
+	//+optional
+	Lines *int32 `json:"lines,omitempty"`
+}
+
+// IdleAction is what happens to a database once it counts as idle
+// +kubebuilder:validation:Enum=Flag;Drop
+type IdleAction string
+
+const (
+	// IdleFlag only reports idle databases in status, Events and metrics
+	IdleFlag IdleAction = "Flag"
+	// IdleDrop drops idle databases, except the newest live one
+	IdleDrop IdleAction = "Drop"
+)
+
+// IdlePolicy defines when a database counts as idle, based on pg_stat_database
+type IdlePolicy struct {
+	// After is how long a database must go without connections or committed
+	// transactions to count as idle. Activity is sampled on every reconcile.
+	After metav1.Duration `json:"after"`
+
+	// Action taken on idle databases.
+	//+kubebuilder:default=Flag
+	//+optional
+	Action IdleAction `json:"action,omitempty"`
+}
+
+// ProvisioningSpec defines how a new version database is created
+type ProvisioningSpec struct {
+	// TemplateDatabase is the golden database copied with CREATE DATABASE ...
+	// TEMPLATE. When empty, the newest Ready database of an older version is
+	// used, or template0 when there is none.
+	//+optional
+	TemplateDatabase string `json:"templateDatabase,omitempty"`
+
+	// Owner is the role that owns the new database. Defaults to the Sde's job
+	// role, which migration, backup and restore Jobs log in as; with another
+	// owner, that role needs to be granted what the Jobs do.
+	//+optional
+	Owner string `json:"owner,omitempty"`
+
+	// Encoding of the new database.
+	//+kubebuilder:default=UTF8
+	//+optional
+	Encoding string `json:"encoding,omitempty"`
+
+	// Extensions are created in the new database if they do not exist yet.
+	//+optional
+	Extensions []string `json:"extensions,omitempty"`
 }
 
 // SdeStatus defines the observed state of Sde
@@ -36,8 +365,271 @@ type SdeStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	Active []corev1.ObjectReference `json:"active,omitempty"`
+
+	// ProvisionedVersion is the last target version whose database was created.
+	ProvisionedVersion string `json:"provisionedVersion,omitempty"`
+
+	// Databases tracks databases created by the controller that are not yet
+	// live, or that were quarantined after a failed migration.
+	//+optional
+	Databases []DatabaseState `json:"databases,omitempty"`
+
+	// UnownedDatabases match the naming pattern but are not owned by this Sde.
+	// They are reported here and never dropped.
+	//+optional
+	UnownedDatabases []string `json:"unownedDatabases,omitempty"`
+
+	// LastCleanup is the outcome of the most recent run that dropped databases.
+	//+optional
+	LastCleanup *CleanupResult `json:"lastCleanup,omitempty"`
+
+	// Plan is what retention selected on the last reconcile, and why.
+	//+optional
+	Plan *RetentionPlan `json:"plan,omitempty"`
+
+	// Activity is the last observed use of each owned database.
+	//+optional
+	Activity []DatabaseActivity `json:"activity,omitempty"`
+
+	// Storage reports disk usage when a size budget is configured.
+	//+optional
+	Storage *StorageStatus `json:"storage,omitempty"`
+
+	// LastError describes the most recent failed reconcile, if any.
+	//+optional
+	LastError *ReconcileError `json:"lastError,omitempty"`
+
+	// Conditions represent the latest observations of the Sde's state.
+	//+patchMergeKey=type
+	//+patchStrategy=merge
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
+// DatabasePhase is the lifecycle phase of a provisioned database
+// +kubebuilder:validation:Enum=Migrating;Ready;Quarantined
+type DatabasePhase string
+
+const (
+	DatabaseMigrating   DatabasePhase = "Migrating"
+	DatabaseReady       DatabasePhase = "Ready"
+	DatabaseQuarantined DatabasePhase = "Quarantined"
+)
+
+// DatabaseState is the observed state of a provisioned database
+type DatabaseState struct {
+	Name  string        `json:"name"`
+	Phase DatabasePhase `json:"phase"`
+
+	// Job is the name of the migration Job run against the database.
+	//+optional
+	Job string `json:"job,omitempty"`
+
+	//+optional
+	Message string `json:"message,omitempty"`
+}
+
+// DropOutcome is what happened to one drop candidate
+// +kubebuilder:validation:Enum=Dropped;Skipped;Failed;Blocked
+type DropOutcome string
+
+const (
+	DropDropped DropOutcome = "Dropped"
+	DropSkipped DropOutcome = "Skipped"
+	DropFailed  DropOutcome = "Failed"
+	// DropBlocked databases were not dropped because of blockers the
+	// blocker policy does not resolve
+	DropBlocked DropOutcome = "Blocked"
+)
+
+// DatabaseResult is the outcome of cleanup for one database
+type DatabaseResult struct {
+	Name    string      `json:"name"`
+	Outcome DropOutcome `json:"outcome"`
+
+	//+optional
+	Message string `json:"message,omitempty"`
+
+	// Blockers found before the drop.
+	//+optional
+	Blockers []Blocker `json:"blockers,omitempty"`
+
+	// Steps lists every statement run for this database, including the
+	// removal of subscriptions, replication slots and roles around the drop.
+	//+optional
+	Steps []CleanupStep `json:"steps,omitempty"`
+}
+
+// BlockerKind is a reason DROP DATABASE would fail
+type BlockerKind string
+
+const (
+	BlockerPreparedTransaction BlockerKind = "PreparedTransaction"
+	BlockerReplicationSlot     BlockerKind = "ActiveReplicationSlot"
+	BlockerSession             BlockerKind = "Session"
+	BlockerTemplate            BlockerKind = "Template"
+)
+
+// Blocker is something that prevents a database from being dropped
+type Blocker struct {
+	Kind BlockerKind `json:"kind"`
+	// Detail names the transaction, slot or session
+	Detail string `json:"detail"`
+}
+
+// CleanupStep is one action taken while dropping a database
+type CleanupStep struct {
+	// Action is one of DropSubscription, DropReplicationSlot, DropDatabase or DropRole.
+	Action string `json:"action"`
+	Target string `json:"target"`
+
+	Succeeded bool `json:"succeeded"`
+
+	//+optional
+	Message string `json:"message,omitempty"`
+}
+
+// RetentionPlan lists the databases retention drops and how they were grouped
+type RetentionPlan struct {
+	// Hash identifies the set of databases to drop. With manual approval it is
+	// the value the approve-plan annotation must hold.
+	//+optional
+	Hash string `json:"hash,omitempty"`
+
+	// Drop lists the selected databases, oldest first.
+	//+optional
+	Drop []PlannedDrop `json:"drop,omitempty"`
+
+	// Lines shows the release line grouping, newest line first, when a
+	// release line policy is configured.
+	//+optional
+	Lines []ReleaseLine `json:"lines,omitempty"`
+
+	// Supported lists databases kept because the catalog lists their version
+	// as supported. No policy drops them.
+	//+optional
+	Supported []string `json:"supported,omitempty"`
+	// Pinned lists databases whose SdeDatabase is pinned. No policy drops them.
+	//+optional
+	Pinned []string `json:"pinned,omitempty"`
+}
+
+// PlannedDrop is a database selected for dropping
+type PlannedDrop struct {
+	Name string `json:"name"`
+	// Reason is the policy that selected it: DatabaseCount, SizeBudget, Idle,
+	// ReleaseLine or EndOfLife.
+	Reason string `json:"reason"`
+}
+
+// ReleaseLine is one group of databases sharing a major or minor version
+type ReleaseLine struct {
+	Line string `json:"line"`
+	//+optional
+	Keep []string `json:"keep,omitempty"`
+	//+optional
+	Drop []string `json:"drop,omitempty"`
+}
+
+// DatabaseActivity tracks when a database was last seen in use
+type DatabaseActivity struct {
+	Name string `json:"name"`
+
+	// LastActivity is when the database last had connections or new commits.
+	// Databases first seen by the controller start out as active.
+	LastActivity metav1.Time `json:"lastActivity"`
+
+	// XactCommit is the commit counter from the last sample.
+	XactCommit int64 `json:"xactCommit"`
+
+	// StatsReset is when the database's statistics were last reset.
+	//+optional
+	StatsReset *metav1.Time `json:"statsReset,omitempty"`
+
+	// Idle is set once the database has been inactive longer than the idle policy allows.
+	//+optional
+	Idle bool `json:"idle,omitempty"`
+}
+
+// StorageStatus reports the disk used by the Sde's databases
+type StorageStatus struct {
+	// TotalBytes is the combined size of all owned databases.
+	TotalBytes int64 `json:"totalBytes"`
+
+	// MaxTotalBytes is the configured budget.
+	MaxTotalBytes int64 `json:"maxTotalBytes"`
+
+	// ProjectedReclaimBytes is the size of the databases retention is about to drop.
+	ProjectedReclaimBytes int64 `json:"projectedReclaimBytes"`
+
+	// MeasureTime is when the sizes were read.
+	MeasureTime metav1.Time `json:"measureTime"`
+}
+
+// CleanupResult summarizes one cleanup run
+type CleanupResult struct {
+	Time    metav1.Time `json:"time"`
+	Dropped int32       `json:"dropped"`
+	Skipped int32       `json:"skipped"`
+	Failed  int32       `json:"failed"`
+
+	//+optional
+	Blocked int32 `json:"blocked,omitempty"`
+
+	//+optional
+	Databases []DatabaseResult `json:"databases,omitempty"`
+}
+
+// ReconcileError records a classified reconcile failure
+type ReconcileError struct {
+	// Class is one of Transient, Auth, Permission, InUse or Config.
+	Class   string `json:"class"`
+	Message string `json:"message"`
+
+	// Count is how many consecutive reconciles failed with this class
+	// against the same inputs.
+	Count int32 `json:"count"`
+
+	// InputsVersion identifies the spec and Secret/ConfigMap versions the
+	// failures were seen with. Permanent errors are retried when it changes.
+	InputsVersion string `json:"inputsVersion,omitempty"`
+
+	LastTime metav1.Time `json:"lastTime"`
+}
+
+// Condition types and reasons reported on an Sde
+const (
+	ConditionReconciled   = "Reconciled"
+	ConditionCleanedUp    = "CleanedUp"
+	ConditionProvisioning = "Provisioning"
+	ConditionProvisioned  = "Provisioned"
+	ConditionPlanApproved = "PlanApproved"
+
+	ReasonSucceeded        = "Succeeded"
+	ReasonTransientError   = "TransientError"
+	ReasonAuthFailed       = "AuthenticationFailed"
+	ReasonPermissionDenied = "PermissionDenied"
+	ReasonDatabaseInUse    = "DatabaseInUse"
+	ReasonConfigError      = "ConfigurationError"
+
+	ReasonPartialCleanup = "PartialCleanup"
+	ReasonCleanupFailed  = "CleanupFailed"
+	ReasonDropBlocked    = "DropBlocked"
+
+	ReasonCreatingDatabase  = "CreatingDatabase"
+	ReasonDatabaseCreated   = "DatabaseCreated"
+	ReasonProvisioningError = "ProvisioningFailed"
+	ReasonMigrating         = "Migrating"
+	ReasonMigrationFailed   = "MigrationFailed"
+
+	ReasonSuspended = "Suspended"
+
+	ReasonAwaitingApproval    = "AwaitingApproval"
+	ReasonApproved            = "Approved"
+	ReasonApprovalInvalidated = "ApprovalInvalidated"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 
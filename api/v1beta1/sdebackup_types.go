@@ -0,0 +1,132 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// BackupFormat is the pg_dump output format
+// +kubebuilder:validation:Enum=custom;plain;directory;tar
+type BackupFormat string
+
+const (
+	BackupFormatCustom    BackupFormat = "custom"
+	BackupFormatPlain     BackupFormat = "plain"
+	BackupFormatDirectory BackupFormat = "directory"
+	BackupFormatTar       BackupFormat = "tar"
+)
+
+// JobPhase is the phase of a backup or restore run
+// +kubebuilder:validation:Enum=Pending;Running;Succeeded;Failed
+type JobPhase string
+
+const (
+	JobPending   JobPhase = "Pending"
+	JobRunning   JobPhase = "Running"
+	JobSucceeded JobPhase = "Succeeded"
+	JobFailed    JobPhase = "Failed"
+)
+
+// BackupStorage is the volume backups are written to
+type BackupStorage struct {
+	// PersistentVolumeClaim is the name of the claim holding backup files.
+	PersistentVolumeClaim string `json:"persistentVolumeClaim"`
+
+	// SubPath is the directory within the volume used for backups.
+	//+optional
+	SubPath string `json:"subPath,omitempty"`
+}
+
+// SdeBackupSpec defines the desired state of SdeBackup
+type SdeBackupSpec struct {
+	// Database is the versioned database to dump, e.g. sde_5.3.4. It must
+	// belong to an Sde in the namespace, whose job role the Job logs in as.
+	Database string `json:"database"`
+
+	// Storage is where the dump is written.
+	Storage BackupStorage `json:"storage"`
+
+	// Format is the pg_dump output format.
+	//+kubebuilder:default=custom
+	//+optional
+	Format BackupFormat `json:"format,omitempty"`
+}
+
+// JobRunStatus is the status shared by backup and restore runs
+type JobRunStatus struct {
+	//+optional
+	Phase JobPhase `json:"phase,omitempty"`
+
+	// Job is the name of the Job doing the work.
+	//+optional
+	Job string `json:"job,omitempty"`
+
+	// SizeBytes is the size of the dump or of the restored database.
+	//+optional
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+
+	//+optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	//+optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	//+optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	//+optional
+	Message string `json:"message,omitempty"`
+}
+
+// SdeBackupStatus defines the observed state of SdeBackup
+type SdeBackupStatus struct {
+	JobRunStatus `json:",inline"`
+
+	// Path is the location of the dump relative to the storage volume.
+	//+optional
+	Path string `json:"path,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Database",type=string,JSONPath=`.spec.database`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.sizeBytes`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SdeBackup is the Schema for the sdebackups API
+type SdeBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SdeBackupSpec   `json:"spec,omitempty"`
+	Status SdeBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SdeBackupList contains a list of SdeBackup
+type SdeBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SdeBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SdeBackup{}, &SdeBackupList{})
+}
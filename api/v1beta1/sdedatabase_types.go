@@ -0,0 +1,104 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConfirmDropAnnotation must be set to the database name on an SdeDatabase
+// for its deletion to drop the database. Without it, deleting the object
+// only removes it from the inventory until the next reconcile.
+const ConfirmDropAnnotation = "sde.domain/confirm-drop"
+
+// SdeDatabaseSpec identifies a database on the Sde's server
+type SdeDatabaseSpec struct {
+	// DatabaseName is the name of the database on the server.
+	DatabaseName string `json:"databaseName"`
+
+	// Pinned keeps the database regardless of any retention policy.
+	//+optional
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// RetentionVerdict is what retention decided for a database
+type RetentionVerdict string
+
+const (
+	VerdictKeep      RetentionVerdict = "Keep"
+	VerdictDrop      RetentionVerdict = "Drop"
+	VerdictPinned    RetentionVerdict = "Pinned"
+	VerdictSupported RetentionVerdict = "Supported"
+	// VerdictNotLive databases are migrating or quarantined and not considered
+	VerdictNotLive RetentionVerdict = "NotLive"
+)
+
+// SdeDatabaseStatus mirrors what the server reports for the database
+type SdeDatabaseStatus struct {
+	Version string `json:"version,omitempty"`
+
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+
+	// Owner is the role owning the database.
+	Owner string `json:"owner,omitempty"`
+
+	// OID of the database; CreationOrder ranks the Sde's databases by it,
+	// 1 being the oldest.
+	OID           int64 `json:"oid,omitempty"`
+	CreationOrder int32 `json:"creationOrder,omitempty"`
+
+	//+optional
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+
+	Verdict RetentionVerdict `json:"verdict,omitempty"`
+
+	// Reason names the policy behind a Drop verdict.
+	//+optional
+	Reason string `json:"reason,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Database",type=string,JSONPath=`.spec.databaseName`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.sizeBytes`
+//+kubebuilder:printcolumn:name="Pinned",type=boolean,JSONPath=`.spec.pinned`
+//+kubebuilder:printcolumn:name="Verdict",type=string,JSONPath=`.status.verdict`
+//+kubebuilder:printcolumn:name="Last Activity",type=date,JSONPath=`.status.lastActivity`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SdeDatabase is the Schema for the sdedatabases API. The Sde controller
+// keeps one per owned database.
+type SdeDatabase struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SdeDatabaseSpec   `json:"spec,omitempty"`
+	Status SdeDatabaseStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SdeDatabaseList contains a list of SdeDatabase
+type SdeDatabaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SdeDatabase `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SdeDatabase{}, &SdeDatabaseList{})
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SecretKeyReference points at a key of a Secret in a given namespace
+type SecretKeyReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+
+	//+optional
+	Key string `json:"key,omitempty"`
+}
+
+// ServerTLS configures TLS for connections to the server
+type ServerTLS struct {
+	// Mode is the libpq sslmode used to connect.
+	//+kubebuilder:validation:Enum=disable;require;verify-ca;verify-full
+	//+kubebuilder:default=require
+	//+optional
+	Mode string `json:"mode,omitempty"`
+
+	// CA references a PEM encoded CA certificate used by verify-ca and
+	// verify-full. The key defaults to ca.crt.
+	//+optional
+	CA *SecretKeyReference `json:"ca,omitempty"`
+}
+
+// SdeDatabaseServerSpec defines the desired state of SdeDatabaseServer
+type SdeDatabaseServerSpec struct {
+	Host string `json:"host"`
+
+	//+kubebuilder:default=5432
+	//+optional
+	Port int32 `json:"port,omitempty"`
+
+	// Database is the maintenance database the controller connects to.
+	//+kubebuilder:default=postgres
+	//+optional
+	Database string `json:"database,omitempty"`
+
+	//+optional
+	TLS *ServerTLS `json:"tls,omitempty"`
+
+	// CredentialsSecret holds the admin "username" and "password" keys.
+	CredentialsSecret SecretKeyReference `json:"credentialsSecret"`
+
+	// NamespaceSelector restricts which namespaces may use the server. An
+	// empty selector allows every namespace.
+	//+optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// HealthCheckInterval is how often the server's connectivity is checked.
+	//+kubebuilder:default="1m"
+	//+optional
+	HealthCheckInterval *metav1.Duration `json:"healthCheckInterval,omitempty"`
+}
+
+// SdeDatabaseServerStatus defines the observed state of SdeDatabaseServer
+type SdeDatabaseServerStatus struct {
+	// ServerVersion is the version reported by the server at the last check.
+	//+optional
+	ServerVersion string `json:"serverVersion,omitempty"`
+
+	//+optional
+	LastCheckTime *metav1.Time `json:"lastCheckTime,omitempty"`
+
+	//+patchMergeKey=type
+	//+patchStrategy=merge
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// Condition types and reasons reported on an SdeDatabaseServer
+const (
+	ConditionReady = "Ready"
+
+	ReasonConnected        = "Connected"
+	ReasonConnectionFailed = "ConnectionFailed"
+	ReasonCredentialsError = "CredentialsUnavailable"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Host",type=string,JSONPath=`.spec.host`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.serverVersion`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SdeDatabaseServer is the Schema for the sdedatabaseservers API
+type SdeDatabaseServer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SdeDatabaseServerSpec   `json:"spec,omitempty"`
+	Status SdeDatabaseServerStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SdeDatabaseServerList contains a list of SdeDatabaseServer
+type SdeDatabaseServerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SdeDatabaseServer `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SdeDatabaseServer{}, &SdeDatabaseServerList{})
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SdeReleaseSpec describes one SDE version and its support window
+type SdeReleaseSpec struct {
+	// Version matches the part of the database name after "sde_".
+	Version string `json:"version"`
+
+	// ReleaseDate is when the version was released, as YYYY-MM-DD.
+	//+kubebuilder:validation:Format=date
+	//+optional
+	ReleaseDate string `json:"releaseDate,omitempty"`
+
+	// EndOfLife is the last day the version is supported, as YYYY-MM-DD.
+	// Versions without one are supported.
+	//+kubebuilder:validation:Format=date
+	//+optional
+	EndOfLife string `json:"endOfLife,omitempty"`
+
+	// LTS marks long term support releases.
+	//+optional
+	LTS bool `json:"lts,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.spec.version`
+//+kubebuilder:printcolumn:name="Released",type=string,JSONPath=`.spec.releaseDate`
+//+kubebuilder:printcolumn:name="EOL",type=string,JSONPath=`.spec.endOfLife`
+//+kubebuilder:printcolumn:name="LTS",type=boolean,JSONPath=`.spec.lts`
+
+// SdeRelease is the Schema for the sdereleases API. Together they form the
+// catalog of SDE versions used by lifecycle retention.
+type SdeRelease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SdeReleaseSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SdeReleaseList contains a list of SdeRelease
+type SdeReleaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SdeRelease `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SdeRelease{}, &SdeReleaseList{})
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OverwritePolicy decides what happens when the restore target already exists
+// +kubebuilder:validation:Enum=Never;Replace
+type OverwritePolicy string
+
+const (
+	// OverwriteNever fails the restore if the target database exists
+	OverwriteNever OverwritePolicy = "Never"
+	// OverwriteReplace has the controller drop an existing target database
+	// owned by an Sde before restoring into a new one
+	OverwriteReplace OverwritePolicy = "Replace"
+)
+
+// SdeRestoreSpec defines the desired state of SdeRestore
+type SdeRestoreSpec struct {
+	// BackupName is the SdeBackup in the same namespace to restore from.
+	BackupName string `json:"backupName"`
+
+	// TargetDatabase is the database the backup is restored into. It must
+	// belong to an Sde in the namespace, whose job role the Job logs in as.
+	TargetDatabase string `json:"targetDatabase"`
+
+	//+kubebuilder:default=Never
+	//+optional
+	OverwritePolicy OverwritePolicy `json:"overwritePolicy,omitempty"`
+}
+
+// SdeRestoreStatus defines the observed state of SdeRestore
+type SdeRestoreStatus struct {
+	JobRunStatus `json:",inline"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Backup",type=string,JSONPath=`.spec.backupName`
+//+kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.spec.targetDatabase`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// SdeRestore is the Schema for the sderestores API
+type SdeRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SdeRestoreSpec   `json:"spec,omitempty"`
+	Status SdeRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// SdeRestoreList contains a list of SdeRestore
+type SdeRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SdeRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SdeRestore{}, &SdeRestoreList{})
+}
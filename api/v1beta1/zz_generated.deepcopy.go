@@ -23,11 +23,546 @@ package v1beta1
 
 import (
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BackupStorage) DeepCopyInto(out *BackupStorage) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BackupStorage.
+func (in *BackupStorage) DeepCopy() *BackupStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(BackupStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Blocker) DeepCopyInto(out *Blocker) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Blocker.
+func (in *Blocker) DeepCopy() *Blocker {
+	if in == nil {
+		return nil
+	}
+	out := new(Blocker)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CleanupResult) DeepCopyInto(out *CleanupResult) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	if in.Databases != nil {
+		in, out := &in.Databases, &out.Databases
+		*out = make([]DatabaseResult, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CleanupResult.
+func (in *CleanupResult) DeepCopy() *CleanupResult {
+	if in == nil {
+		return nil
+	}
+	out := new(CleanupResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CleanupSpec) DeepCopyInto(out *CleanupSpec) {
+	*out = *in
+	if in.FailureBudget != nil {
+		in, out := &in.FailureBudget, &out.FailureBudget
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CleanupSpec.
+func (in *CleanupSpec) DeepCopy() *CleanupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CleanupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CleanupStep) DeepCopyInto(out *CleanupStep) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CleanupStep.
+func (in *CleanupStep) DeepCopy() *CleanupStep {
+	if in == nil {
+		return nil
+	}
+	out := new(CleanupStep)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseActivity) DeepCopyInto(out *DatabaseActivity) {
+	*out = *in
+	in.LastActivity.DeepCopyInto(&out.LastActivity)
+	if in.StatsReset != nil {
+		in, out := &in.StatsReset, &out.StatsReset
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseActivity.
+func (in *DatabaseActivity) DeepCopy() *DatabaseActivity {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseActivity)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseResult) DeepCopyInto(out *DatabaseResult) {
+	*out = *in
+	if in.Blockers != nil {
+		in, out := &in.Blockers, &out.Blockers
+		*out = make([]Blocker, len(*in))
+		copy(*out, *in)
+	}
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]CleanupStep, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseResult.
+func (in *DatabaseResult) DeepCopy() *DatabaseResult {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseResult)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseState) DeepCopyInto(out *DatabaseState) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseState.
+func (in *DatabaseState) DeepCopy() *DatabaseState {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseState)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IdlePolicy) DeepCopyInto(out *IdlePolicy) {
+	*out = *in
+	out.After = in.After
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IdlePolicy.
+func (in *IdlePolicy) DeepCopy() *IdlePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(IdlePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JobRunStatus) DeepCopyInto(out *JobRunStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+	if in.CompletionTime != nil {
+		in, out := &in.CompletionTime, &out.CompletionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Duration != nil {
+		in, out := &in.Duration, &out.Duration
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JobRunStatus.
+func (in *JobRunStatus) DeepCopy() *JobRunStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(JobRunStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LifecyclePolicy) DeepCopyInto(out *LifecyclePolicy) {
+	*out = *in
+	out.GracePeriod = in.GracePeriod
+	if in.ReleaseSelector != nil {
+		in, out := &in.ReleaseSelector, &out.ReleaseSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LifecyclePolicy.
+func (in *LifecyclePolicy) DeepCopy() *LifecyclePolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(LifecyclePolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Notification) DeepCopyInto(out *Notification) {
+	*out = *in
+	if in.SigningKey != nil {
+		in, out := &in.SigningKey, &out.SigningKey
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Events != nil {
+		in, out := &in.Events, &out.Events
+		*out = make([]NotificationEvent, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Notification.
+func (in *Notification) DeepCopy() *Notification {
+	if in == nil {
+		return nil
+	}
+	out := new(Notification)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PlannedDrop) DeepCopyInto(out *PlannedDrop) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PlannedDrop.
+func (in *PlannedDrop) DeepCopy() *PlannedDrop {
+	if in == nil {
+		return nil
+	}
+	out := new(PlannedDrop)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProvisioningSpec) DeepCopyInto(out *ProvisioningSpec) {
+	*out = *in
+	if in.Extensions != nil {
+		in, out := &in.Extensions, &out.Extensions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProvisioningSpec.
+func (in *ProvisioningSpec) DeepCopy() *ProvisioningSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ProvisioningSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReconcileError) DeepCopyInto(out *ReconcileError) {
+	*out = *in
+	in.LastTime.DeepCopyInto(&out.LastTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReconcileError.
+func (in *ReconcileError) DeepCopy() *ReconcileError {
+	if in == nil {
+		return nil
+	}
+	out := new(ReconcileError)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReleaseLine) DeepCopyInto(out *ReleaseLine) {
+	*out = *in
+	if in.Keep != nil {
+		in, out := &in.Keep, &out.Keep
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Drop != nil {
+		in, out := &in.Drop, &out.Drop
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReleaseLine.
+func (in *ReleaseLine) DeepCopy() *ReleaseLine {
+	if in == nil {
+		return nil
+	}
+	out := new(ReleaseLine)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReleaseLinesPolicy) DeepCopyInto(out *ReleaseLinesPolicy) {
+	*out = *in
+	if in.PerLine != nil {
+		in, out := &in.PerLine, &out.PerLine
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Lines != nil {
+		in, out := &in.Lines, &out.Lines
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReleaseLinesPolicy.
+func (in *ReleaseLinesPolicy) DeepCopy() *ReleaseLinesPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(ReleaseLinesPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RetentionPlan) DeepCopyInto(out *RetentionPlan) {
+	*out = *in
+	if in.Drop != nil {
+		in, out := &in.Drop, &out.Drop
+		*out = make([]PlannedDrop, len(*in))
+		copy(*out, *in)
+	}
+	if in.Lines != nil {
+		in, out := &in.Lines, &out.Lines
+		*out = make([]ReleaseLine, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Supported != nil {
+		in, out := &in.Supported, &out.Supported
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Pinned != nil {
+		in, out := &in.Pinned, &out.Pinned
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RetentionPlan.
+func (in *RetentionPlan) DeepCopy() *RetentionPlan {
+	if in == nil {
+		return nil
+	}
+	out := new(RetentionPlan)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RetentionSpec) DeepCopyInto(out *RetentionSpec) {
+	*out = *in
+	if in.MaxTotalSize != nil {
+		in, out := &in.MaxTotalSize, &out.MaxTotalSize
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.MinCount != nil {
+		in, out := &in.MinCount, &out.MinCount
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Idle != nil {
+		in, out := &in.Idle, &out.Idle
+		*out = new(IdlePolicy)
+		**out = **in
+	}
+	if in.ReleaseLines != nil {
+		in, out := &in.ReleaseLines, &out.ReleaseLines
+		*out = new(ReleaseLinesPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Lifecycle != nil {
+		in, out := &in.Lifecycle, &out.Lifecycle
+		*out = new(LifecyclePolicy)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RetentionSpec.
+func (in *RetentionSpec) DeepCopy() *RetentionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RetentionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Sde) DeepCopyInto(out *Sde) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Sde.
+func (in *Sde) DeepCopy() *Sde {
+	if in == nil {
+		return nil
+	}
+	out := new(Sde)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Sde) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeBackup) DeepCopyInto(out *SdeBackup) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeBackup.
+func (in *SdeBackup) DeepCopy() *SdeBackup {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeBackup)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeBackup) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeBackupList) DeepCopyInto(out *SdeBackupList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SdeBackup, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeBackupList.
+func (in *SdeBackupList) DeepCopy() *SdeBackupList {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeBackupList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeBackupList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeBackupSpec) DeepCopyInto(out *SdeBackupSpec) {
+	*out = *in
+	out.Storage = in.Storage
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeBackupSpec.
+func (in *SdeBackupSpec) DeepCopy() *SdeBackupSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeBackupSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeBackupStatus) DeepCopyInto(out *SdeBackupStatus) {
+	*out = *in
+	in.JobRunStatus.DeepCopyInto(&out.JobRunStatus)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeBackupStatus.
+func (in *SdeBackupStatus) DeepCopy() *SdeBackupStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeBackupStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabase) DeepCopyInto(out *SdeDatabase) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
@@ -35,24 +570,206 @@ func (in *Sde) DeepCopyInto(out *Sde) {
 	in.Status.DeepCopyInto(&out.Status)
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Sde.
-func (in *Sde) DeepCopy() *Sde {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabase.
+func (in *SdeDatabase) DeepCopy() *SdeDatabase {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabase)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeDatabase) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseList) DeepCopyInto(out *SdeDatabaseList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SdeDatabase, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseList.
+func (in *SdeDatabaseList) DeepCopy() *SdeDatabaseList {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabaseList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeDatabaseList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseServer) DeepCopyInto(out *SdeDatabaseServer) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseServer.
+func (in *SdeDatabaseServer) DeepCopy() *SdeDatabaseServer {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabaseServer)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeDatabaseServer) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseServerList) DeepCopyInto(out *SdeDatabaseServerList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SdeDatabaseServer, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseServerList.
+func (in *SdeDatabaseServerList) DeepCopy() *SdeDatabaseServerList {
 	if in == nil {
 		return nil
 	}
-	out := new(Sde)
+	out := new(SdeDatabaseServerList)
 	in.DeepCopyInto(out)
 	return out
 }
 
 // DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
-func (in *Sde) DeepCopyObject() runtime.Object {
+func (in *SdeDatabaseServerList) DeepCopyObject() runtime.Object {
 	if c := in.DeepCopy(); c != nil {
 		return c
 	}
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseServerSpec) DeepCopyInto(out *SdeDatabaseServerSpec) {
+	*out = *in
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(ServerTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	out.CredentialsSecret = in.CredentialsSecret
+	if in.NamespaceSelector != nil {
+		in, out := &in.NamespaceSelector, &out.NamespaceSelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.HealthCheckInterval != nil {
+		in, out := &in.HealthCheckInterval, &out.HealthCheckInterval
+		*out = new(metav1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseServerSpec.
+func (in *SdeDatabaseServerSpec) DeepCopy() *SdeDatabaseServerSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabaseServerSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseServerStatus) DeepCopyInto(out *SdeDatabaseServerStatus) {
+	*out = *in
+	if in.LastCheckTime != nil {
+		in, out := &in.LastCheckTime, &out.LastCheckTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseServerStatus.
+func (in *SdeDatabaseServerStatus) DeepCopy() *SdeDatabaseServerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabaseServerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseSpec) DeepCopyInto(out *SdeDatabaseSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseSpec.
+func (in *SdeDatabaseSpec) DeepCopy() *SdeDatabaseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabaseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeDatabaseStatus) DeepCopyInto(out *SdeDatabaseStatus) {
+	*out = *in
+	if in.LastActivity != nil {
+		in, out := &in.LastActivity, &out.LastActivity
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeDatabaseStatus.
+func (in *SdeDatabaseStatus) DeepCopy() *SdeDatabaseStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeDatabaseStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SdeList) DeepCopyInto(out *SdeList) {
 	*out = *in
@@ -85,9 +802,204 @@ func (in *SdeList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeRelease) DeepCopyInto(out *SdeRelease) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeRelease.
+func (in *SdeRelease) DeepCopy() *SdeRelease {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeRelease)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeRelease) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeReleaseList) DeepCopyInto(out *SdeReleaseList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SdeRelease, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeReleaseList.
+func (in *SdeReleaseList) DeepCopy() *SdeReleaseList {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeReleaseList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeReleaseList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeReleaseSpec) DeepCopyInto(out *SdeReleaseSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeReleaseSpec.
+func (in *SdeReleaseSpec) DeepCopy() *SdeReleaseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeReleaseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeRestore) DeepCopyInto(out *SdeRestore) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeRestore.
+func (in *SdeRestore) DeepCopy() *SdeRestore {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeRestore)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeRestore) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeRestoreList) DeepCopyInto(out *SdeRestoreList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]SdeRestore, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeRestoreList.
+func (in *SdeRestoreList) DeepCopy() *SdeRestoreList {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeRestoreList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *SdeRestoreList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeRestoreSpec) DeepCopyInto(out *SdeRestoreSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeRestoreSpec.
+func (in *SdeRestoreSpec) DeepCopy() *SdeRestoreSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeRestoreSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SdeRestoreStatus) DeepCopyInto(out *SdeRestoreStatus) {
+	*out = *in
+	in.JobRunStatus.DeepCopyInto(&out.JobRunStatus)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeRestoreStatus.
+func (in *SdeRestoreStatus) DeepCopy() *SdeRestoreStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(SdeRestoreStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SdeSpec) DeepCopyInto(out *SdeSpec) {
 	*out = *in
+	if in.Versioning != nil {
+		in, out := &in.Versioning, &out.Versioning
+		*out = new(VersioningSpec)
+		**out = **in
+	}
+	if in.Provisioning != nil {
+		in, out := &in.Provisioning, &out.Provisioning
+		*out = new(ProvisioningSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Cleanup != nil {
+		in, out := &in.Cleanup, &out.Cleanup
+		*out = new(CleanupSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Retention != nil {
+		in, out := &in.Retention, &out.Retention
+		*out = new(RetentionSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Notifications != nil {
+		in, out := &in.Notifications, &out.Notifications
+		*out = make([]Notification, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Migration != nil {
+		in, out := &in.Migration, &out.Migration
+		*out = new(v1.PodTemplateSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeSpec.
@@ -108,6 +1020,50 @@ func (in *SdeStatus) DeepCopyInto(out *SdeStatus) {
 		*out = make([]v1.ObjectReference, len(*in))
 		copy(*out, *in)
 	}
+	if in.Databases != nil {
+		in, out := &in.Databases, &out.Databases
+		*out = make([]DatabaseState, len(*in))
+		copy(*out, *in)
+	}
+	if in.UnownedDatabases != nil {
+		in, out := &in.UnownedDatabases, &out.UnownedDatabases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.LastCleanup != nil {
+		in, out := &in.LastCleanup, &out.LastCleanup
+		*out = new(CleanupResult)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Plan != nil {
+		in, out := &in.Plan, &out.Plan
+		*out = new(RetentionPlan)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Activity != nil {
+		in, out := &in.Activity, &out.Activity
+		*out = make([]DatabaseActivity, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(StorageStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastError != nil {
+		in, out := &in.LastError, &out.LastError
+		*out = new(ReconcileError)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SdeStatus.
@@ -119,3 +1075,69 @@ func (in *SdeStatus) DeepCopy() *SdeStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretKeyReference) DeepCopyInto(out *SecretKeyReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretKeyReference.
+func (in *SecretKeyReference) DeepCopy() *SecretKeyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretKeyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServerTLS) DeepCopyInto(out *ServerTLS) {
+	*out = *in
+	if in.CA != nil {
+		in, out := &in.CA, &out.CA
+		*out = new(SecretKeyReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServerTLS.
+func (in *ServerTLS) DeepCopy() *ServerTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(ServerTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StorageStatus) DeepCopyInto(out *StorageStatus) {
+	*out = *in
+	in.MeasureTime.DeepCopyInto(&out.MeasureTime)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StorageStatus.
+func (in *StorageStatus) DeepCopy() *StorageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StorageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VersioningSpec) DeepCopyInto(out *VersioningSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VersioningSpec.
+func (in *VersioningSpec) DeepCopy() *VersioningSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VersioningSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sde.domain/sdeController/controllers"
+)
+
+type cli struct {
+	client        client.Client
+	namespace     string
+	allNamespaces bool
+	output        string
+	in            io.Reader
+	out           io.Writer
+	now           func() time.Time
+}
+
+func (c *cli) dispatch(ctx context.Context, command string, args []string) error {
+	want := map[string]int{"list": -1, "plan": 1, "pin": 2, "unpin": 2, "run-now": 1, "suspend": 1, "resume": 1}
+	n, ok := want[command]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown command %q", command)
+	case n >= 0 && len(args) != n:
+		return fmt.Errorf("%s takes %d arguments, got %d", command, n, len(args))
+	case n < 0 && len(args) > 1:
+		return fmt.Errorf("%s takes at most one argument", command)
+	}
+
+	switch command {
+	case "list":
+		return c.list(ctx, args)
+	case "plan":
+		return c.plan(ctx, args[0])
+	case "pin", "unpin":
+		return c.pin(ctx, args[0], args[1], command == "pin")
+	case "run-now":
+		return c.runNow(ctx, args[0])
+	}
+	return c.suspend(ctx, args[0], command == "suspend")
+}
+
+// inventoryRow is one owned database as listed by "list"
+type inventoryRow struct {
+	Namespace    string                      `json:"namespace"`
+	Sde          string                      `json:"sde"`
+	Database     string                      `json:"database"`
+	Version      string                      `json:"version,omitempty"`
+	SizeBytes    int64                       `json:"sizeBytes"`
+	Pinned       bool                        `json:"pinned,omitempty"`
+	Verdict      sdev1beta1.RetentionVerdict `json:"verdict,omitempty"`
+	Reason       string                      `json:"reason,omitempty"`
+	LastActivity *metav1.Time                `json:"lastActivity,omitempty"`
+}
+
+// planReport is the output of "plan"
+type planReport struct {
+	Namespace string `json:"namespace"`
+	Sde       string `json:"sde"`
+	Hash      string `json:"hash,omitempty"`
+	// ControllerHash is the plan the controller last published; it differs
+	// from Hash when the inventory changed since
+	ControllerHash string                    `json:"controllerHash,omitempty"`
+	Approval       string                    `json:"approval"`
+	Suspended      bool                      `json:"suspended,omitempty"`
+	Databases      []plannedRow              `json:"databases"`
+	Lines          []sdev1beta1.ReleaseLine  `json:"lines,omitempty"`
+	Storage        *sdev1beta1.StorageStatus `json:"storage,omitempty"`
+}
+
+type plannedRow struct {
+	controllers.PlannedDatabase
+	SizeBytes int64 `json:"sizeBytes"`
+}
+
+func (c *cli) getSde(ctx context.Context, name string) (*sdev1beta1.Sde, error) {
+	sde := &sdev1beta1.Sde{}
+	err := c.client.Get(ctx, types.NamespacedName{Name: name, Namespace: c.namespace}, sde)
+	return sde, err
+}
+
+// databases returns the SdeDatabases the controller keeps for sde, leaving
+// out those being deleted
+func (c *cli) databases(ctx context.Context, sde *sdev1beta1.Sde) ([]sdev1beta1.SdeDatabase, error) {
+	list := &sdev1beta1.SdeDatabaseList{}
+	err := c.client.List(ctx, list, client.InNamespace(sde.Namespace), client.MatchingLabels{"sde.domain/sde": sde.Name})
+	if err != nil {
+		return nil, err
+	}
+	var objs []sdev1beta1.SdeDatabase
+	for _, obj := range list.Items {
+		if metav1.IsControlledBy(&obj, sde) && obj.DeletionTimestamp.IsZero() {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+func (c *cli) list(ctx context.Context, args []string) error {
+	var sdes []sdev1beta1.Sde
+	if len(args) == 1 {
+		sde, err := c.getSde(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		sdes = append(sdes, *sde)
+	} else {
+		list := &sdev1beta1.SdeList{}
+		var opts []client.ListOption
+		if !c.allNamespaces {
+			opts = append(opts, client.InNamespace(c.namespace))
+		}
+		if err := c.client.List(ctx, list, opts...); err != nil {
+			return err
+		}
+		sdes = list.Items
+	}
+
+	rows := []inventoryRow{}
+	for i := range sdes {
+		sde := &sdes[i]
+		objs, err := c.databases(ctx, sde)
+		if err != nil {
+			return err
+		}
+		byName := map[string]sdev1beta1.SdeDatabase{}
+		var names []string
+		for _, obj := range objs {
+			byName[obj.Spec.DatabaseName] = obj
+			names = append(names, obj.Spec.DatabaseName)
+		}
+		controllers.SortDatabases(sde, names)
+		for _, name := range names {
+			obj := byName[name]
+			rows = append(rows, inventoryRow{
+				Namespace:    sde.Namespace,
+				Sde:          sde.Name,
+				Database:     name,
+				Version:      obj.Status.Version,
+				SizeBytes:    obj.Status.SizeBytes,
+				Pinned:       obj.Spec.Pinned,
+				Verdict:      obj.Status.Verdict,
+				Reason:       obj.Status.Reason,
+				LastActivity: obj.Status.LastActivity,
+			})
+		}
+	}
+	return c.print(rows, func(t *table) {
+		t.header("NAMESPACE", "SDE", "DATABASE", "VERSION", "SIZE", "PINNED", "VERDICT", "LAST ACTIVITY")
+		for _, row := range rows {
+			verdict := string(row.Verdict)
+			if row.Reason != "" {
+				verdict += " (" + row.Reason + ")"
+			}
+			t.row(row.Namespace, row.Sde, row.Database, row.Version, formatBytes(row.SizeBytes),
+				fmt.Sprint(row.Pinned), verdict, c.age(row.LastActivity))
+		}
+		if !c.allNamespaces {
+			t.dropColumn(0)
+		}
+	})
+}
+
+// plan recomputes retention for sde from its inventory with the controller's
+// own planning code
+func (c *cli) plan(ctx context.Context, name string) error {
+	sde, err := c.getSde(ctx, name)
+	if err != nil {
+		return err
+	}
+	objs, err := c.databases(ctx, sde)
+	if err != nil {
+		return err
+	}
+
+	// Every database is listed, but PlanRetention plans only those
+	// controllers.LiveDatabases keeps, as the controller does; the rest come
+	// back NotLive
+	input := controllers.PlanInput{Sizes: map[string]int64{}, Activity: sde.Status.Activity, Now: c.now()}
+	for _, obj := range objs {
+		input.Databases = append(input.Databases, obj.Spec.DatabaseName)
+		input.Sizes[obj.Spec.DatabaseName] = obj.Status.SizeBytes
+		if obj.Spec.Pinned {
+			input.Pinned = append(input.Pinned, obj.Spec.DatabaseName)
+		}
+	}
+	if p := sde.Spec.Retention; p != nil && p.Lifecycle != nil {
+		list := &sdev1beta1.SdeReleaseList{}
+		var opts []client.ListOption
+		if p.Lifecycle.ReleaseSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(p.Lifecycle.ReleaseSelector)
+			if err != nil {
+				return fmt.Errorf("invalid release selector: %w", err)
+			}
+			opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+		}
+		if err := c.client.List(ctx, list, opts...); err != nil {
+			return err
+		}
+		input.Releases = list.Items
+	}
+
+	preview := controllers.PlanRetention(sde, input)
+	report := planReport{
+		Namespace: sde.Namespace,
+		Sde:       sde.Name,
+		Hash:      preview.Plan.Hash,
+		Approval:  string(sdev1beta1.ApprovalAutomatic),
+		Suspended: sde.Spec.Suspend,
+		Lines:     preview.Plan.Lines,
+		Storage:   preview.Storage,
+	}
+	for _, db := range preview.Databases {
+		report.Databases = append(report.Databases, plannedRow{PlannedDatabase: db, SizeBytes: input.Sizes[db.Name]})
+	}
+	if sde.Status.Plan != nil {
+		report.ControllerHash = sde.Status.Plan.Hash
+	}
+	if sde.Spec.Approval == sdev1beta1.ApprovalManual {
+		report.Approval = string(sdev1beta1.ApprovalManual)
+		if cond := meta.FindStatusCondition(sde.Status.Conditions, sdev1beta1.ConditionPlanApproved); cond != nil {
+			report.Approval += ", " + cond.Reason
+		}
+	}
+
+	return c.print(report, func(t *table) {
+		t.header("DATABASE", "SIZE", "VERDICT", "REASON")
+		for _, db := range report.Databases {
+			t.row(db.Name, formatBytes(db.SizeBytes), string(db.Verdict), db.Reason)
+		}
+		t.footer(fmt.Sprintf("Plan %s, approval %s", orNone(report.Hash), report.Approval))
+		if report.ControllerHash != report.Hash {
+			t.footer(fmt.Sprintf("The controller last planned %s; the inventory changed since", orNone(report.ControllerHash)))
+		}
+		if s := report.Storage; s != nil {
+			t.footer(fmt.Sprintf("Storage %s of %s, %s to reclaim",
+				formatBytes(s.TotalBytes), formatBytes(s.MaxTotalBytes), formatBytes(s.ProjectedReclaimBytes)))
+		}
+		if report.Suspended {
+			t.footer("Suspended: nothing is dropped until resumed")
+		}
+	})
+}
+
+func (c *cli) pin(ctx context.Context, sdeName, dbName string, pinned bool) error {
+	sde, err := c.getSde(ctx, sdeName)
+	if err != nil {
+		return err
+	}
+	objs, err := c.databases(ctx, sde)
+	if err != nil {
+		return err
+	}
+	for i := range objs {
+		obj := &objs[i]
+		if obj.Spec.DatabaseName != dbName && obj.Name != dbName {
+			continue
+		}
+		patch := client.MergeFrom(obj.DeepCopy())
+		obj.Spec.Pinned = pinned
+		if err := c.client.Patch(ctx, obj, patch); err != nil {
+			return err
+		}
+		verb := "pinned"
+		if !pinned {
+			verb = "unpinned"
+		}
+		fmt.Fprintf(c.out, "sdedatabase/%s %s\n", obj.Name, verb)
+		return nil
+	}
+	return fmt.Errorf("sde %s has no database %s", sdeName, dbName)
+}
+
+func (c *cli) runNow(ctx context.Context, name string) error {
+	sde, err := c.getSde(ctx, name)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(sde.DeepCopy())
+	if sde.Annotations == nil {
+		sde.Annotations = map[string]string{}
+	}
+	sde.Annotations[sdev1beta1.RunNowAnnotation] = c.now().UTC().Format(time.RFC3339Nano)
+	if err := c.client.Patch(ctx, sde, patch); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "sde/%s triggered\n", sde.Name)
+	if sde.Spec.Suspend {
+		fmt.Fprintln(c.out, "note: the Sde is suspended, so the reconcile does nothing")
+	}
+	return nil
+}
+
+func (c *cli) suspend(ctx context.Context, name string, suspend bool) error {
+	sde, err := c.getSde(ctx, name)
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(sde.DeepCopy())
+	sde.Spec.Suspend = suspend
+	if err := c.client.Patch(ctx, sde, patch); err != nil {
+		return err
+	}
+	verb := "suspended"
+	if !suspend {
+		verb = "resumed"
+	}
+	fmt.Fprintf(c.out, "sde/%s %s\n", sde.Name, verb)
+	return nil
+}
+
+// age renders a timestamp the way kubectl does, e.g. "5h" ago
+func (c *cli) age(t *metav1.Time) string {
+	return c.ageAt(t, c.now())
+}
+
+func (c *cli) ageAt(t *metav1.Time, now time.Time) string {
+	if t == nil {
+		return "<none>"
+	}
+	d := now.Sub(t.Time)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
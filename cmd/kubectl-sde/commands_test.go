@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func testCli(t *testing.T) (*cli, *bytes.Buffer) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{
+		ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns", UID: "uid"},
+		Spec:       sdev1beta1.SdeSpec{DatabaseCount: 1},
+	}
+	objs := []client.Object{sde}
+	for _, name := range []string{"sde_5.10.0", "sde_5.2.0", "sde_5.9.0"} {
+		objs = append(objs, &sdev1beta1.SdeDatabase{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "sde-" + name[4:], Namespace: "ns",
+				Labels: map[string]string{"sde.domain/sde": "sde"},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: sdev1beta1.GroupVersion.String(), Kind: "Sde", Name: "sde", UID: "uid", Controller: pointer.Bool(true),
+				}},
+			},
+			Spec:   sdev1beta1.SdeDatabaseSpec{DatabaseName: name},
+			Status: sdev1beta1.SdeDatabaseStatus{SizeBytes: 3 << 30, Version: name[4:]},
+		})
+	}
+
+	out := &bytes.Buffer{}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &cli{client: c, namespace: "ns", output: "table", out: out, now: func() time.Time { return now }}, out
+}
+
+func TestListAndPlan(t *testing.T) {
+	ctx := context.Background()
+	c, out := testCli(t)
+
+	// Databases are listed in version order, not by name
+	c.output = "json"
+	assert.NoError(t, c.dispatch(ctx, "list", nil))
+	var rows []inventoryRow
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &rows))
+	var names []string
+	for _, row := range rows {
+		names = append(names, row.Database)
+	}
+	assert.Equal(t, []string{"sde_5.2.0", "sde_5.9.0", "sde_5.10.0"}, names)
+
+	out.Reset()
+	assert.NoError(t, c.dispatch(ctx, "pin", []string{"sde", "sde_5.2.0"}))
+	assert.Equal(t, "sdedatabase/sde-5.2.0 pinned\n", out.String())
+
+	out.Reset()
+	c.output = "table"
+	assert.NoError(t, c.dispatch(ctx, "plan", []string{"sde"}))
+	assert.Regexp(t, `sde_5.2.0\s+3.0Gi\s+Pinned`, out.String())
+	assert.Regexp(t, `sde_5.9.0\s+3.0Gi\s+Drop\s+DatabaseCount`, out.String())
+	assert.Regexp(t, `sde_5.10.0\s+3.0Gi\s+Keep`, out.String())
+	assert.Contains(t, out.String(), "The controller last planned <none>")
+
+	assert.Error(t, c.dispatch(ctx, "pin", []string{"sde", "sde_6.0.0"}))
+	assert.Error(t, c.dispatch(ctx, "plan", nil))
+}
+
+func TestSuspendAndRunNow(t *testing.T) {
+	ctx := context.Background()
+	c, _ := testCli(t)
+
+	assert.NoError(t, c.dispatch(ctx, "suspend", []string{"sde"}))
+	assert.NoError(t, c.dispatch(ctx, "run-now", []string{"sde"}))
+
+	sde := &sdev1beta1.Sde{}
+	assert.NoError(t, c.client.Get(ctx, types.NamespacedName{Name: "sde", Namespace: "ns"}, sde))
+	assert.True(t, sde.Spec.Suspend)
+	assert.Equal(t, "2024-01-01T00:00:00Z", sde.Annotations[sdev1beta1.RunNowAnnotation])
+
+	assert.NoError(t, c.dispatch(ctx, "resume", []string{"sde"}))
+	assert.NoError(t, c.client.Get(ctx, types.NamespacedName{Name: "sde", Namespace: "ns"}, sde))
+	assert.False(t, sde.Spec.Suspend)
+}
+
+func TestPlanLeavesOutMigrating(t *testing.T) {
+	ctx := context.Background()
+	c, out := testCli(t)
+
+	sde := &sdev1beta1.Sde{}
+	assert.NoError(t, c.client.Get(ctx, types.NamespacedName{Name: "sde", Namespace: "ns"}, sde))
+	sde.Status.Databases = []sdev1beta1.DatabaseState{{Name: "sde_5.10.0", Phase: sdev1beta1.DatabaseMigrating}}
+	assert.NoError(t, c.client.Status().Update(ctx, sde))
+
+	// The migrating database neither counts towards databaseCount nor is dropped
+	assert.NoError(t, c.dispatch(ctx, "plan", []string{"sde"}))
+	assert.Regexp(t, `sde_5.2.0\s+3.0Gi\s+Drop\s+DatabaseCount`, out.String())
+	assert.Regexp(t, `sde_5.9.0\s+3.0Gi\s+Keep`, out.String())
+	assert.Regexp(t, `sde_5.10.0\s+3.0Gi\s+NotLive`, out.String())
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-sde inspects and operates Sde retention. Installed on the PATH it
+// runs as "kubectl sde".
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/pflag"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+const usage = `Inspect and operate Sde database retention.
+
+Usage:
+  kubectl sde list [<sde>]              owned databases with sizes and verdicts
+  kubectl sde plan <sde>                what retention would drop, and why
+  kubectl sde pin <sde> <database>      never drop the database
+  kubectl sde unpin <sde> <database>    let retention drop the database again
+  kubectl sde run-now <sde>             reconcile immediately
+  kubectl sde suspend <sde>             stop provisioning and retention
+  kubectl sde resume <sde>              undo suspend
+  kubectl sde simulate -f <sde.yaml> [<names file>|-]
+                                        plan retention offline for a list of
+                                        "name [size] [last activity]" lines;
+                                        fails when the plan breaks safety rails
+
+Flags:
+`
+
+type options struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+	output        string
+	simulate      simulateOptions
+}
+
+func main() {
+	if err := run(context.Background(), os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, in io.Reader, out io.Writer) error {
+	var opts options
+	flags := pflag.NewFlagSet("kubectl-sde", pflag.ContinueOnError)
+	flags.StringVar(&opts.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	flags.StringVar(&opts.context, "context", "", "The kubeconfig context to use.")
+	flags.StringVarP(&opts.namespace, "namespace", "n", "", "The namespace of the Sde.")
+	flags.BoolVarP(&opts.allNamespaces, "all-namespaces", "A", false, "List Sdes in all namespaces.")
+	flags.StringVarP(&opts.output, "output", "o", "table", "Output format: table, json or yaml.")
+	flags.StringVarP(&opts.simulate.filename, "filename", "f", "", "simulate: the Sde manifest, optionally with SdeReleases.")
+	flags.IntVar(&opts.simulate.maxDrops, "max-drops", -1, "simulate: fail when more databases would be dropped.")
+	flags.StringVar(&opts.simulate.now, "now", "", "simulate: the RFC 3339 time to plan at instead of the current time.")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if opts.output != "table" && opts.output != "json" && opts.output != "yaml" {
+		return fmt.Errorf("unknown output format %q", opts.output)
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no command given")
+	}
+
+	cmd := &cli{allNamespaces: opts.allNamespaces, output: opts.output, in: in, out: out, now: time.Now}
+	if flags.Arg(0) == "simulate" {
+		return cmd.simulate(flags.Args()[1:], opts.simulate)
+	}
+
+	var err error
+	if cmd.client, cmd.namespace, err = newClient(opts); err != nil {
+		return err
+	}
+	return cmd.dispatch(ctx, flags.Arg(0), flags.Args()[1:])
+}
+
+// newClient connects the way kubectl does, returning the namespace of the
+// current context unless one was given
+func newClient(opts options) (client.Client, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = opts.kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.context}
+	overrides.Context.Namespace = opts.namespace
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace, _, err := config.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, "", err
+	}
+	if err := sdev1beta1.AddToScheme(scheme); err != nil {
+		return nil, "", err
+	}
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	return c, namespace, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"sigs.k8s.io/yaml"
+)
+
+// print writes v as JSON or YAML, or as the table fill builds
+func (c *cli) print(v interface{}, fill func(*table)) error {
+	switch c.output {
+	case "json":
+		out, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(c.out, string(out))
+		return err
+	case "yaml":
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = c.out.Write(out)
+		return err
+	}
+
+	t := &table{}
+	fill(t)
+	return t.write(c)
+}
+
+// table collects rows so columns can be dropped before printing
+type table struct {
+	rows    [][]string
+	footers []string
+}
+
+func (t *table) header(cells ...string) { t.rows = append([][]string{cells}, t.rows...) }
+func (t *table) row(cells ...string)    { t.rows = append(t.rows, cells) }
+func (t *table) footer(line string)     { t.footers = append(t.footers, line) }
+
+func (t *table) dropColumn(i int) {
+	for n, row := range t.rows {
+		t.rows[n] = append(row[:i:i], row[i+1:]...)
+	}
+}
+
+func (t *table) write(c *cli) error {
+	if len(t.rows) <= 1 {
+		fmt.Fprintln(c.out, "No databases found.")
+	} else {
+		w := tabwriter.NewWriter(c.out, 0, 4, 3, ' ', 0)
+		for _, row := range t.rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(t.footers) > 0 {
+		fmt.Fprintln(c.out)
+		for _, line := range t.footers {
+			fmt.Fprintln(c.out, line)
+		}
+	}
+	return nil
+}
+
+// formatBytes renders a size with binary units, e.g. 1.5Gi
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ci", float64(n)/float64(div), "KMGTP"[exp])
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sde.domain/sdeController/controllers"
+)
+
+// simulateOptions are the flags only simulate reads
+type simulateOptions struct {
+	filename string
+	maxDrops int
+	now      string
+}
+
+// simulatedDatabase is one line of the names file
+type simulatedDatabase struct {
+	Name         string
+	SizeBytes    int64
+	LastActivity *time.Time
+}
+
+// simulationReport is the output of "simulate"
+type simulationReport struct {
+	Sde        string                    `json:"sde"`
+	Databases  []simulatedRow            `json:"databases"`
+	Lines      []sdev1beta1.ReleaseLine  `json:"lines,omitempty"`
+	Storage    *sdev1beta1.StorageStatus `json:"storage,omitempty"`
+	Violations []string                  `json:"violations,omitempty"`
+}
+
+type simulatedRow struct {
+	controllers.PlannedDatabase
+	SizeBytes    int64        `json:"sizeBytes,omitempty"`
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+}
+
+var errSafetyRails = errors.New("the plan violates safety rails")
+
+// simulate plans retention for the databases listed in args[0], or stdin,
+// under the Sde in opts.filename, without a cluster or database. It fails
+// with errSafetyRails when the plan breaks any of the rails.
+func (c *cli) simulate(args []string, opts simulateOptions) error {
+	if opts.filename == "" {
+		return errors.New("simulate needs the Sde manifest in --filename")
+	}
+	if len(args) > 1 {
+		return errors.New("simulate takes at most one names file")
+	}
+	now := c.now()
+	if opts.now != "" {
+		t, err := time.Parse(time.RFC3339, opts.now)
+		if err != nil {
+			return fmt.Errorf("--now: %w", err)
+		}
+		now = t
+	}
+
+	manifest, err := os.ReadFile(opts.filename)
+	if err != nil {
+		return err
+	}
+	sde, releases, err := readManifests(manifest)
+	if err != nil {
+		return fmt.Errorf("%s: %w", opts.filename, err)
+	}
+
+	in := c.in
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	dbs, err := readDatabases(in)
+	if err != nil {
+		return err
+	}
+
+	var idleAfter time.Duration
+	if p := sde.Spec.Retention; p != nil && p.Idle != nil {
+		idleAfter = p.Idle.After.Duration
+	}
+	input := controllers.PlanInput{Sizes: map[string]int64{}, Releases: releases, Now: now}
+	byName := map[string]simulatedDatabase{}
+	for _, db := range dbs {
+		byName[db.Name] = db
+		input.Databases = append(input.Databases, db.Name)
+		input.Sizes[db.Name] = db.SizeBytes
+		if db.LastActivity != nil {
+			input.Activity = append(input.Activity, sdev1beta1.DatabaseActivity{
+				Name:         db.Name,
+				LastActivity: metav1.NewTime(*db.LastActivity),
+				Idle:         idleAfter > 0 && now.Sub(*db.LastActivity) > idleAfter,
+			})
+		}
+	}
+
+	preview := controllers.PlanRetention(sde, input)
+	report := simulationReport{
+		Sde:        sde.Name,
+		Lines:      preview.Plan.Lines,
+		Storage:    preview.Storage,
+		Violations: safetyViolations(sde, preview, opts.maxDrops),
+	}
+	for _, db := range preview.Databases {
+		row := simulatedRow{PlannedDatabase: db, SizeBytes: byName[db.Name].SizeBytes}
+		if t := byName[db.Name].LastActivity; t != nil {
+			last := metav1.NewTime(*t)
+			row.LastActivity = &last
+		}
+		report.Databases = append(report.Databases, row)
+	}
+
+	err = c.print(report, func(t *table) {
+		t.header("DATABASE", "SIZE", "LAST ACTIVITY", "VERDICT", "REASON")
+		for _, row := range report.Databases {
+			t.row(row.Name, formatBytes(row.SizeBytes), c.ageAt(row.LastActivity, now), string(row.Verdict), row.Reason)
+		}
+		t.footer(fmt.Sprintf("%d of %d databases dropped", len(preview.Plan.Drop), len(report.Databases)))
+		for _, v := range report.Violations {
+			t.footer("VIOLATION: " + v)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(report.Violations) > 0 {
+		return errSafetyRails
+	}
+	return nil
+}
+
+// safetyViolations checks a plan against the rails a retention change must
+// never cross: something is always kept, the newest and the target version
+// are never dropped, minCount holds and at most maxDrops go at once
+// (maxDrops < 0 means no limit).
+func safetyViolations(sde *sdev1beta1.Sde, preview *controllers.RetentionPreview, maxDrops int) []string {
+	var violations []string
+	var live, kept []string
+	for _, db := range preview.Databases {
+		if db.Verdict == sdev1beta1.VerdictNotLive {
+			continue
+		}
+		live = append(live, db.Name)
+		if db.Verdict != sdev1beta1.VerdictDrop {
+			kept = append(kept, db.Name)
+		}
+	}
+	drops := map[string]bool{}
+	for _, drop := range preview.Plan.Drop {
+		drops[drop.Name] = true
+	}
+
+	if len(live) > 0 && len(kept) == 0 {
+		violations = append(violations, "every database would be dropped")
+	}
+	if len(live) > 0 && drops[live[len(live)-1]] {
+		violations = append(violations, fmt.Sprintf("the newest database %s would be dropped", live[len(live)-1]))
+	}
+	if v := sde.Spec.TargetVersion; v != "" && drops["sde_"+v] {
+		violations = append(violations, fmt.Sprintf("the target version database sde_%s would be dropped", v))
+	}
+	if p := sde.Spec.Retention; p != nil && p.MinCount != nil && len(kept) < int(*p.MinCount) && len(live) >= int(*p.MinCount) {
+		violations = append(violations, fmt.Sprintf("%d databases would be kept, fewer than minCount %d", len(kept), *p.MinCount))
+	}
+	if maxDrops >= 0 && len(drops) > maxDrops {
+		violations = append(violations, fmt.Sprintf("%d databases would be dropped, more than --max-drops %d", len(drops), maxDrops))
+	}
+	return violations
+}
+
+// readManifests decodes the one Sde and any SdeReleases in a YAML stream.
+// Fields the API does not know are errors, so typos fail the check.
+func readManifests(data []byte) (*sdev1beta1.Sde, []sdev1beta1.SdeRelease, error) {
+	var sde *sdev1beta1.Sde
+	var releases []sdev1beta1.SdeRelease
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		var meta metav1.TypeMeta
+		if err := yaml.Unmarshal(doc, &meta); err != nil {
+			return nil, nil, err
+		}
+
+		switch meta.Kind {
+		case "Sde":
+			if sde != nil {
+				return nil, nil, errors.New("more than one Sde")
+			}
+			sde = &sdev1beta1.Sde{}
+			if err := yaml.UnmarshalStrict(doc, sde); err != nil {
+				return nil, nil, err
+			}
+		case "SdeRelease":
+			release := sdev1beta1.SdeRelease{}
+			if err := yaml.UnmarshalStrict(doc, &release); err != nil {
+				return nil, nil, err
+			}
+			releases = append(releases, release)
+		}
+	}
+	if sde == nil {
+		return nil, nil, errors.New("no Sde found")
+	}
+	return sde, releases, nil
+}
+
+// readDatabases parses one database per line: the name, then optionally a
+// size such as 12Gi or 1048576 and a last activity date such as 2024-01-31
+// or an RFC 3339 time, separated by spaces or commas. Blank lines and lines
+// starting with # are skipped.
+func readDatabases(r io.Reader) ([]simulatedDatabase, error) {
+	var dbs []simulatedDatabase
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: no database name", n)
+		}
+		db := simulatedDatabase{Name: fields[0]}
+		for _, field := range fields[1:] {
+			if t, ok := parseDate(field); ok {
+				db.LastActivity = &t
+			} else if q, err := resource.ParseQuantity(field); err == nil {
+				db.SizeBytes = q.Value()
+			} else {
+				return nil, fmt.Errorf("line %d: %q is neither a size nor a date", n, field)
+			}
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, scanner.Err()
+}
+
+func parseDate(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
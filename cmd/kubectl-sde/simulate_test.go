@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func simulateCli(t *testing.T, manifest, names string) (*cli, *bytes.Buffer, simulateOptions) {
+	path := filepath.Join(t.TempDir(), "sde.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(manifest), 0o600))
+	out := &bytes.Buffer{}
+	now := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	c := &cli{output: "table", in: strings.NewReader(names), out: out, now: func() time.Time { return now }}
+	return c, out, simulateOptions{filename: path, maxDrops: -1}
+}
+
+const simulatedSde = `apiVersion: sde.sde.domain/v1beta1
+kind: Sde
+metadata:
+  name: prod
+spec:
+  databaseCount: 2
+  retention:
+    idle:
+      after: 720h
+      action: Drop
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+`
+
+func TestSimulate(t *testing.T) {
+	names := "# name size last-activity\nsde_5.9.0, 6Gi, 2024-01-01\nsde_5.10.0 5Gi 2024-03-01\n\nsde_5.8.1 4Gi\n"
+	c, out, opts := simulateCli(t, simulatedSde, names)
+	assert.NoError(t, c.simulate(nil, opts))
+	assert.Regexp(t, `sde_5.8.1\s+4.0Gi\s+<none>\s+Drop\s+DatabaseCount`, out.String())
+	assert.Regexp(t, `sde_5.9.0\s+6.0Gi\s+64d\s+Drop\s+Idle`, out.String())
+	assert.Regexp(t, `sde_5.10.0\s+5.0Gi\s+4d\s+Keep`, out.String())
+
+	// Too many drops at once
+	c, out, opts = simulateCli(t, simulatedSde, names)
+	opts.maxDrops = 1
+	assert.ErrorIs(t, c.simulate(nil, opts), errSafetyRails)
+	assert.Contains(t, out.String(), "VIOLATION: 2 databases would be dropped, more than --max-drops 1")
+
+	// A count of zero drops everything, the newest included
+	c, out, opts = simulateCli(t, strings.Replace(simulatedSde, "databaseCount: 2", "databaseCount: 0", 1), names)
+	assert.ErrorIs(t, c.simulate(nil, opts), errSafetyRails)
+	assert.Contains(t, out.String(), "VIOLATION: every database would be dropped")
+	assert.Contains(t, out.String(), "VIOLATION: the newest database sde_5.10.0 would be dropped")
+}
+
+func TestSimulateInputErrors(t *testing.T) {
+	c, _, opts := simulateCli(t, strings.Replace(simulatedSde, "databaseCount", "databaseCuont", 1), "sde_5.0.0\n")
+	assert.Error(t, c.simulate(nil, opts))
+
+	c, _, opts = simulateCli(t, simulatedSde, "sde_5.0.0 yesterday\n")
+	assert.EqualError(t, c.simulate(nil, opts), `line 1: "yesterday" is neither a size nor a date`)
+
+	// A line of separators only has no name to read
+	c, _, opts = simulateCli(t, simulatedSde, "sde_5.0.0\n, ,,\n")
+	assert.EqualError(t, c.simulate(nil, opts), "line 2: no database name")
+
+	c, _, opts = simulateCli(t, "kind: ConfigMap\n", "sde_5.0.0\n")
+	assert.Error(t, c.simulate(nil, opts))
+}
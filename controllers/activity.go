@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// activitySampleInterval is how often Sdes with an idle policy are requeued
+// so that activity keeps being sampled
+const activitySampleInterval = 10 * time.Minute
+
+type activitySample struct {
+	numBackends int32
+	xactCommit  int64
+	statsReset  *time.Time
+}
+
+// sampleActivity reads the pg_stat_database counters of each database in dbList
+func sampleActivity(ctx context.Context, db *sql.DB, dbList []string) (map[string]activitySample, error) {
+	rows, err := db.QueryContext(ctx,
+		`SELECT datname, numbackends, xact_commit, stats_reset FROM pg_stat_database WHERE datname = ANY($1)`, pq.Array(dbList))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make(map[string]activitySample, len(dbList))
+	for rows.Next() {
+		var name string
+		var sample activitySample
+		var reset sql.NullTime
+		if err := rows.Scan(&name, &sample.numBackends, &sample.xactCommit, &reset); err != nil {
+			return nil, err
+		}
+		if reset.Valid {
+			sample.statsReset = &reset.Time
+		}
+		samples[name] = sample
+	}
+	return samples, rows.Err()
+}
+
+func sameTime(a *metav1.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Time.Equal(*b)
+}
+
+// updateActivity folds new samples into the previous activity records. A
+// database counts as active when it has connections, its commit counter moved,
+// or its statistics were reset since the last sample. Databases without a
+// sample are dropped from the result.
+func updateActivity(prev []sdev1beta1.DatabaseActivity, samples map[string]activitySample, dbList []string, now time.Time, idleAfter time.Duration) []sdev1beta1.DatabaseActivity {
+	byName := make(map[string]sdev1beta1.DatabaseActivity, len(prev))
+	for _, a := range prev {
+		byName[a.Name] = a
+	}
+
+	activity := make([]sdev1beta1.DatabaseActivity, 0, len(dbList))
+	for _, name := range dbList {
+		sample, ok := samples[name]
+		if !ok {
+			continue
+		}
+
+		a, seen := byName[name]
+		active := !seen || sample.numBackends > 0 || sample.xactCommit != a.XactCommit || !sameTime(a.StatsReset, sample.statsReset)
+		a.Name = name
+		if active {
+			a.LastActivity = metav1.NewTime(now)
+		}
+		a.XactCommit = sample.xactCommit
+		a.StatsReset = nil
+		if sample.statsReset != nil {
+			reset := metav1.NewTime(*sample.statsReset)
+			a.StatsReset = &reset
+		}
+		a.Idle = idleAfter > 0 && now.Sub(a.LastActivity.Time) > idleAfter
+		activity = append(activity, a)
+	}
+	return activity
+}
+
+// idleDrops returns the idle databases among live that the policy drops. The
+// newest live database is never dropped for being idle.
+func idleDrops(activity []sdev1beta1.DatabaseActivity, live []string) []string {
+	idle := map[string]bool{}
+	for _, a := range activity {
+		if a.Idle {
+			idle[a.Name] = true
+		}
+	}
+
+	var drops []string
+	for i, name := range live {
+		if i < len(live)-1 && idle[name] {
+			drops = append(drops, name)
+		}
+	}
+	return drops
+}
+
+// reconcileActivity samples pg_stat_database and records the result in
+// sde.Status for the caller to write.
+func (r *SdeReconciler) reconcileActivity(ctx context.Context, db *sql.DB, sde *sdev1beta1.Sde, owned []string) error {
+	samples, err := sampleActivity(ctx, db, owned)
+	if err != nil {
+		return err
+	}
+
+	var idleAfter time.Duration
+	if p := sde.Spec.Retention; p != nil && p.Idle != nil {
+		idleAfter = p.Idle.After.Duration
+	}
+
+	wasIdle := map[string]bool{}
+	for _, a := range sde.Status.Activity {
+		wasIdle[a.Name] = a.Idle
+	}
+	sde.Status.Activity = updateActivity(sde.Status.Activity, samples, owned, time.Now(), idleAfter)
+
+	idleCount := 0
+	for _, a := range sde.Status.Activity {
+		if !a.Idle {
+			continue
+		}
+		idleCount++
+		if !wasIdle[a.Name] {
+			r.event(sde, corev1.EventTypeNormal, "Idle",
+				fmt.Sprintf("Database %s has been idle since %s", a.Name, a.LastActivity.UTC().Format(time.RFC3339)))
+		}
+	}
+	idleDatabases.WithLabelValues(sde.Namespace, sde.Name).Set(float64(idleCount))
+	return nil
+}
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestUpdateActivity(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	dbList := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.1"}
+	samples := map[string]activitySample{
+		"sde_5.0.0": {xactCommit: 10},
+		"sde_5.1.0": {xactCommit: 20},
+		"sde_5.2.1": {xactCommit: 30},
+	}
+
+	// Databases seen for the first time start out active
+	activity := updateActivity(nil, samples, dbList, start, time.Hour)
+	assert.Len(t, activity, 3)
+	for _, a := range activity {
+		assert.Equal(t, start, a.LastActivity.Time)
+		assert.False(t, a.Idle)
+	}
+
+	// Two hours later only sde_5.1.0 committed and sde_5.2.1 has a connection
+	later := start.Add(2 * time.Hour)
+	samples = map[string]activitySample{
+		"sde_5.0.0": {xactCommit: 10},
+		"sde_5.1.0": {xactCommit: 25},
+		"sde_5.2.1": {xactCommit: 30, numBackends: 1},
+	}
+	activity = updateActivity(activity, samples, dbList, later, time.Hour)
+	assert.True(t, activity[0].Idle)
+	assert.Equal(t, start, activity[0].LastActivity.Time)
+	assert.False(t, activity[1].Idle)
+	assert.Equal(t, later, activity[1].LastActivity.Time)
+	assert.False(t, activity[2].Idle)
+
+	// A statistics reset counts as activity
+	reset := later.Add(time.Minute)
+	samples["sde_5.0.0"] = activitySample{statsReset: &reset}
+	activity = updateActivity(activity, samples, dbList, later.Add(time.Hour), time.Hour)
+	assert.False(t, activity[0].Idle)
+
+	// Without a policy nothing is idle
+	activity = updateActivity(activity, samples, dbList, later.Add(24*time.Hour), 0)
+	assert.False(t, activity[0].Idle)
+}
+
+func TestIdleDrops(t *testing.T) {
+	live := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.1"}
+	activity := []sdev1beta1.DatabaseActivity{
+		{Name: "sde_5.0.0", Idle: true},
+		{Name: "sde_5.1.0"},
+		{Name: "sde_5.2.1", Idle: true},
+	}
+	assert.Equal(t, []string{"sde_5.0.0"}, idleDrops(activity, live))
+}
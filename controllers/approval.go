@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// planHash identifies a set of drops for one Sde. drops must be in plan order.
+func planHash(sde *sdev1beta1.Sde, drops []string) string {
+	if len(drops) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s\n", sde.Namespace, sde.Name)
+	for _, name := range drops {
+		fmt.Fprintf(h, "%s\n", name)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// removeApproval deletes the approve-plan annotation without losing the
+// in-memory status, which the patch response would overwrite
+func (r *SdeReconciler) removeApproval(ctx context.Context, sde *sdev1beta1.Sde) error {
+	if _, ok := sde.Annotations[sdev1beta1.ApprovePlanAnnotation]; !ok {
+		return nil
+	}
+	status := sde.Status.DeepCopy()
+	patch := client.MergeFrom(sde.DeepCopy())
+	delete(sde.Annotations, sdev1beta1.ApprovePlanAnnotation)
+	err := r.Patch(ctx, sde, patch)
+	sde.Status = *status
+	return err
+}
+
+// checkApproval reports whether the plan in sde.Status.Plan may run. With
+// manual approval it must match the approve-plan annotation; an annotation
+// for any other plan is stale and removed. The PlanApproved condition is set
+// for the caller to write.
+func (r *SdeReconciler) checkApproval(ctx context.Context, sde *sdev1beta1.Sde) (bool, error) {
+	hash := sde.Status.Plan.Hash
+	if sde.Spec.Approval != sdev1beta1.ApprovalManual || hash == "" {
+		meta.RemoveStatusCondition(&sde.Status.Conditions, sdev1beta1.ConditionPlanApproved)
+		return true, r.removeApproval(ctx, sde)
+	}
+
+	condition := metav1.Condition{
+		Type:               sdev1beta1.ConditionPlanApproved,
+		ObservedGeneration: sde.Generation,
+	}
+	given := sde.Annotations[sdev1beta1.ApprovePlanAnnotation]
+	switch given {
+	case hash:
+		condition.Status, condition.Reason = metav1.ConditionTrue, sdev1beta1.ReasonApproved
+		condition.Message = fmt.Sprintf("Plan %s approved", hash)
+	case "":
+		condition.Status, condition.Reason = metav1.ConditionFalse, sdev1beta1.ReasonAwaitingApproval
+		condition.Message = fmt.Sprintf("Set annotation %s=%s to drop %d databases",
+			sdev1beta1.ApprovePlanAnnotation, hash, len(sde.Status.Plan.Drop))
+	default:
+		condition.Status, condition.Reason = metav1.ConditionFalse, sdev1beta1.ReasonApprovalInvalidated
+		condition.Message = fmt.Sprintf("Approval for plan %s is stale, the plan is now %s", given, hash)
+		r.event(sde, corev1.EventTypeWarning, "ApprovalInvalidated", condition.Message)
+		if err := r.removeApproval(ctx, sde); err != nil {
+			return false, err
+		}
+	}
+
+	previous := meta.FindStatusCondition(sde.Status.Conditions, sdev1beta1.ConditionPlanApproved)
+	if condition.Reason == sdev1beta1.ReasonAwaitingApproval && (previous == nil || previous.Message != condition.Message) {
+		r.event(sde, corev1.EventTypeNormal, "ApprovalRequired", condition.Message)
+	}
+	meta.SetStatusCondition(&sde.Status.Conditions, condition)
+	return condition.Status == metav1.ConditionTrue, nil
+}
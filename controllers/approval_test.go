@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestPlanHash(t *testing.T) {
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"}}
+	other := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "other"}}
+
+	hash := planHash(sde, []string{"sde_5.0.0", "sde_5.1.0"})
+	assert.Len(t, hash, 16)
+	assert.Equal(t, hash, planHash(sde, []string{"sde_5.0.0", "sde_5.1.0"}))
+	assert.NotEqual(t, hash, planHash(sde, []string{"sde_5.0.0"}))
+	assert.NotEqual(t, hash, planHash(other, []string{"sde_5.0.0", "sde_5.1.0"}))
+	assert.Empty(t, planHash(sde, nil))
+}
+
+func TestCheckApproval(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{
+		ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"},
+		Spec:       sdev1beta1.SdeSpec{Approval: sdev1beta1.ApprovalManual},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde).Build()
+	r := &SdeReconciler{Client: c, Scheme: scheme}
+	ctx := context.Background()
+	key := types.NamespacedName{Name: "sde", Namespace: "ns"}
+
+	get := func() *sdev1beta1.Sde {
+		current := &sdev1beta1.Sde{}
+		assert.NoError(t, c.Get(ctx, key, current))
+		current.Status.Plan = &sdev1beta1.RetentionPlan{
+			Hash: planHash(current, []string{"sde_5.0.0"}),
+			Drop: []sdev1beta1.PlannedDrop{{Name: "sde_5.0.0"}},
+		}
+		return current
+	}
+	reason := func(sde *sdev1beta1.Sde) string {
+		return meta.FindStatusCondition(sde.Status.Conditions, sdev1beta1.ConditionPlanApproved).Reason
+	}
+
+	// Without an annotation the plan waits
+	current := get()
+	approved, err := r.checkApproval(ctx, current)
+	assert.NoError(t, err)
+	assert.False(t, approved)
+	assert.Equal(t, sdev1beta1.ReasonAwaitingApproval, reason(current))
+
+	// A stale approval is rejected and removed
+	current.Annotations = map[string]string{sdev1beta1.ApprovePlanAnnotation: "0123456789abcdef"}
+	assert.NoError(t, c.Update(ctx, current))
+	current = get()
+	approved, err = r.checkApproval(ctx, current)
+	assert.NoError(t, err)
+	assert.False(t, approved)
+	assert.Equal(t, sdev1beta1.ReasonApprovalInvalidated, reason(current))
+	assert.NotNil(t, current.Status.Plan)
+	assert.NotContains(t, get().Annotations, sdev1beta1.ApprovePlanAnnotation)
+
+	// The matching hash approves the plan
+	current = get()
+	current.Annotations = map[string]string{sdev1beta1.ApprovePlanAnnotation: current.Status.Plan.Hash}
+	assert.NoError(t, c.Update(ctx, current))
+	current = get()
+	approved, err = r.checkApproval(ctx, current)
+	assert.NoError(t, err)
+	assert.True(t, approved)
+	assert.Equal(t, sdev1beta1.ReasonApproved, reason(current))
+
+	// Automatic mode needs no approval
+	current = get()
+	current.Spec.Approval = sdev1beta1.ApprovalAutomatic
+	approved, err = r.checkApproval(ctx, current)
+	assert.NoError(t, err)
+	assert.True(t, approved)
+	assert.Nil(t, meta.FindStatusCondition(current.Status.Conditions, sdev1beta1.ConditionPlanApproved))
+}
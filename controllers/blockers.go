@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// errDropBlocked is returned when cleanup left databases in place because of
+// blockers; it is retried like a database in use
+var errDropBlocked = errors.New("drop blocked")
+
+const (
+	actionClearTemplate       = "ClearTemplate"
+	actionRollbackPrepared    = "RollbackPrepared"
+	actionTerminateSlotClient = "TerminateSlotConsumer"
+	actionBlockConnections    = "BlockConnections"
+	actionTerminateSessions   = "TerminateSessions"
+	actionAllowConnections    = "AllowConnections"
+)
+
+func blockerPolicy(sde *sdev1beta1.Sde) sdev1beta1.BlockerPolicy {
+	if c := sde.Spec.Cleanup; c != nil && c.BlockerPolicy != "" {
+		return c.BlockerPolicy
+	}
+	return sdev1beta1.BlockerReport
+}
+
+// findBlockers lists what would make DROP DATABASE fail for name. Sessions
+// of logical replication workers are not reported: dropping the database's
+// subscriptions stops them.
+func (e *sqlExecutor) findBlockers(ctx context.Context, name string) ([]sdev1beta1.Blocker, error) {
+	checks := []struct {
+		kind  sdev1beta1.BlockerKind
+		query string
+	}{
+		{sdev1beta1.BlockerTemplate, `SELECT datname FROM pg_database WHERE datname = $1 AND datistemplate`},
+		{sdev1beta1.BlockerPreparedTransaction, `SELECT gid FROM pg_prepared_xacts WHERE database = $1`},
+		{sdev1beta1.BlockerReplicationSlot, `SELECT slot_name FROM pg_replication_slots WHERE active AND database = $1`},
+		{sdev1beta1.BlockerSession, `SELECT format('pid %s, user %s, application %s', pid, usename, application_name)
+			FROM pg_stat_activity WHERE datname = $1 AND backend_type = 'client backend' AND pid <> pg_backend_pid()`},
+	}
+
+	var blockers []sdev1beta1.Blocker
+	for _, check := range checks {
+		details, err := queryNames(ctx, e.db, check.query, name)
+		if err != nil {
+			return nil, fmt.Errorf("checking %s blockers of %s: %w", check.kind, name, err)
+		}
+		for _, detail := range details {
+			blockers = append(blockers, sdev1beta1.Blocker{Kind: check.kind, Detail: detail})
+		}
+	}
+	return blockers, nil
+}
+
+func hasBlocker(blockers []sdev1beta1.Blocker, kind sdev1beta1.BlockerKind) bool {
+	for _, b := range blockers {
+		if b.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBlockers clears the template flag, rolls back prepared transactions
+// and terminates the consumers of active replication slots. Client sessions
+// are handled by closeSessions, after the subscriptions are gone.
+func (e *sqlExecutor) resolveBlockers(ctx context.Context, name string, blockers []sdev1beta1.Blocker) ([]sdev1beta1.CleanupStep, error) {
+	if err := e.checkOwned(ctx, name); err != nil {
+		return nil, err
+	}
+
+	var steps []sdev1beta1.CleanupStep
+	for _, b := range blockers {
+		var err error
+		var action string
+		switch b.Kind {
+		case sdev1beta1.BlockerTemplate:
+			action = actionClearTemplate
+			err = e.exec(ctx, "ALTER DATABASE "+pq.QuoteIdentifier(name)+" IS_TEMPLATE false")
+		case sdev1beta1.BlockerPreparedTransaction:
+			// Prepared transactions can only be finished from their own database
+			action = actionRollbackPrepared
+			err = e.rollbackPrepared(ctx, name, b.Detail)
+		case sdev1beta1.BlockerReplicationSlot:
+			action = actionTerminateSlotClient
+			err = e.exec(ctx, "SELECT pg_terminate_backend(active_pid) FROM pg_replication_slots WHERE slot_name = "+pq.QuoteLiteral(b.Detail))
+		default:
+			continue
+		}
+		steps = append(steps, cleanupStep(action, b.Detail, err))
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+func (e *sqlExecutor) rollbackPrepared(ctx context.Context, name, gid string) error {
+	if e.connect == nil {
+		return fmt.Errorf("cannot connect to %s to roll back prepared transaction %s", name, gid)
+	}
+	target, release, err := e.connect(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return e.execIn(ctx, target, name, "ROLLBACK PREPARED "+pq.QuoteLiteral(gid))
+}
+
+// closeSessions stops new connections to name and terminates the existing
+// ones, so that sessions which reconnect cannot block the drop. When it fails
+// past stopping connections, they are allowed again.
+func (e *sqlExecutor) closeSessions(ctx context.Context, name string) ([]sdev1beta1.CleanupStep, error) {
+	err := e.exec(ctx, "ALTER DATABASE "+pq.QuoteIdentifier(name)+" ALLOW_CONNECTIONS false")
+	steps := []sdev1beta1.CleanupStep{cleanupStep(actionBlockConnections, name, err)}
+	if err != nil {
+		return steps, err
+	}
+	err = e.exec(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = "+
+		pq.QuoteLiteral(name)+" AND pid <> pg_backend_pid()")
+	steps = append(steps, cleanupStep(actionTerminateSessions, name, err))
+	if err != nil {
+		steps = append(steps, e.allowConnections(name))
+	}
+	return steps, err
+}
+
+// allowConnections undoes closeSessions for a database that was not dropped
+// after all. It runs detached from the reconcile's context, which may be what
+// failed the drop, so the database is not left refusing every connection.
+func (e *sqlExecutor) allowConnections(name string) sdev1beta1.CleanupStep {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+	err := e.exec(ctx, "ALTER DATABASE "+pq.QuoteIdentifier(name)+" ALLOW_CONNECTIONS true")
+	return cleanupStep(actionAllowConnections, name, err)
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestCleanupReportsBlockers(t *testing.T) {
+	db, d := openFakeDB(t)
+	exec := ownedExecutor(db, d, []string{"sde_5.0.0", "sde_5.1.0"})
+	d.names = map[string][]string{
+		"pg_prepared_xacts": {"tx1"},
+		"datistemplate":     {"sde_5.0.0"},
+	}
+
+	results, err := cleanupDB(context.Background(), exec, []string{"sde_5.0.0"}, 3)
+	assert.ErrorIs(t, err, errDropBlocked)
+	assert.Equal(t, classInUse, classifyError(err))
+	assert.Empty(t, d.executed)
+	assert.Equal(t, sdev1beta1.DropBlocked, results[0].Outcome)
+	assert.ElementsMatch(t, []sdev1beta1.Blocker{
+		{Kind: sdev1beta1.BlockerTemplate, Detail: "sde_5.0.0"},
+		{Kind: sdev1beta1.BlockerPreparedTransaction, Detail: "tx1"},
+	}, results[0].Blockers)
+
+	_, reason, _ := cleanupCondition(summarizeCleanup(results))
+	assert.Equal(t, sdev1beta1.ReasonDropBlocked, reason)
+}
+
+func TestCleanupResolvesBlockers(t *testing.T) {
+	db, d := openFakeDB(t)
+	exec := ownedExecutor(db, d, []string{"sde_5.0.0"})
+	exec.sde.Spec.Cleanup = &sdev1beta1.CleanupSpec{BlockerPolicy: sdev1beta1.BlockerResolve}
+	exec.connect = func(context.Context, string) (*sql.DB, func(), error) { return db, func() {}, nil }
+	d.names = map[string][]string{
+		"pg_prepared_xacts": {"tx1"},
+		"pg_stat_activity":  {"pid 42, user app, application psql"},
+	}
+
+	results, err := cleanupDB(context.Background(), exec, []string{"sde_5.0.0"}, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, sdev1beta1.DropDropped, results[0].Outcome)
+	assert.Equal(t, []string{
+		`ROLLBACK PREPARED 'tx1'`,
+		`ALTER DATABASE "sde_5.0.0" ALLOW_CONNECTIONS false`,
+		`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = 'sde_5.0.0' AND pid <> pg_backend_pid()`,
+		`DROP DATABASE "sde_5.0.0"`,
+	}, d.executed)
+	assert.Len(t, results[0].Blockers, 2)
+}
+
+func TestCleanupAllowsConnectionsAfterFailedDrop(t *testing.T) {
+	for _, failOn := range []string{"pg_terminate_backend", `DROP DATABASE "sde_5.0.0"`} {
+		db, d := openFakeDB(t, failOn)
+		exec := ownedExecutor(db, d, []string{"sde_5.0.0"})
+		exec.sde.Spec.Cleanup = &sdev1beta1.CleanupSpec{BlockerPolicy: sdev1beta1.BlockerResolve}
+		d.names = map[string][]string{"pg_stat_activity": {"pid 42, user app, application psql"}}
+
+		results, err := cleanupDB(context.Background(), exec, []string{"sde_5.0.0"}, 3)
+		assert.Error(t, err)
+		assert.Equal(t, sdev1beta1.DropFailed, results[0].Outcome)
+		assert.Equal(t, `ALTER DATABASE "sde_5.0.0" ALLOW_CONNECTIONS true`, d.executed[len(d.executed)-1], failOn)
+		steps := results[0].Steps
+		assert.Equal(t, actionAllowConnections, steps[len(steps)-1].Action, failOn)
+		assert.True(t, steps[len(steps)-1].Succeeded, failOn)
+	}
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/lib/pq"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// errorClass groups reconcile failures by how they should be retried
+type errorClass string
+
+const (
+	// classTransient failures are retried with exponential backoff
+	classTransient errorClass = "Transient"
+	// classAuth failures need new credentials
+	classAuth errorClass = "Auth"
+	// classPermission failures need grants on the server
+	classPermission errorClass = "Permission"
+	// classInUse failures clear once other sessions let go of the database
+	classInUse errorClass = "InUse"
+	// classConfig failures need a change to the Sde or its inputs
+	classConfig errorClass = "Config"
+)
+
+// permanent classes are not retried forever; see maxPermanentFailures
+func (c errorClass) permanent() bool {
+	return c == classAuth || c == classPermission || c == classConfig
+}
+
+// reason is the condition reason reported for the class
+func (c errorClass) reason() string {
+	switch c {
+	case classAuth:
+		return sdev1beta1.ReasonAuthFailed
+	case classPermission:
+		return sdev1beta1.ReasonPermissionDenied
+	case classInUse:
+		return sdev1beta1.ReasonDatabaseInUse
+	case classConfig:
+		return sdev1beta1.ReasonConfigError
+	}
+	return sdev1beta1.ReasonTransientError
+}
+
+// classifyError maps an error to its class using the SQLSTATE of Postgres
+// errors, the kind of network errors and Kubernetes API errors.
+func classifyError(err error) errorClass {
+	if errors.Is(err, errLockBusy) || errors.Is(err, errDropBlocked) {
+		return classInUse
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return classTransient
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return classifySQLState(string(pqErr.Code))
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return classConfig
+		}
+		return classTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return classTransient
+	}
+
+	if apierrors.IsNotFound(err) || apierrors.IsInvalid(err) {
+		return classConfig
+	}
+	if apierrors.IsForbidden(err) {
+		return classPermission
+	}
+
+	var cfgErr *configError
+	if errors.As(err, &cfgErr) {
+		return classConfig
+	}
+	return classTransient
+}
+
+func classifySQLState(code string) errorClass {
+	switch code {
+	case "28000", "28P01": // invalid_authorization_specification, invalid_password
+		return classAuth
+	case "42501": // insufficient_privilege
+		return classPermission
+	case "55006", "55P03": // object_in_use, lock_not_available
+		return classInUse
+	case "3D000", "42P04", "42704", "22023", "58P01": // invalid_catalog_name, duplicate_database, undefined_object, invalid_parameter_value, undefined_file
+		return classConfig
+	}
+
+	// Everything else, e.g. connection exceptions (08), insufficient
+	// resources (53), statement timeouts (57014) and serialization
+	// failures (40), is worth retrying.
+	return classTransient
+}
+
+// configError marks a failure caused by the Sde's own configuration
+type configError struct {
+	msg string
+}
+
+func (e *configError) Error() string {
+	return e.msg
+}
+
+func configErrorf(format string, args ...interface{}) error {
+	return &configError{msg: fmt.Sprintf(format, args...)}
+}
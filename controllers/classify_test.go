@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class errorClass
+	}{
+		{&pq.Error{Code: "28P01"}, classAuth},
+		{&pq.Error{Code: "42501"}, classPermission},
+		{fmt.Errorf("drop: %w", &pq.Error{Code: "55006"}), classInUse},
+		{&pq.Error{Code: "3D000"}, classConfig},
+		{&pq.Error{Code: "57014"}, classTransient},
+		{&pq.Error{Code: "08006"}, classTransient},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, classConfig},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, classTransient},
+		{context.DeadlineExceeded, classTransient},
+		{apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "team-database-secrets"), classConfig},
+		{configErrorf("no template"), classConfig},
+		{errLockBusy, classInUse},
+		{errors.New("something else"), classTransient},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.class, classifyError(tt.err), tt.err.Error())
+	}
+
+	assert.True(t, classAuth.permanent())
+	assert.False(t, classInUse.permanent())
+}
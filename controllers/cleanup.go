@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+const defaultFailureBudget = 3
+
+func failureBudget(sde *sdev1beta1.Sde) int {
+	if c := sde.Spec.Cleanup; c != nil && c.FailureBudget != nil {
+		return int(*c.FailureBudget)
+	}
+	return defaultFailureBudget
+}
+
+// summarizeCleanup counts the outcomes of a cleanup run
+func summarizeCleanup(results []sdev1beta1.DatabaseResult) *sdev1beta1.CleanupResult {
+	summary := &sdev1beta1.CleanupResult{Time: metav1.Now(), Databases: results}
+	for _, res := range results {
+		switch res.Outcome {
+		case sdev1beta1.DropDropped:
+			summary.Dropped++
+		case sdev1beta1.DropSkipped:
+			summary.Skipped++
+		case sdev1beta1.DropFailed:
+			summary.Failed++
+		case sdev1beta1.DropBlocked:
+			summary.Blocked++
+		}
+	}
+	return summary
+}
+
+// cleanupCondition derives the CleanedUp condition from a run summary
+func cleanupCondition(summary *sdev1beta1.CleanupResult) (metav1.ConditionStatus, string, string) {
+	message := fmt.Sprintf("%d dropped, %d failed, %d skipped, %d blocked",
+		summary.Dropped, summary.Failed, summary.Skipped, summary.Blocked)
+	switch {
+	case summary.Failed == 0 && summary.Skipped == 0 && summary.Blocked == 0:
+		return metav1.ConditionTrue, sdev1beta1.ReasonSucceeded, message
+	case summary.Dropped > 0:
+		return metav1.ConditionFalse, sdev1beta1.ReasonPartialCleanup, message
+	case summary.Failed == 0 && summary.Skipped == 0:
+		return metav1.ConditionFalse, sdev1beta1.ReasonDropBlocked, message
+	}
+	return metav1.ConditionFalse, sdev1beta1.ReasonCleanupFailed, message
+}
+
+// recordCleanup stores the per-database results in status and emits an Event
+// for each database that was dropped or failed to drop.
+func (r *SdeReconciler) recordCleanup(ctx context.Context, sde *sdev1beta1.Sde, results []sdev1beta1.DatabaseResult) error {
+	for _, res := range results {
+		switch res.Outcome {
+		case sdev1beta1.DropDropped:
+			r.event(sde, corev1.EventTypeNormal, "Dropped", fmt.Sprintf("Dropped database %s", res.Name))
+		case sdev1beta1.DropFailed:
+			r.event(sde, corev1.EventTypeWarning, "DropFailed", fmt.Sprintf("Failed to drop database %s: %s", res.Name, res.Message))
+		case sdev1beta1.DropBlocked:
+			for _, b := range res.Blockers {
+				r.event(sde, corev1.EventTypeWarning, "DropBlocked", fmt.Sprintf("Database %s is blocked by %s %s", res.Name, b.Kind, b.Detail))
+			}
+		}
+	}
+
+	summary := summarizeCleanup(results)
+	sde.Status.LastCleanup = summary
+	status, reason, message := cleanupCondition(summary)
+	meta.SetStatusCondition(&sde.Status.Conditions, metav1.Condition{
+		Type:               sdev1beta1.ConditionCleanedUp,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: sde.Generation,
+	})
+	return r.Status().Update(ctx, sde)
+}
+
+func (r *SdeReconciler) event(sde *sdev1beta1.Sde, eventType, reason, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(sde, eventType, reason, message)
+	}
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// fakeDriver records executed statements and fails those containing any of
+// the configured substrings. Owner comment queries return the entry in
+// comments for the database passed as the first argument and advisory locks
+// are granted unless lockBusy is set; other queries return the names listed
+// under the longest key of names they contain.
+type fakeDriver struct {
+	mu       sync.Mutex
+	failOn   []string
+	executed []string
+	comments map[string]string
+	names    map[string][]string
+	lockBusy bool
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{d}, nil }
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	c.d.executed = append(c.d.executed, query)
+	for _, f := range c.d.failOn {
+		if strings.Contains(query, f) {
+			return nil, errors.New("database " + f + " is being accessed by other users")
+		}
+	}
+	// Comments are kept so that claims show up in later ownership checks
+	if m := commentStatement.FindStringSubmatch(query); m != nil {
+		if c.d.comments == nil {
+			c.d.comments = map[string]string{}
+		}
+		c.d.comments[m[1]] = m[2]
+	}
+	return driver.RowsAffected(0), nil
+}
+
+var commentStatement = regexp.MustCompile(`^COMMENT ON DATABASE "(.*)" IS '(.*)'$`)
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	rows := &fakeRows{}
+	if strings.Contains(query, "shobj_description") && len(args) == 0 {
+		// Listing every database with its comment
+		rows.columns = []string{"datname", "comment"}
+		for name, comment := range c.d.comments {
+			rows.values = append(rows.values, []driver.Value{name, comment})
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "shobj_description") {
+		if comment, ok := c.d.comments[args[0].Value.(string)]; ok {
+			rows.values = [][]driver.Value{{comment}}
+		}
+		return rows, nil
+	}
+	if strings.Contains(query, "pg_try_advisory_lock") {
+		rows.values = [][]driver.Value{{!c.d.lockBusy}}
+		return rows, nil
+	}
+	match := ""
+	for key := range c.d.names {
+		if strings.Contains(query, key) && len(key) > len(match) {
+			match = key
+		}
+	}
+	for _, name := range c.d.names[match] {
+		rows.values = append(rows.values, []driver.Value{name})
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if r.columns == nil {
+		return []string{"comment"}
+	}
+	return r.columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var fakeDrivers sync.Map
+
+func openFakeDB(t *testing.T, failOn ...string) (*sql.DB, *fakeDriver) {
+	d := &fakeDriver{failOn: failOn}
+	name := "fake-" + t.Name()
+	if _, loaded := fakeDrivers.LoadOrStore(name, d); !loaded {
+		sql.Register(name, d)
+	} else {
+		v, _ := fakeDrivers.Load(name)
+		d = v.(*fakeDriver)
+		d.failOn, d.executed, d.comments, d.names, d.lockBusy = failOn, nil, nil, nil, false
+	}
+	db, err := sql.Open(name, "")
+	assert.NoError(t, err)
+	return db, d
+}
+
+// ownedExecutor returns an executor for a test Sde that owns every database in dbList
+func ownedExecutor(db *sql.DB, d *fakeDriver, dbList []string) *sqlExecutor {
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"}}
+	d.comments = map[string]string{}
+	for _, name := range dbList {
+		d.comments[name] = ownerComment(sde)
+	}
+	return newExecutor(db, sde, "retention")
+}
+
+func TestCleanupContinuesPastFailures(t *testing.T) {
+	db, d := openFakeDB(t, "sde_5.1.0")
+	dbList := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.1", "sde_5.3.4"}
+
+	results, err := cleanupDB(context.Background(), ownedExecutor(db, d, dbList), dbList[:3], 3)
+	assert.Error(t, err)
+	assert.Len(t, d.executed, 3)
+	assert.Equal(t, sdev1beta1.DropDropped, results[0].Outcome)
+	assert.Equal(t, sdev1beta1.DropFailed, results[1].Outcome)
+	assert.Equal(t, sdev1beta1.DropDropped, results[2].Outcome)
+
+	summary := summarizeCleanup(results)
+	status, reason, _ := cleanupCondition(summary)
+	assert.Equal(t, metav1.ConditionFalse, status)
+	assert.Equal(t, sdev1beta1.ReasonPartialCleanup, reason)
+}
+
+func TestCleanupFailureBudget(t *testing.T) {
+	db, d := openFakeDB(t, "sde_5.0.0", "sde_5.1.0")
+	dbList := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.1", "sde_5.3.4"}
+
+	results, err := cleanupDB(context.Background(), ownedExecutor(db, d, dbList), dbList[:3], 1)
+	assert.Error(t, err)
+	assert.Len(t, d.executed, 2)
+	assert.Equal(t, sdev1beta1.DropSkipped, results[2].Outcome)
+
+	summary := summarizeCleanup(results)
+	assert.Equal(t, int32(0), summary.Dropped)
+	assert.Equal(t, int32(2), summary.Failed)
+	assert.Equal(t, int32(1), summary.Skipped)
+	_, reason, _ := cleanupCondition(summary)
+	assert.Equal(t, sdev1beta1.ReasonCleanupFailed, reason)
+}
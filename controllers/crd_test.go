@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// validateAgainstCRD checks obj against the schema the API server enforces
+// for the CRD in file
+func validateAgainstCRD(t *testing.T, file string, obj runtime.Object) []error {
+	data, err := os.ReadFile(filepath.Join("..", "config", "crd", "bases", file))
+	assert.NoError(t, err)
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	assert.NoError(t, yaml.Unmarshal(data, crd))
+
+	props := &apiextensions.JSONSchemaProps{}
+	assert.NoError(t, apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(crd.Spec.Versions[0].Schema.OpenAPIV3Schema, props, nil))
+	validator, _, err := validation.NewSchemaValidator(&apiextensions.CustomResourceValidation{OpenAPIV3Schema: props})
+	assert.NoError(t, err)
+
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	assert.NoError(t, err)
+	return validator.Validate(u).Errors
+}
+
+func TestCleanupOutcomesMatchCRD(t *testing.T) {
+	sde := &sdev1beta1.Sde{
+		TypeMeta:   metav1.TypeMeta{APIVersion: sdev1beta1.GroupVersion.String(), Kind: "Sde"},
+		ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"},
+	}
+	sde.Status.LastCleanup = summarizeCleanup([]sdev1beta1.DatabaseResult{
+		{Name: "sde_5.0.0", Outcome: sdev1beta1.DropDropped},
+		{Name: "sde_5.1.0", Outcome: sdev1beta1.DropSkipped},
+		{Name: "sde_5.2.0", Outcome: sdev1beta1.DropFailed},
+		{Name: "sde_5.3.0", Outcome: sdev1beta1.DropBlocked},
+	})
+	assert.Empty(t, validateAgainstCRD(t, "sde.sde.domain_sdes.yaml", sde))
+}
+
+func TestRolePatternMatchesCRD(t *testing.T) {
+	sde := &sdev1beta1.Sde{
+		TypeMeta:   metav1.TypeMeta{APIVersion: sdev1beta1.GroupVersion.String(), Kind: "Sde"},
+		ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"},
+	}
+	sde.Spec.Cleanup = &sdev1beta1.CleanupSpec{RolePattern: "sde_{version}_(ro|rw)"}
+	assert.Empty(t, validateAgainstCRD(t, "sde.sde.domain_sdes.yaml", sde))
+
+	sde.Spec.Cleanup.RolePattern = "sde_.*_(ro|rw)"
+	assert.NotEmpty(t, validateAgainstCRD(t, "sde.sde.domain_sdes.yaml", sde))
+}
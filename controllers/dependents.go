@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+const (
+	actionDropSubscription    = "DropSubscription"
+	actionDropReplicationSlot = "DropReplicationSlot"
+	actionDropDatabase        = "DropDatabase"
+	actionDropRole            = "DropRole"
+)
+
+func cleanupStep(action, target string, err error) sdev1beta1.CleanupStep {
+	step := sdev1beta1.CleanupStep{Action: action, Target: target, Succeeded: err == nil}
+	if err != nil {
+		step.Message = err.Error()
+	}
+	return step
+}
+
+func queryNames(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// dropDependents removes the subscriptions and replication slots tied to an
+// owned database, which would otherwise block the drop or retain WAL. It
+// stops at the first failure.
+func (e *sqlExecutor) dropDependents(ctx context.Context, name string) ([]sdev1beta1.CleanupStep, error) {
+	if err := e.checkOwned(ctx, name); err != nil {
+		return nil, err
+	}
+
+	var steps []sdev1beta1.CleanupStep
+	subs, err := queryNames(ctx, e.db,
+		`SELECT s.subname FROM pg_subscription s JOIN pg_database d ON d.oid = s.subdbid WHERE d.datname = $1`, name)
+	if err != nil {
+		return steps, fmt.Errorf("listing subscriptions in %s: %w", name, err)
+	}
+	if len(subs) > 0 {
+		if e.connect == nil {
+			return steps, fmt.Errorf("cannot connect to %s to drop its subscriptions", name)
+		}
+		target, release, err := e.connect(ctx, name)
+		if err != nil {
+			return steps, err
+		}
+		// release closes the dedicated connection when this returns, so no
+		// session of ours is left in the database by DROP DATABASE
+		defer release()
+
+		for _, sub := range subs {
+			err := e.dropSubscription(ctx, target, name, sub)
+			steps = append(steps, cleanupStep(actionDropSubscription, sub, err))
+			if err != nil {
+				return steps, err
+			}
+		}
+	}
+
+	slots, err := queryNames(ctx, e.db, `SELECT slot_name FROM pg_replication_slots WHERE database = $1`, name)
+	if err != nil {
+		return steps, fmt.Errorf("listing replication slots of %s: %w", name, err)
+	}
+	for _, slot := range slots {
+		err := e.exec(ctx, "SELECT pg_drop_replication_slot("+pq.QuoteLiteral(slot)+")")
+		steps = append(steps, cleanupStep(actionDropReplicationSlot, slot, err))
+		if err != nil {
+			return steps, err
+		}
+	}
+	return steps, nil
+}
+
+// dropSubscription disables and drops a subscription. When the publisher's
+// slot cannot be dropped, for example because the publisher is gone, the
+// subscription is detached from it and dropped anyway.
+func (e *sqlExecutor) dropSubscription(ctx context.Context, target *sql.DB, dbName, sub string) error {
+	quoted := pq.QuoteIdentifier(sub)
+	if err := e.execIn(ctx, target, dbName, "ALTER SUBSCRIPTION "+quoted+" DISABLE"); err != nil {
+		return err
+	}
+	if err := e.execIn(ctx, target, dbName, "DROP SUBSCRIPTION "+quoted); err == nil {
+		return nil
+	}
+	if err := e.execIn(ctx, target, dbName, "ALTER SUBSCRIPTION "+quoted+" SET (slot_name = NONE)"); err != nil {
+		return err
+	}
+	if err := e.execIn(ctx, target, dbName, "DROP SUBSCRIPTION "+quoted); err != nil {
+		return err
+	}
+	return nil
+}
+
+// rolePattern compiles the cleanup role pattern for a dropped database, or
+// returns nil when none is configured. A pattern without "{version}" would
+// match the roles of every version, so it is refused like the CRD does.
+func rolePattern(sde *sdev1beta1.Sde, dbName string) (*regexp.Regexp, error) {
+	c := sde.Spec.Cleanup
+	if c == nil || c.RolePattern == "" {
+		return nil, nil
+	}
+	if !strings.Contains(c.RolePattern, "{version}") {
+		return nil, configErrorf("role pattern %q does not contain {version}", c.RolePattern)
+	}
+	version := regexp.QuoteMeta(strings.TrimPrefix(dbName, dbPrefix))
+	pattern, err := regexp.Compile("^(?:" + strings.ReplaceAll(c.RolePattern, "{version}", version) + ")$")
+	if err != nil {
+		return nil, configErrorf("invalid role pattern %q: %v", c.RolePattern, err)
+	}
+	return pattern, nil
+}
+
+// dropRoles removes the roles left behind by a dropped database: those
+// matching the role pattern that own nothing and hold no privileges.
+func (e *sqlExecutor) dropRoles(ctx context.Context, dbName string) []sdev1beta1.CleanupStep {
+	pattern, err := rolePattern(e.sde, dbName)
+	if err != nil {
+		return []sdev1beta1.CleanupStep{cleanupStep(actionDropRole, e.sde.Spec.Cleanup.RolePattern, err)}
+	} else if pattern == nil {
+		return nil
+	}
+
+	roles, err := queryNames(ctx, e.db, `SELECT r.rolname FROM pg_roles r
+		WHERE r.rolname <> current_user AND NOT r.rolsuper
+		AND NOT EXISTS (SELECT 1 FROM pg_shdepend d WHERE d.refclassid = 'pg_authid'::regclass AND d.refobjid = r.oid)
+		AND NOT EXISTS (SELECT 1 FROM pg_database d WHERE d.datdba = r.oid)`)
+	if err != nil {
+		return []sdev1beta1.CleanupStep{cleanupStep(actionDropRole, pattern.String(), err)}
+	}
+
+	var steps []sdev1beta1.CleanupStep
+	for _, role := range roles {
+		if !pattern.MatchString(role) {
+			continue
+		}
+		err := e.exec(ctx, "DROP ROLE "+pq.QuoteIdentifier(role))
+		steps = append(steps, cleanupStep(actionDropRole, role, err))
+	}
+	return steps
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestCleanupDropsDependents(t *testing.T) {
+	db, d := openFakeDB(t)
+	exec := ownedExecutor(db, d, []string{"sde_5.0.0"})
+	exec.sde.Spec.Cleanup = &sdev1beta1.CleanupSpec{RolePattern: "sde_{version}_(ro|rw)"}
+	d.names = map[string][]string{
+		"pg_subscription":      {"sub1"},
+		"slots WHERE database": {"slot1"},
+		"pg_roles":             {"sde_5.0.0_ro", "sde_5x0x0_rw", "app"},
+	}
+	released := false
+	exec.connect = func(context.Context, string) (*sql.DB, func(), error) {
+		return db, func() { released = true }, nil
+	}
+
+	results, err := cleanupDB(context.Background(), exec, []string{"sde_5.0.0"}, 3)
+	assert.NoError(t, err)
+	assert.True(t, released)
+	assert.Equal(t, []string{
+		`ALTER SUBSCRIPTION "sub1" DISABLE`,
+		`DROP SUBSCRIPTION "sub1"`,
+		`SELECT pg_drop_replication_slot('slot1')`,
+		`DROP DATABASE "sde_5.0.0"`,
+		`DROP ROLE "sde_5.0.0_ro"`,
+	}, d.executed)
+
+	steps := results[0].Steps
+	assert.Len(t, steps, 4)
+	assert.Equal(t, actionDropSubscription, steps[0].Action)
+	assert.Equal(t, actionDropReplicationSlot, steps[1].Action)
+	assert.Equal(t, actionDropDatabase, steps[2].Action)
+	assert.Equal(t, sdev1beta1.CleanupStep{Action: actionDropRole, Target: "sde_5.0.0_ro", Succeeded: true}, steps[3])
+	assert.Equal(t, "sde_5.0.0", exec.records[0].Database)
+}
+
+func TestCleanupStopsOnFailedDependent(t *testing.T) {
+	db, d := openFakeDB(t, "pg_drop_replication_slot")
+	exec := ownedExecutor(db, d, []string{"sde_5.0.0"})
+	d.names = map[string][]string{"slots WHERE database": {"slot1"}}
+
+	results, err := cleanupDB(context.Background(), exec, []string{"sde_5.0.0"}, 3)
+	assert.Error(t, err)
+	assert.Equal(t, sdev1beta1.DropFailed, results[0].Outcome)
+	assert.Len(t, results[0].Steps, 1)
+	assert.False(t, results[0].Steps[0].Succeeded)
+	assert.NotContains(t, d.executed, `DROP DATABASE "sde_5.0.0"`)
+}
+
+func TestRolePatternRequiresVersion(t *testing.T) {
+	db, d := openFakeDB(t)
+	exec := ownedExecutor(db, d, []string{"sde_5.0.0"})
+	exec.sde.Spec.Cleanup = &sdev1beta1.CleanupSpec{RolePattern: "sde_.*_(ro|rw)"}
+	d.names = map[string][]string{"pg_roles": {"sde_5.0.0_ro", "sde_6.0.0_ro"}}
+
+	results, err := cleanupDB(context.Background(), exec, []string{"sde_5.0.0"}, 3)
+	assert.NoError(t, err)
+	assert.NotContains(t, d.executed, `DROP ROLE "sde_6.0.0_ro"`)
+	steps := results[0].Steps
+	assert.Equal(t, actionDropRole, steps[len(steps)-1].Action)
+	assert.False(t, steps[len(steps)-1].Succeeded)
+}
@@ -0,0 +1,14 @@
+#!/bin/bash
+set -e
+
+format=${1:-custom}
+output=${2}
+
+export PGHOST="${DATABASE_HOST}" PGPORT="${DATABASE_PORT}" PGUSER="${DATABASE_USER}" PGPASSWORD="${DATABASE_PASSWORD}"
+
+mkdir -p "$(dirname "${output}")"
+echo "Dumping ${DATABASE_NAME} to ${output} as ${format}"
+pg_dump --format="${format}" --file="${output}" "${DATABASE_NAME}"
+
+# The controller reads the dump size from the termination message
+du -sb "${output}" | cut -f1 > /dev/termination-log
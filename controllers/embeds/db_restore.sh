@@ -0,0 +1,20 @@
+#!/bin/bash
+set -e
+
+format=${1:-custom}
+input=${2}
+target="${DATABASE_NAME}"
+
+export PGHOST="${DATABASE_HOST}" PGPORT="${DATABASE_PORT}" PGUSER="${DATABASE_USER}" PGPASSWORD="${DATABASE_PASSWORD}"
+
+# The controller has created the empty target, owned by the role this Job
+# logs in as
+echo "Restoring ${input} into ${target}"
+if [ "${format}" == "plain" ]; then
+    psql --set ON_ERROR_STOP=1 --dbname="${target}" --file="${input}"
+else
+    pg_restore --no-owner --exit-on-error --dbname="${target}" "${input}"
+fi
+
+# The controller reads the restored size from the termination message
+echo "SELECT pg_database_size(:'target')" | psql --dbname=postgres -tA -v target="${target}" > /dev/termination-log
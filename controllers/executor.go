@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// auditRecord is one statement changing the server that the controller ran,
+// or refused to run
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Sde       string    `json:"sde"`
+	Actor     string    `json:"actor"`
+	Trigger   string    `json:"trigger"`
+	Statement string    `json:"statement"`
+	// Database is set when the statement ran inside a version database
+	// rather than the maintenance database
+	Database string `json:"database,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sqlExecutor is the only path for SQL that changes the server. It quotes
+// identifiers, refuses to drop targets the Sde does not own and keeps an audit
+// record of every statement, which writeAudit then persists.
+type sqlExecutor struct {
+	db      *sql.DB
+	sde     *sdev1beta1.Sde
+	actor   string
+	trigger string
+	records []auditRecord
+
+	// connect opens a connection to a version database, for statements that
+	// must run inside it. release must close it before the database is dropped.
+	connect func(ctx context.Context, dbName string) (db *sql.DB, release func(), err error)
+}
+
+const controllerActor = "sde-controller"
+
+func newExecutor(db *sql.DB, sde *sdev1beta1.Sde, trigger string) *sqlExecutor {
+	return &sqlExecutor{db: db, sde: sde, actor: controllerActor, trigger: trigger}
+}
+
+func (e *sqlExecutor) record(database, statement string, err error) {
+	rec := auditRecord{
+		Time:      time.Now().UTC(),
+		Sde:       e.sde.Namespace + "/" + e.sde.Name,
+		Actor:     e.actor,
+		Trigger:   e.trigger,
+		Statement: statement,
+		Database:  database,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	e.records = append(e.records, rec)
+}
+
+func (e *sqlExecutor) exec(ctx context.Context, statement string) error {
+	_, err := e.db.ExecContext(ctx, statement)
+	e.record("", statement, err)
+	return err
+}
+
+// execIn runs a statement inside the version database dbName
+func (e *sqlExecutor) execIn(ctx context.Context, db *sql.DB, dbName, statement string) error {
+	_, err := db.ExecContext(ctx, statement)
+	e.record(dbName, statement, err)
+	return err
+}
+
+// checkOwned re-reads the database's owner comment right before acting on it
+func (e *sqlExecutor) checkOwned(ctx context.Context, name string) error {
+	var comment string
+	err := e.db.QueryRowContext(ctx,
+		`SELECT COALESCE(shobj_description(oid, 'pg_database'), '') FROM pg_database WHERE datname = $1`, name).Scan(&comment)
+	if err == sql.ErrNoRows {
+		return configErrorf("database %s does not exist", name)
+	} else if err != nil {
+		return err
+	}
+
+	if comment != ownerComment(e.sde) {
+		return configErrorf("refusing to touch database %s: not owned by %s/%s", name, e.sde.Namespace, e.sde.Name)
+	}
+	return nil
+}
+
+// DropDatabase drops a database owned by the executor's Sde
+func (e *sqlExecutor) DropDatabase(ctx context.Context, name string) error {
+	statement := "DROP DATABASE " + pq.QuoteIdentifier(name)
+	if err := e.checkOwned(ctx, name); err != nil {
+		e.record("", statement, err)
+		return err
+	}
+	return e.exec(ctx, statement)
+}
+
+func auditConfigMapName(sde *sdev1beta1.Sde) string {
+	return sde.Name + "-sql-audit"
+}
+
+// maxAuditRecords bounds the audit ConfigMap; the oldest records rotate out
+const maxAuditRecords = 500
+
+// writeAudit appends the executor's records to the Sde's audit ConfigMap as
+// JSON lines. Records are only ever appended, apart from rotation.
+func writeAudit(ctx context.Context, c client.Client, scheme *runtime.Scheme, e *sqlExecutor) error {
+	if len(e.records) == 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, rec := range e.records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, string(line))
+	}
+
+	return appendLines(ctx, c, scheme, e.sde, auditConfigMapName(e.sde), "audit.jsonl", lines, maxAuditRecords, 0)
+}
+
+// appendLines appends lines to a key of a ConfigMap owned by sde, creating it
+// if needed. The oldest lines rotate out beyond maxLines, or beyond maxBytes
+// when that is set.
+func appendLines(ctx context.Context, c client.Client, scheme *runtime.Scheme, sde *sdev1beta1.Sde, name, dataKey string, lines []string, maxLines, maxBytes int) error {
+	key := types.NamespacedName{Name: name, Namespace: sde.Namespace}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configmap := &corev1.ConfigMap{}
+		err := c.Get(ctx, key, configmap)
+		create := err != nil && errors.IsNotFound(err)
+		if err != nil && !create {
+			return err
+		}
+
+		existing := strings.Split(strings.TrimSuffix(configmap.Data[dataKey], "\n"), "\n")
+		if len(existing) == 1 && existing[0] == "" {
+			existing = nil
+		}
+		all := append(existing, lines...)
+		if len(all) > maxLines {
+			all = all[len(all)-maxLines:]
+		}
+		data := strings.Join(all, "\n") + "\n"
+		for maxBytes > 0 && len(data) > maxBytes && len(all) > 1 {
+			all = all[1:]
+			data = strings.Join(all, "\n") + "\n"
+		}
+
+		if create {
+			configmap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Data:       map[string]string{dataKey: data},
+			}
+			if err = ctrl.SetControllerReference(sde, configmap, scheme); err != nil {
+				return err
+			}
+			return c.Create(ctx, configmap)
+		}
+		if configmap.Data == nil {
+			configmap.Data = map[string]string{}
+		}
+		configmap.Data[dataKey] = data
+		return c.Update(ctx, configmap)
+	})
+}
+
+// readAudit returns the audit records stored for an Sde, oldest first
+func readAudit(configmap *corev1.ConfigMap) ([]auditRecord, error) {
+	var records []auditRecord
+	for _, line := range strings.Split(configmap.Data["audit.jsonl"], "\n") {
+		if line == "" {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, fmt.Errorf("parsing audit record: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
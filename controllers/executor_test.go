@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestExecutorRefusesUnowned(t *testing.T) {
+	db, d := openFakeDB(t)
+	exec := ownedExecutor(db, d, []string{"sde_5.0.0"})
+	d.comments["sde_other"] = "sde.domain/owner=ns/someone-else"
+
+	assert.NoError(t, exec.DropDatabase(context.Background(), "sde_5.0.0"))
+	assert.Error(t, exec.DropDatabase(context.Background(), "sde_other"))
+	assert.Error(t, exec.DropDatabase(context.Background(), "sde_missing"))
+	assert.Equal(t, []string{`DROP DATABASE "sde_5.0.0"`}, d.executed)
+
+	assert.Len(t, exec.records, 3)
+	assert.Equal(t, "ns/sde", exec.records[0].Sde)
+	assert.Equal(t, "retention", exec.records[0].Trigger)
+	assert.Empty(t, exec.records[0].Error)
+	assert.Equal(t, `DROP DATABASE "sde_other"`, exec.records[1].Statement)
+	assert.Contains(t, exec.records[1].Error, "not owned")
+}
+
+func TestExecutorQuotesIdentifiers(t *testing.T) {
+	db, d := openFakeDB(t)
+	name := `sde_x"; DROP DATABASE postgres; --`
+	exec := ownedExecutor(db, d, []string{name})
+
+	assert.NoError(t, exec.DropDatabase(context.Background(), name))
+	assert.Equal(t, []string{`DROP DATABASE "sde_x""; DROP DATABASE postgres; --"`}, d.executed)
+}
+
+func TestReadAudit(t *testing.T) {
+	records, err := readAudit(&corev1.ConfigMap{Data: map[string]string{
+		"audit.jsonl": `{"time":"2026-01-02T03:04:05Z","sde":"ns/sde","actor":"sde-controller","trigger":"retention","statement":"DROP DATABASE \"sde_1.0.0\""}` + "\n",
+	}})
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, `DROP DATABASE "sde_1.0.0"`, records[0].Statement)
+}
@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// dropFinalizer lets the controller see SdeDatabase deletions, and drop the
+// database when the deletion is confirmed
+const dropFinalizer = "sde.domain/drop-database"
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// sdeDatabaseName derives a valid object name from a database name. Names
+// that had to be altered get a hash suffix so that they cannot collide.
+func sdeDatabaseName(sde *sdev1beta1.Sde, dbName string) string {
+	version := strings.TrimPrefix(dbName, dbPrefix)
+	clean := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(version), "-"), "-.")
+	name := sde.Name + "-" + clean
+	if clean == version && len(name) <= 253 {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(dbName))
+	suffix := "-" + hex.EncodeToString(sum[:])[:8]
+	if len(name) > 253-len(suffix) {
+		name = strings.TrimRight(name[:253-len(suffix)], "-.")
+	}
+	return name + suffix
+}
+
+// listSdeDatabases returns the SdeDatabase objects controlled by sde
+func (r *SdeReconciler) listSdeDatabases(ctx context.Context, sde *sdev1beta1.Sde) ([]sdev1beta1.SdeDatabase, error) {
+	list := &sdev1beta1.SdeDatabaseList{}
+	err := r.List(ctx, list, client.InNamespace(sde.Namespace), client.MatchingLabels{"sde.domain/sde": sde.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []sdev1beta1.SdeDatabase
+	for _, obj := range list.Items {
+		if metav1.IsControlledBy(&obj, sde) {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+// releaseOrphans removes the drop finalizer from the SdeDatabases labelled
+// for the Sde name in namespace that the Sde with uid does not control,
+// uid being empty once the Sde is gone. They were left by a deleted Sde and
+// the garbage collector may then remove them; their databases are kept.
+func (r *SdeReconciler) releaseOrphans(ctx context.Context, namespace, name string, uid types.UID) error {
+	list := &sdev1beta1.SdeDatabaseList{}
+	err := r.List(ctx, list, client.InNamespace(namespace), client.MatchingLabels{"sde.domain/sde": name})
+	if err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if ref := metav1.GetControllerOf(obj); uid != "" && ref != nil && ref.UID == uid {
+			continue
+		}
+		if !controllerutil.ContainsFinalizer(obj, dropFinalizer) {
+			continue
+		}
+		log.FromContext(ctx).Info(fmt.Sprintf("Releasing SdeDatabase %s of a deleted Sde", obj.Name))
+		controllerutil.RemoveFinalizer(obj, dropFinalizer)
+		if err := r.Update(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func pinnedDbs(objs []sdev1beta1.SdeDatabase) []string {
+	var names []string
+	for _, obj := range objs {
+		if obj.Spec.Pinned && obj.DeletionTimestamp.IsZero() {
+			names = append(names, obj.Spec.DatabaseName)
+		}
+	}
+	return names
+}
+
+// dropConfirmed handles SdeDatabases being deleted. Those carrying the
+// confirmation annotation have their database dropped through cleanupDB
+// first; the others just lose their finalizer. It returns the dropped names.
+func (r *SdeReconciler) dropConfirmed(ctx context.Context, db *sql.DB, conn PGConnector, sde *sdev1beta1.Sde, run *runReport, objs []sdev1beta1.SdeDatabase, owned []string) ([]string, error) {
+	var dropped []string
+	for i := range objs {
+		obj := &objs[i]
+		if obj.DeletionTimestamp.IsZero() || !controllerutil.ContainsFinalizer(obj, dropFinalizer) {
+			continue
+		}
+
+		name := obj.Spec.DatabaseName
+		if obj.Annotations[sdev1beta1.ConfirmDropAnnotation] == name && containsDb(owned, name) {
+			log.FromContext(ctx).Info(fmt.Sprintf("Dropping %s for deleted SdeDatabase %s", name, obj.Name))
+			exec := newExecutor(db, sde, fmt.Sprintf("SdeDatabase %s deleted", obj.Name))
+			exec.connect = r.versionConnector(conn)
+			var results []sdev1beta1.DatabaseResult
+			err := withServerLock(ctx, db, dbPrefix, func() error {
+				kept, skipped, err := stillOwned(ctx, db, sde, []string{name})
+				if err != nil {
+					return err
+				}
+				results, err = cleanupDB(ctx, exec, kept, 0)
+				results = append(results, skipped...)
+				return err
+			})
+			r.audit(ctx, run, exec)
+			if statusErr := r.recordCleanup(ctx, sde, results); statusErr != nil {
+				log.FromContext(ctx).Error(statusErr, "Failed to record cleanup results")
+			}
+			if err != nil {
+				return dropped, err
+			}
+			if results[0].Outcome == sdev1beta1.DropDropped {
+				dropped = append(dropped, name)
+			}
+		}
+
+		controllerutil.RemoveFinalizer(obj, dropFinalizer)
+		if err := r.Update(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
+// syncDatabases creates an SdeDatabase for every owned database, refreshes
+// their status and removes those whose database is gone.
+func (r *SdeReconciler) syncDatabases(ctx context.Context, sde *sdev1beta1.Sde, objs []sdev1beta1.SdeDatabase, owned, live []string, info map[string]dbInfo, plan *retentionPlan) error {
+	existing := map[string]*sdev1beta1.SdeDatabase{}
+	for i := range objs {
+		obj := &objs[i]
+		if !obj.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if containsDb(owned, obj.Spec.DatabaseName) {
+			existing[obj.Spec.DatabaseName] = obj
+			continue
+		}
+
+		controllerutil.RemoveFinalizer(obj, dropFinalizer)
+		if err := r.Update(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	byOID := append([]string(nil), owned...)
+	sort.Slice(byOID, func(i, j int) bool { return info[byOID[i]].oid < info[byOID[j]].oid })
+	order := map[string]int32{}
+	for i, name := range byOID {
+		order[name] = int32(i + 1)
+	}
+
+	for _, name := range owned {
+		obj, ok := existing[name]
+		if !ok {
+			obj = &sdev1beta1.SdeDatabase{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       sdeDatabaseName(sde, name),
+					Namespace:  sde.Namespace,
+					Labels:     map[string]string{"sde.domain/sde": sde.Name},
+					Finalizers: []string{dropFinalizer},
+				},
+				Spec: sdev1beta1.SdeDatabaseSpec{DatabaseName: name},
+			}
+			if err := ctrl.SetControllerReference(sde, obj, r.Scheme); err != nil {
+				return err
+			}
+			if err := r.Create(ctx, obj); err != nil {
+				return err
+			}
+		}
+
+		status := sdev1beta1.SdeDatabaseStatus{
+			Version:       strings.TrimPrefix(name, dbPrefix),
+			SizeBytes:     info[name].size,
+			Owner:         info[name].owner,
+			OID:           info[name].oid,
+			CreationOrder: order[name],
+			Verdict:       sdev1beta1.VerdictNotLive,
+		}
+		for _, a := range sde.Status.Activity {
+			if a.Name == name {
+				lastActivity := a.LastActivity
+				status.LastActivity = &lastActivity
+			}
+		}
+		if containsDb(live, name) {
+			status.Verdict, status.Reason = plan.verdict(name)
+		}
+
+		if equality.Semantic.DeepEqual(obj.Status, status) {
+			continue
+		}
+		obj.Status = status
+		if err := r.Status().Update(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionConnector opens dedicated connections to version databases on
+// conn's server for the executor; releasing one closes it
+func (r *SdeReconciler) versionConnector(conn PGConnector) func(ctx context.Context, dbName string) (*sql.DB, func(), error) {
+	return func(ctx context.Context, dbName string) (*sql.DB, func(), error) {
+		target := conn
+		target.Dbname = dbName
+		return r.Pools.Open(ctx, target)
+	}
+}
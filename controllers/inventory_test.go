@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestSdeDatabaseName(t *testing.T) {
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "prod"}}
+	assert.Equal(t, "prod-5.3.4", sdeDatabaseName(sde, "sde_5.3.4"))
+
+	// Altered names get a hash so that sde_5_3 and sde_5-3 do not collide
+	a, b := sdeDatabaseName(sde, "sde_5_3"), sdeDatabaseName(sde, "sde_5-3")
+	assert.Regexp(t, `^prod-5-3-[0-9a-f]{8}$`, a)
+	assert.Equal(t, "prod-5-3", b)
+	assert.NotEqual(t, a, b)
+}
+
+func TestDropConfirmed(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns", UID: "uid"}}
+	deleted := func(name, dbName string, confirm string) *sdev1beta1.SdeDatabase {
+		now := metav1.Now()
+		obj := &sdev1beta1.SdeDatabase{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name, Namespace: "ns", DeletionTimestamp: &now, Finalizers: []string{dropFinalizer},
+				Labels: map[string]string{"sde.domain/sde": "sde"},
+			},
+			Spec: sdev1beta1.SdeDatabaseSpec{DatabaseName: dbName},
+		}
+		if confirm != "" {
+			obj.Annotations = map[string]string{sdev1beta1.ConfirmDropAnnotation: confirm}
+		}
+		return obj
+	}
+	objs := []sdev1beta1.SdeDatabase{
+		*deleted("sde-5.0.0", "sde_5.0.0", "sde_5.0.0"),
+		*deleted("sde-5.1.0", "sde_5.1.0", ""),
+		*deleted("sde-5.2.0", "sde_5.2.0", "sde_5.1.0"),
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde, &objs[0], &objs[1], &objs[2]).Build()
+	r := &SdeReconciler{Client: c, Scheme: scheme}
+
+	db, d := openFakeDB(t)
+	dbList := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.0"}
+	ownedExecutor(db, d, dbList)
+
+	dropped, err := r.dropConfirmed(context.Background(), db, PGConnector{}, sde, &runReport{}, objs, dbList)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sde_5.0.0"}, dropped)
+	assert.Equal(t, []string{`DROP DATABASE "sde_5.0.0"`, "SELECT pg_advisory_unlock(hashtext($1))"}, d.executed)
+
+	for _, obj := range objs {
+		got := &sdev1beta1.SdeDatabase{}
+		err := c.Get(context.Background(), types.NamespacedName{Name: obj.Name, Namespace: "ns"}, got)
+		if err == nil {
+			assert.Empty(t, got.Finalizers, obj.Name)
+		}
+	}
+}
+
+func TestDropConfirmedRelists(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns", UID: "uid"}}
+	now := metav1.Now()
+	obj := &sdev1beta1.SdeDatabase{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "sde-5.0.0", Namespace: "ns", DeletionTimestamp: &now, Finalizers: []string{dropFinalizer},
+			Annotations: map[string]string{sdev1beta1.ConfirmDropAnnotation: "sde_5.0.0"},
+		},
+		Spec: sdev1beta1.SdeDatabaseSpec{DatabaseName: "sde_5.0.0"},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde, obj).Build()
+	r := &SdeReconciler{Client: c, Scheme: scheme}
+
+	// Another Sde claimed the database after this run listed it
+	db, d := openFakeDB(t)
+	d.comments = map[string]string{"sde_5.0.0": "sde.domain/owner=other/sde"}
+
+	dropped, err := r.dropConfirmed(context.Background(), db, PGConnector{}, sde, &runReport{}, []sdev1beta1.SdeDatabase{*obj}, []string{"sde_5.0.0"})
+	assert.NoError(t, err)
+	assert.Empty(t, dropped)
+	assert.NotContains(t, d.executed, `DROP DATABASE "sde_5.0.0"`)
+}
+
+func TestReleaseOrphans(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	child := func(name string, uid types.UID, deleting bool) *sdev1beta1.SdeDatabase {
+		obj := &sdev1beta1.SdeDatabase{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name, Namespace: "ns", Finalizers: []string{dropFinalizer},
+				Labels: map[string]string{"sde.domain/sde": "sde"},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: sdev1beta1.GroupVersion.String(), Kind: "Sde", Name: "sde", UID: uid, Controller: pointer.Bool(true),
+				}},
+			},
+		}
+		if deleting {
+			now := metav1.Now()
+			obj.DeletionTimestamp = &now
+		}
+		return obj
+	}
+	finalizers := func(c client.Client, name string) []string {
+		obj := &sdev1beta1.SdeDatabase{}
+		if err := c.Get(context.Background(), types.NamespacedName{Name: name, Namespace: "ns"}, obj); err != nil {
+			assert.True(t, errors.IsNotFound(err))
+			return nil
+		}
+		return obj.Finalizers
+	}
+
+	// The garbage collector deletes the children of a deleted Sde; the
+	// reconcile of the missing Sde lets them go
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(child("sde-5.0.0", "old", true), child("sde-5.1.0", "old", false)).Build()
+	r := &SdeReconciler{Client: c, Scheme: scheme}
+	_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "sde", Namespace: "ns"}})
+	assert.NoError(t, err)
+	assert.Empty(t, finalizers(c, "sde-5.0.0"))
+	assert.Empty(t, finalizers(c, "sde-5.1.0"))
+
+	// An Sde created again under the same name keeps its own children
+	c = fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(child("sde-5.0.0", "old", true), child("sde-5.1.0", "new", false)).Build()
+	r = &SdeReconciler{Client: c, Scheme: scheme}
+	assert.NoError(t, r.releaseOrphans(context.Background(), "ns", "sde", "new"))
+	assert.Empty(t, finalizers(c, "sde-5.0.0"))
+	assert.Equal(t, []string{dropFinalizer}, finalizers(c, "sde-5.1.0"))
+}
@@ -2,7 +2,8 @@ package controllers
 
 import (
 	"context"
-	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
@@ -10,9 +11,11 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -52,8 +55,6 @@ func (r *SdeReconciler) MakeJob(ctx context.Context, sde *sdev1beta1.Sde) (ctrl.
 	if err != nil && errors.IsNotFound(err) {
 
 		ctxlog.Info("Creating new Job")
-		configmapMode := int32(0554)
-
 		job := &batchv1.Job{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "sde-controller-job",
@@ -61,63 +62,8 @@ func (r *SdeReconciler) MakeJob(ctx context.Context, sde *sdev1beta1.Sde) (ctrl.
 			},
 			Spec: batchv1.JobSpec{
 				Template: corev1.PodTemplateSpec{
-					Spec: corev1.PodSpec{
-						RestartPolicy: corev1.RestartPolicyOnFailure,
-						// STEP 3a: define the ConfigMap as a volume.
-						Volumes: []corev1.Volume{
-							{
-								Name: "task-script-volume",
-								VolumeSource: corev1.VolumeSource{
-									ConfigMap: &corev1.ConfigMapVolumeSource{
-										LocalObjectReference: corev1.LocalObjectReference{
-											Name: "run-scripts",
-										},
-										DefaultMode: &configmapMode,
-									},
-								},
-							},
-							{
-								Name: "db-secret-volume",
-								VolumeSource: corev1.VolumeSource{
-									Secret: &corev1.SecretVolumeSource{
-										SecretName: fmt.Sprintf("%s-database-secrets", sde.Namespace),
-									},
-								},
-							},
-						},
-						Containers: []corev1.Container{
-							{
-								Name:  "task",
-								Image: "postgres:12",
-								Resources: corev1.ResourceRequirements{
-									Requests: corev1.ResourceList{
-										corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.DecimalSI),
-										corev1.ResourceMemory: *resource.NewScaledQuantity(int64(250), resource.Mega),
-									},
-									Limits: corev1.ResourceList{
-										corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(100), resource.DecimalSI),
-										corev1.ResourceMemory: *resource.NewScaledQuantity(int64(500), resource.Mega),
-									},
-								},
-								// STEP 3b: mount the ConfigMap volume.
-								VolumeMounts: []corev1.VolumeMount{
-									{
-										Name:      "task-script-volume",
-										MountPath: "/scripts",
-										ReadOnly:  true,
-									},
-									{
-										Name:      "db-secret-volume",
-										MountPath: "/secrets",
-										ReadOnly:  true,
-									},
-								},
-								// STEP 3c: run the volume-mounted script.
-								Command: []string{"/scripts/db_cleanup.sh", "postgres", "/secrets/ADMIN_DATABASE_PASSWORD", "", "sde_", "1"},
-								// Command: []string{"sleep", "1231273"},
-							},
-						},
-					},
+					Spec: scriptPodSpec("run-scripts", dbSecretName(sde.Namespace),
+						[]string{"/scripts/db_cleanup.sh", "postgres", "/secrets/ADMIN_DATABASE_PASSWORD", "", "sde_", "1"}),
 				},
 			},
 		}
@@ -141,3 +87,161 @@ func (r *SdeReconciler) MakeJob(ctx context.Context, sde *sdev1beta1.Sde) (ctrl.
 
 	return ctrl.Result{}, nil
 }
+
+// scriptPodSpec builds a pod that runs command from the scripts ConfigMap in a
+// postgres container, with the database secret mounted under /secrets.
+func scriptPodSpec(scriptsConfigMap, secretName string, command []string) corev1.PodSpec {
+	configmapMode := int32(0554)
+
+	return corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyOnFailure,
+		// STEP 3a: define the ConfigMap as a volume.
+		Volumes: []corev1.Volume{
+			{
+				Name: "task-script-volume",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: scriptsConfigMap,
+						},
+						DefaultMode: &configmapMode,
+					},
+				},
+			},
+			{
+				Name: "db-secret-volume",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: secretName,
+					},
+				},
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name:  "task",
+				Image: "postgres:12",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(50), resource.DecimalSI),
+						corev1.ResourceMemory: *resource.NewScaledQuantity(int64(250), resource.Mega),
+					},
+					Limits: corev1.ResourceList{
+						corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(100), resource.DecimalSI),
+						corev1.ResourceMemory: *resource.NewScaledQuantity(int64(500), resource.Mega),
+					},
+				},
+				// STEP 3b: mount the ConfigMap volume.
+				VolumeMounts: []corev1.VolumeMount{
+					{
+						Name:      "task-script-volume",
+						MountPath: "/scripts",
+						ReadOnly:  true,
+					},
+					{
+						Name:      "db-secret-volume",
+						MountPath: "/secrets",
+						ReadOnly:  true,
+					},
+				},
+				// STEP 3c: run the volume-mounted script.
+				Command: command,
+			},
+		},
+	}
+}
+
+// ensureScripts creates the ConfigMap holding the scripts run by owner's Jobs
+func ensureScripts(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, name string, scripts map[string]string) error {
+	configmap := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: owner.GetNamespace()}, configmap)
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+
+	configmap = &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: owner.GetNamespace(),
+		},
+		Data: scripts,
+	}
+	err = ctrl.SetControllerReference(owner, configmap, scheme)
+	if err != nil {
+		return err
+	}
+	return c.Create(ctx, configmap)
+}
+
+// jobTerminationMessage returns the termination message left by the Job's
+// most recently finished container
+func jobTerminationMessage(ctx context.Context, c client.Client, job *batchv1.Job) (string, error) {
+	pods := &corev1.PodList{}
+	err := c.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name})
+	if err != nil {
+		return "", err
+	}
+
+	var message string
+	var finishedAt time.Time
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			terminated := cs.State.Terminated
+			if terminated == nil || terminated.FinishedAt.Time.Before(finishedAt) {
+				continue
+			}
+			message = strings.TrimSpace(terminated.Message)
+			finishedAt = terminated.FinishedAt.Time
+		}
+	}
+	return message, nil
+}
+
+// observeJob copies the progress of a backup or restore Job into its run status
+func observeJob(ctx context.Context, c client.Client, job *batchv1.Job, run *sdev1beta1.JobRunStatus) error {
+	run.Job = job.Name
+	if run.StartTime == nil {
+		run.StartTime = job.Status.StartTime
+	}
+
+	var finished *batchv1.JobCondition
+	for i, cond := range job.Status.Conditions {
+		if (cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) && cond.Status == corev1.ConditionTrue {
+			finished = &job.Status.Conditions[i]
+		}
+	}
+	if finished == nil {
+		run.Phase = sdev1beta1.JobPending
+		if job.Status.Active > 0 {
+			run.Phase = sdev1beta1.JobRunning
+		}
+		return nil
+	}
+
+	message, err := jobTerminationMessage(ctx, c, job)
+	if err != nil {
+		return err
+	}
+
+	completed := finished.LastTransitionTime
+	run.CompletionTime = &completed
+	if run.StartTime != nil {
+		run.Duration = &metav1.Duration{Duration: completed.Sub(run.StartTime.Time)}
+	}
+
+	if finished.Type == batchv1.JobFailed {
+		run.Phase = sdev1beta1.JobFailed
+		run.Message = message
+		if run.Message == "" {
+			run.Message = finished.Message
+		}
+		return nil
+	}
+
+	run.Phase = sdev1beta1.JobSucceeded
+	run.Message = ""
+	if size, err := strconv.ParseInt(message, 10, 64); err == nil {
+		run.SizeBytes = size
+	}
+	return nil
+}
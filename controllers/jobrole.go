@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lib/pq"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Migration, backup and restore Jobs run in the Sde's namespace, where anyone
+// who reads Secrets sees their credentials. They therefore never get the
+// server's admin login: each Sde has a job role of its own, without
+// superuser, CREATEDB or CREATEROLE, that owns the databases the Sde creates.
+
+// jobRoleName is the Sde's job role. The hash keeps it unique per Sde and
+// within the 63 bytes Postgres allows.
+func jobRoleName(sde *sdev1beta1.Sde) string {
+	sum := sha256.Sum256([]byte(sde.Namespace + "/" + sde.Name))
+	return "sde_job_" + hex.EncodeToString(sum[:8])
+}
+
+// jobRoleSecretName names the Secret holding the password of the Sde's job role
+func jobRoleSecretName(sde *sdev1beta1.Sde) string {
+	return sde.Name + "-db-job-role"
+}
+
+// jobRolePassword returns the job role password kept in the Sde's namespace,
+// generating it on first use, and whether it did
+func jobRolePassword(ctx context.Context, c client.Client, scheme *runtime.Scheme, sde *sdev1beta1.Sde) (string, bool, error) {
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: jobRoleSecretName(sde), Namespace: sde.Namespace}, secret)
+	if err == nil {
+		return string(secret.Data["password"]), false, nil
+	} else if !errors.IsNotFound(err) {
+		return "", false, err
+	}
+
+	buf := make([]byte, 24)
+	if _, err = rand.Read(buf); err != nil {
+		return "", false, err
+	}
+	password := hex.EncodeToString(buf)
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: jobRoleSecretName(sde), Namespace: sde.Namespace},
+		Data:       map[string][]byte{"password": []byte(password)},
+	}
+	if err = ctrl.SetControllerReference(sde, secret, scheme); err != nil {
+		return "", false, err
+	}
+	return password, true, c.Create(ctx, secret)
+}
+
+// ensureJobRole creates the executor's Sde's job role, or sets the password
+// of an existing one when the password is new, and returns conn logging in as
+// it. The audit records the statements without the password.
+func ensureJobRole(ctx context.Context, c client.Client, scheme *runtime.Scheme, exec *sqlExecutor, conn PGConnector) (PGConnector, error) {
+	password, generated, err := jobRolePassword(ctx, c, scheme, exec.sde)
+	if err != nil {
+		return PGConnector{}, err
+	}
+
+	role := jobRoleName(exec.sde)
+	existing, err := queryNames(ctx, exec.db, `SELECT rolname FROM pg_roles WHERE rolname = $1`, role)
+	if err != nil {
+		return PGConnector{}, err
+	}
+	statement := "CREATE ROLE %s LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE PASSWORD %s"
+	if len(existing) > 0 {
+		statement = "ALTER ROLE %s LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE PASSWORD %s"
+	}
+	if len(existing) == 0 || generated {
+		_, err = exec.db.ExecContext(ctx, fmt.Sprintf(statement, pq.QuoteIdentifier(role), pq.QuoteLiteral(password)))
+		exec.record("", fmt.Sprintf(statement, pq.QuoteIdentifier(role), "'********'"), err)
+		if err != nil {
+			return PGConnector{}, fmt.Errorf("setting up job role %s: %w", role, err)
+		}
+		// Creating a database owned by the role takes membership in it
+		if err = exec.exec(ctx, fmt.Sprintf("GRANT %s TO CURRENT_USER", pq.QuoteIdentifier(role))); err != nil {
+			return PGConnector{}, fmt.Errorf("granting job role %s: %w", role, err)
+		}
+	}
+
+	conn.User, conn.Password = role, password
+	return conn, nil
+}
+
+// jobConnection resolves the Sde owning dbName in namespace, for the backup
+// and restore Jobs of that database, and sets up its job role, auditing the
+// statements under trigger. It returns the Sde with its admin connection and
+// the connection its Jobs use.
+func jobConnection(ctx context.Context, c client.Client, scheme *runtime.Scheme, pools *ServerPools, namespace, dbName, trigger string) (*sdev1beta1.Sde, PGConnector, PGConnector, error) {
+	sde, err := sdeForDatabase(ctx, c, namespace, dbName)
+	if err != nil {
+		return nil, PGConnector{}, PGConnector{}, err
+	}
+	if sde == nil {
+		return nil, PGConnector{}, PGConnector{}, configErrorf("no Sde in namespace %s for database %s", namespace, dbName)
+	}
+	conn, err := connectorFor(ctx, c, sde)
+	if err != nil {
+		return nil, PGConnector{}, PGConnector{}, err
+	}
+	db, release, err := pools.Get(ctx, conn)
+	if err != nil {
+		return nil, PGConnector{}, PGConnector{}, err
+	}
+	defer release()
+	exec := newExecutor(db, sde, trigger)
+	jobConn, err := ensureJobRole(ctx, c, scheme, exec, conn)
+	if auditErr := writeAudit(ctx, c, scheme, exec); auditErr != nil {
+		log.FromContext(ctx).Error(auditErr, "Failed to write SQL audit records")
+	}
+	return sde, conn, jobConn, err
+}
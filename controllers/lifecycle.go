@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// lifecycleRecheckInterval is how often Sdes with a lifecycle policy are
+// requeued so that versions reaching end of life are noticed
+const lifecycleRecheckInterval = time.Hour
+
+// releases lists the SdeRelease catalog selected by the policy
+func (r *SdeReconciler) releases(ctx context.Context, policy *sdev1beta1.LifecyclePolicy) ([]sdev1beta1.SdeRelease, error) {
+	var opts []client.ListOption
+	if policy.ReleaseSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(policy.ReleaseSelector)
+		if err != nil {
+			return nil, configErrorf("invalid release selector: %v", err)
+		}
+		opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+	}
+
+	list := &sdev1beta1.SdeReleaseList{}
+	if err := r.List(ctx, list, opts...); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// sdesForRelease maps a changed SdeRelease to every Sde with a lifecycle policy
+func (r *SdeReconciler) sdesForRelease(obj client.Object) []reconcile.Request {
+	sdes := &sdev1beta1.SdeList{}
+	if err := r.List(context.Background(), sdes); err != nil {
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, sde := range sdes.Items {
+		if p := sde.Spec.Retention; p != nil && p.Lifecycle != nil {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&sde)})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// errLockBusy is returned when another worker or controller replica holds
+// the advisory lock for the same server and prefix
+var errLockBusy = errors.New("database server is locked by another reconcile")
+
+// serverLock holds a session-level advisory lock on a dedicated connection
+type serverLock struct {
+	conn *sql.Conn
+	key  string
+}
+
+// lockServer takes the advisory lock guarding adoption and drops of
+// databases with prefix on the server db points at. The lock lives on the
+// server, so it also serializes separate controller replicas.
+func lockServer(ctx context.Context, db *sql.DB, prefix string) (*serverLock, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &serverLock{conn: conn, key: "sde-controller:" + prefix}
+	var acquired bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", lock.key).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired {
+		conn.Close()
+		return nil, errLockBusy
+	}
+	return lock, nil
+}
+
+// unlockTimeout bounds releasing the lock, which happens even when the
+// reconcile's context has been cancelled
+const unlockTimeout = 10 * time.Second
+
+// Unlock releases the lock and returns the connection to the pool. When the
+// lock cannot be released, the connection is discarded instead so that the
+// session holding the lock ends with it.
+func (l *serverLock) Unlock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", l.key)
+	if err != nil {
+		_ = l.conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	l.conn.Close()
+	return err
+}
+
+// withServerLock runs fn holding the advisory lock for databases with prefix
+// on the server db points at
+func withServerLock(ctx context.Context, db *sql.DB, prefix string, fn func() error) error {
+	lock, err := lockServer(ctx, db, prefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Unlock(); err != nil {
+			log.FromContext(ctx).Error(err, "Failed to release advisory lock")
+		}
+	}()
+	return fn()
+}
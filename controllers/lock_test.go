@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerLock(t *testing.T) {
+	db, d := openFakeDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The lock is released even when the reconcile was cancelled meanwhile,
+	// and the connection goes back to the pool
+	err := withServerLock(ctx, db, dbPrefix, func() error {
+		cancel()
+		return errors.New("failed")
+	})
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, []string{"SELECT pg_advisory_unlock(hashtext($1))"}, d.executed)
+	assert.Equal(t, 1, db.Stats().Idle)
+
+	// A session that may still hold the lock is never reused
+	db, d = openFakeDB(t, "pg_advisory_unlock")
+	assert.NoError(t, withServerLock(context.Background(), db, dbPrefix, func() error { return nil }))
+	assert.Equal(t, 0, db.Stats().OpenConnections)
+
+	db, d = openFakeDB(t)
+	d.lockBusy = true
+	assert.ErrorIs(t, withServerLock(context.Background(), db, dbPrefix, func() error { return nil }), errLockBusy)
+}
@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var idleDatabases = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sde_idle_databases",
+	Help: "Number of databases owned by an Sde that are idle longer than its idle policy allows",
+}, []string{"namespace", "sde"})
+
+func init() {
+	metrics.Registry.MustRegister(idleDatabases)
+}
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func migrationJobName(sde *sdev1beta1.Sde, dbName string) string {
+	version := strings.TrimPrefix(dbName, dbPrefix)
+	return strings.ToLower(fmt.Sprintf("%s-migrate-%s", sde.Name, strings.ReplaceAll(version, "_", "-")))
+}
+
+func findDbState(sde *sdev1beta1.Sde, name string) *sdev1beta1.DatabaseState {
+	for i := range sde.Status.Databases {
+		if sde.Status.Databases[i].Name == name {
+			return &sde.Status.Databases[i]
+		}
+	}
+	return nil
+}
+
+func setDbState(sde *sdev1beta1.Sde, state sdev1beta1.DatabaseState) {
+	if existing := findDbState(sde, state.Name); existing != nil {
+		*existing = state
+		return
+	}
+	sde.Status.Databases = append(sde.Status.Databases, state)
+}
+
+// dbCertDir is where Job containers find the server's CA certificate
+const dbCertDir = "/etc/sde-db"
+
+// connectionSecretName names the Secret holding the database connection of
+// owner's Jobs
+func connectionSecretName(owner client.Object) string {
+	return owner.GetName() + "-db-connection"
+}
+
+// ensureConnectionSecret copies conn into a Secret owned by owner, so that
+// Jobs connect like the controller does whether the details come from the
+// namespace or from an SdeDatabaseServer elsewhere in the cluster
+func ensureConnectionSecret(ctx context.Context, c client.Client, scheme *runtime.Scheme, owner client.Object, conn PGConnector) error {
+	data := map[string][]byte{
+		"DATABASE_HOST":     []byte(conn.Host),
+		"DATABASE_PORT":     []byte(conn.Port),
+		"DATABASE_USER":     []byte(conn.User),
+		"DATABASE_PASSWORD": []byte(conn.Password),
+		"PGSSLMODE":         []byte(conn.Sslmode.String()),
+	}
+	if conn.SslRootCert != "" {
+		data["ca.crt"] = []byte(conn.SslRootCert)
+	}
+
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: connectionSecretName(owner), Namespace: owner.GetNamespace()}, secret)
+	if err != nil && errors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: connectionSecretName(owner), Namespace: owner.GetNamespace()},
+			Data:       data,
+		}
+		if err = ctrl.SetControllerReference(owner, secret, scheme); err != nil {
+			return err
+		}
+		return c.Create(ctx, secret)
+	} else if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(secret.Data, data) {
+		return nil
+	}
+	secret.Data = data
+	return c.Update(ctx, secret)
+}
+
+// withDbConnection gives every container of spec the connection environment
+// for dbName, read from the connection Secret secretName
+func withDbConnection(spec *corev1.PodSpec, secretName, dbName string, conn PGConnector) {
+	fromSecret := func(key string) *corev1.EnvVarSource {
+		return &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+			Key:                  key,
+		}}
+	}
+	env := []corev1.EnvVar{
+		{Name: "DATABASE_HOST", ValueFrom: fromSecret("DATABASE_HOST")},
+		{Name: "DATABASE_PORT", ValueFrom: fromSecret("DATABASE_PORT")},
+		{Name: "DATABASE_USER", ValueFrom: fromSecret("DATABASE_USER")},
+		{Name: "DATABASE_PASSWORD", ValueFrom: fromSecret("DATABASE_PASSWORD")},
+		{Name: "DATABASE_NAME", Value: dbName},
+		{Name: "PGSSLMODE", ValueFrom: fromSecret("PGSSLMODE")},
+	}
+
+	var mounts []corev1.VolumeMount
+	if conn.SslRootCert != "" {
+		env = append(env, corev1.EnvVar{Name: "PGSSLROOTCERT", Value: dbCertDir + "/ca.crt"})
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: "db-ca",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
+				Items:      []corev1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+			}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: "db-ca", MountPath: dbCertDir, ReadOnly: true})
+	}
+
+	for i := range spec.InitContainers {
+		spec.InitContainers[i].Env = append(spec.InitContainers[i].Env, env...)
+		spec.InitContainers[i].VolumeMounts = append(spec.InitContainers[i].VolumeMounts, mounts...)
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].Env = append(spec.Containers[i].Env, env...)
+		spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts, mounts...)
+	}
+}
+
+func makeMigrationJob(sde *sdev1beta1.Sde, dbName string, conn PGConnector) *batchv1.Job {
+	template := sde.Spec.Migration.DeepCopy()
+	if template.Spec.RestartPolicy == "" {
+		template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	withDbConnection(&template.Spec, connectionSecretName(sde), dbName, conn)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migrationJobName(sde, dbName),
+			Namespace: sde.Namespace,
+			Labels: map[string]string{
+				"sde.domain/sde":      sde.Name,
+				"sde.domain/database": dbName,
+			},
+		},
+		Spec: batchv1.JobSpec{
+			Template: *template,
+		},
+	}
+}
+
+// startMigration launches the migration Job for a freshly provisioned
+// database and records it as Migrating.
+func (r *SdeReconciler) startMigration(ctx context.Context, sde *sdev1beta1.Sde, dbName string, conn PGConnector) error {
+	err := ensureConnectionSecret(ctx, r.Client, r.Scheme, sde, conn)
+	if err != nil {
+		return err
+	}
+	job := makeMigrationJob(sde, dbName, conn)
+	err = ctrl.SetControllerReference(sde, job, r.Scheme)
+	if err != nil {
+		return err
+	}
+
+	log.FromContext(ctx).Info(fmt.Sprintf("Creating migration Job %s for %s", job.Name, dbName))
+	err = r.Create(ctx, job)
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	setDbState(sde, sdev1beta1.DatabaseState{
+		Name:  dbName,
+		Phase: sdev1beta1.DatabaseMigrating,
+		Job:   job.Name,
+	})
+	return nil
+}
+
+func jobFinished(job *batchv1.Job) (bool, batchv1.JobConditionType) {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true, c.Type
+		}
+	}
+	return false, ""
+}
+
+// reconcileMigrations moves Migrating databases to Ready or Quarantined
+// once their Job has finished, and forgets databases that no longer exist.
+func (r *SdeReconciler) reconcileMigrations(ctx context.Context, sde *sdev1beta1.Sde, dbList []string) error {
+	logger := log.FromContext(ctx)
+	changed := false
+
+	states := sde.Status.Databases[:0]
+	for _, state := range sde.Status.Databases {
+		if containsDb(dbList, state.Name) {
+			states = append(states, state)
+		} else {
+			changed = true
+		}
+	}
+	sde.Status.Databases = states
+
+	for i := range sde.Status.Databases {
+		state := &sde.Status.Databases[i]
+		if state.Phase != sdev1beta1.DatabaseMigrating {
+			continue
+		}
+
+		job := &batchv1.Job{}
+		err := r.Get(ctx, types.NamespacedName{Name: state.Job, Namespace: sde.Namespace}, job)
+		if err != nil && errors.IsNotFound(err) {
+			state.Phase = sdev1beta1.DatabaseQuarantined
+			state.Message = fmt.Sprintf("migration Job %s not found", state.Job)
+			changed = true
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		finished, result := jobFinished(job)
+		if !finished {
+			continue
+		}
+
+		if result == batchv1.JobComplete {
+			logger.Info(fmt.Sprintf("Migration of %s succeeded", state.Name))
+			state.Phase = sdev1beta1.DatabaseReady
+			state.Message = ""
+		} else {
+			logger.Info(fmt.Sprintf("Migration of %s failed, quarantining database", state.Name))
+			state.Phase = sdev1beta1.DatabaseQuarantined
+			state.Message = fmt.Sprintf("migration Job %s failed", state.Job)
+		}
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return r.Status().Update(ctx, sde)
+}
+
+// liveDbs filters out databases that are still migrating or quarantined so
+// they are never counted or dropped by retention.
+func liveDbs(sde *sdev1beta1.Sde, dbList []string) []string {
+	live := make([]string, 0, len(dbList))
+	for _, name := range dbList {
+		if state := findDbState(sde, name); state != nil && state.Phase != sdev1beta1.DatabaseReady {
+			continue
+		}
+		live = append(live, name)
+	}
+	return live
+}
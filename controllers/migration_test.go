@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestLiveDbs(t *testing.T) {
+	sde := &sdev1beta1.Sde{}
+	sde.Status.Databases = []sdev1beta1.DatabaseState{
+		{Name: "sde_5.3.4", Phase: sdev1beta1.DatabaseReady},
+		{Name: "sde_5.4.0", Phase: sdev1beta1.DatabaseQuarantined},
+		{Name: "sde_5.5.0", Phase: sdev1beta1.DatabaseMigrating},
+	}
+
+	live := liveDbs(sde, []string{"sde_5.2.1", "sde_5.3.4", "sde_5.4.0", "sde_5.5.0"})
+	assert.Equal(t, []string{"sde_5.2.1", "sde_5.3.4"}, live)
+}
+
+func TestMakeMigrationJob(t *testing.T) {
+	sde := &sdev1beta1.Sde{}
+	sde.Name = "sde-sample"
+	sde.Namespace = "team"
+	sde.Spec.Migration = &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "migrate", Image: "sde:5.4.0_rc1"}}},
+	}
+
+	job := makeMigrationJob(sde, "sde_5.4.0_rc1", PGConnector{})
+	assert.Equal(t, "sde-sample-migrate-5.4.0-rc1", job.Name)
+	assert.Equal(t, corev1.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+
+	env := job.Spec.Template.Spec.Containers[0].Env
+	assert.Len(t, env, 6)
+	assert.Equal(t, "sde-sample-db-connection", env[0].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, "DATABASE_PASSWORD", env[3].ValueFrom.SecretKeyRef.Key)
+	assert.Equal(t, "sde_5.4.0_rc1", env[4].Value)
+	assert.Empty(t, job.Spec.Template.Spec.Volumes)
+
+	// A server CA is mounted from the connection Secret
+	job = makeMigrationJob(sde, "sde_5.4.0_rc1", PGConnector{Sslmode: sslVerifyFull, SslRootCert: "PEM"})
+	container := job.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, corev1.EnvVar{Name: "PGSSLROOTCERT", Value: "/etc/sde-db/ca.crt"}, container.Env[6])
+	assert.Equal(t, "sde-sample-db-connection", job.Spec.Template.Spec.Volumes[0].Secret.SecretName)
+	assert.Equal(t, "/etc/sde-db", container.VolumeMounts[0].MountPath)
+
+	// The Sde's own template must not be modified
+	assert.Empty(t, sde.Spec.Migration.Spec.Containers[0].Env)
+}
@@ -0,0 +1,397 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// NotifierOptions bounds webhook deliveries
+type NotifierOptions struct {
+	// Timeout limits a single POST
+	Timeout time.Duration
+	// MaxAttempts is how often a delivery is tried before it is given up
+	MaxAttempts int
+	// Backoff is the delay before the first retry; it doubles up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Workers is the number of deliveries in flight at once
+	Workers int
+	// QueueSize is how many deliveries may wait; more are dropped
+	QueueSize int
+}
+
+// Notifier posts retention summaries to the endpoints in spec.notifications.
+// Reconcile only queues deliveries, so slow or failing receivers never hold
+// it up. Retries are scheduled rather than slept, keeping workers free.
+type Notifier struct {
+	client client.Client
+	scheme *runtime.Scheme
+	opts   NotifierOptions
+	http   *http.Client
+	queue  chan *delivery
+}
+
+func NewNotifier(c client.Client, scheme *runtime.Scheme, opts NotifierOptions) *Notifier {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 2 * time.Second
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = time.Minute
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 2
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 100
+	}
+	return &Notifier{
+		client: c,
+		scheme: scheme,
+		opts:   opts,
+		http:   &http.Client{Timeout: opts.Timeout},
+		queue:  make(chan *delivery, opts.QueueSize),
+	}
+}
+
+// notificationPayload is the run summary handed to the endpoint template
+type notificationPayload struct {
+	Events         []sdev1beta1.NotificationEvent `json:"events"`
+	Sde            string                         `json:"sde"`
+	Namespace      string                         `json:"namespace"`
+	Time           time.Time                      `json:"time"`
+	PlanHash       string                         `json:"planHash,omitempty"`
+	Planned        []string                       `json:"planned,omitempty"`
+	Dropped        []string                       `json:"dropped,omitempty"`
+	Failed         []string                       `json:"failed,omitempty"`
+	ReclaimedBytes int64                          `json:"reclaimedBytes"`
+}
+
+type delivery struct {
+	sde      types.NamespacedName
+	owner    *sdev1beta1.Sde
+	endpoint sdev1beta1.Notification
+	payload  *notificationPayload
+	attempts int
+}
+
+// deliveryState is what is recorded for the latest delivery to an endpoint
+type deliveryState struct {
+	Endpoint    string                         `json:"endpoint"`
+	Events      []sdev1beta1.NotificationEvent `json:"events"`
+	State       string                         `json:"state"`
+	Attempts    int                            `json:"attempts"`
+	LastAttempt time.Time                      `json:"lastAttempt"`
+	Error       string                         `json:"error,omitempty"`
+}
+
+const (
+	deliveryPending   = "Pending"
+	deliveryDelivered = "Delivered"
+	deliveryFailed    = "Failed"
+)
+
+func notificationConfigMapName(sde *sdev1beta1.Sde) string {
+	return sde.Name + "-notifications"
+}
+
+var defaultNotificationEvents = []sdev1beta1.NotificationEvent{sdev1beta1.NotifyDropped, sdev1beta1.NotifyFailed}
+
+// matchingEvents is the part of events the endpoint subscribed to
+func matchingEvents(endpoint sdev1beta1.Notification, events []sdev1beta1.NotificationEvent) []sdev1beta1.NotificationEvent {
+	filter := endpoint.Events
+	if len(filter) == 0 {
+		filter = defaultNotificationEvents
+	}
+	var matched []sdev1beta1.NotificationEvent
+	for _, event := range events {
+		for _, f := range filter {
+			if event == f {
+				matched = append(matched, event)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// planPayload summarizes a newly planned set of drops
+func planPayload(sde *sdev1beta1.Sde) *notificationPayload {
+	payload := &notificationPayload{
+		Events:    []sdev1beta1.NotificationEvent{sdev1beta1.NotifyPlanned},
+		Sde:       sde.Name,
+		Namespace: sde.Namespace,
+		Time:      time.Now().UTC(),
+		PlanHash:  sde.Status.Plan.Hash,
+	}
+	for _, drop := range sde.Status.Plan.Drop {
+		payload.Planned = append(payload.Planned, drop.Name)
+	}
+	return payload
+}
+
+// runPayload summarizes a cleanup run, counting the sizes of dropped databases
+// as reclaimed
+func runPayload(sde *sdev1beta1.Sde, results []sdev1beta1.DatabaseResult, info map[string]dbInfo) *notificationPayload {
+	payload := &notificationPayload{
+		Sde:       sde.Name,
+		Namespace: sde.Namespace,
+		Time:      time.Now().UTC(),
+	}
+	if sde.Status.Plan != nil {
+		payload.PlanHash = sde.Status.Plan.Hash
+	}
+	for _, res := range results {
+		payload.Planned = append(payload.Planned, res.Name)
+		if res.Outcome == sdev1beta1.DropDropped {
+			payload.Dropped = append(payload.Dropped, res.Name)
+			payload.ReclaimedBytes += info[res.Name].size
+		} else {
+			payload.Failed = append(payload.Failed, res.Name)
+		}
+	}
+	if len(payload.Dropped) > 0 {
+		payload.Events = append(payload.Events, sdev1beta1.NotifyDropped)
+	}
+	if len(payload.Failed) > 0 {
+		payload.Events = append(payload.Events, sdev1beta1.NotifyFailed)
+	}
+	return payload
+}
+
+// notify queues payload for every endpoint of sde subscribed to one of its
+// events. It never blocks; a full queue drops the delivery with an Event.
+func (r *SdeReconciler) notify(sde *sdev1beta1.Sde, payload *notificationPayload) {
+	if r.Notifier == nil {
+		return
+	}
+	for _, endpoint := range sde.Spec.Notifications {
+		events := matchingEvents(endpoint, payload.Events)
+		if len(events) == 0 {
+			continue
+		}
+		scoped := *payload
+		scoped.Events = events
+		d := &delivery{
+			sde:      types.NamespacedName{Name: sde.Name, Namespace: sde.Namespace},
+			owner:    sde.DeepCopy(),
+			endpoint: *endpoint.DeepCopy(),
+			payload:  &scoped,
+		}
+		if !r.Notifier.enqueue(d) {
+			r.event(sde, corev1.EventTypeWarning, "NotificationDropped",
+				fmt.Sprintf("Notification queue is full, not sending %v to %s", events, endpoint.Name))
+		}
+	}
+}
+
+func (n *Notifier) enqueue(d *delivery) bool {
+	select {
+	case n.queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Notifier) Start(ctx context.Context) error {
+	for i := 0; i < n.opts.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-n.queue:
+					n.deliver(ctx, d)
+				}
+			}
+		}()
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// retryDelay is the backoff after the given number of failed attempts
+func (n *Notifier) retryDelay(attempts int) time.Duration {
+	delay := n.opts.Backoff
+	for i := 1; i < attempts && delay < n.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > n.opts.MaxBackoff {
+		delay = n.opts.MaxBackoff
+	}
+	return delay
+}
+
+// deliver makes one attempt, records its outcome and schedules a retry for
+// transient failures
+func (n *Notifier) deliver(ctx context.Context, d *delivery) {
+	ctxlog := log.FromContext(ctx).WithValues("sde", d.sde, "endpoint", d.endpoint.Name)
+	d.attempts++
+	retryable, err := n.post(ctx, d)
+
+	state := deliveryState{
+		Endpoint:    d.endpoint.Name,
+		Events:      d.payload.Events,
+		State:       deliveryDelivered,
+		Attempts:    d.attempts,
+		LastAttempt: time.Now().UTC(),
+	}
+	if err != nil {
+		state.Error = err.Error()
+		state.State = deliveryFailed
+		if retryable && d.attempts < n.opts.MaxAttempts {
+			state.State = deliveryPending
+		}
+		ctxlog.Info("Notification delivery failed", "attempts", d.attempts, "state", state.State, "error", err.Error())
+	}
+	if err := n.record(ctx, d, state); err != nil {
+		ctxlog.Error(err, "Failed to record notification delivery state")
+	}
+
+	// Only hand d to another worker once this one is done with it
+	if state.State == deliveryPending {
+		time.AfterFunc(n.retryDelay(d.attempts), func() {
+			if ctx.Err() == nil && !n.enqueue(d) {
+				ctxlog.Info("Notification queue is full, giving up on a retry")
+			}
+		})
+	}
+}
+
+// post renders, signs and sends d. Network errors, 429 and 5xx responses are
+// retryable; anything else is not.
+func (n *Notifier) post(ctx context.Context, d *delivery) (bool, error) {
+	body, err := renderPayload(d.endpoint.Template, d.payload)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ref := d.endpoint.SigningKey; ref != nil {
+		secret := &corev1.Secret{}
+		if err := n.client.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: d.sde.Namespace}, secret); err != nil {
+			return !errors.IsNotFound(err), fmt.Errorf("signing key: %w", err)
+		}
+		key, ok := secret.Data[ref.Key]
+		if !ok {
+			return false, fmt.Errorf("signing key: secret %s has no key %q", ref.Name, ref.Key)
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Sde-Timestamp", timestamp)
+		req.Header.Set("X-Sde-Signature", "sha256="+signPayload(key, timestamp, body))
+	}
+
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return false, fmt.Errorf("endpoint returned %s", resp.Status)
+}
+
+// signPayload is the hex HMAC-SHA256 of "<timestamp>.<body>"
+func signPayload(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// renderPayload executes the endpoint template over payload and checks that
+// the result is JSON. Without a template the payload itself is sent.
+func renderPayload(text string, payload *notificationPayload) ([]byte, error) {
+	if text == "" {
+		return json.Marshal(payload)
+	}
+	tmpl, err := template.New("notification").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			out, err := json.Marshal(v)
+			return string(out), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, payload); err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template: rendered body is not valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// record stores state as the endpoint's entry in the Sde's notifications
+// ConfigMap. Sde status is left alone so deliveries never conflict with
+// Reconcile's own status writes.
+func (n *Notifier) record(ctx context.Context, d *delivery, state deliveryState) error {
+	line, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	key := types.NamespacedName{Name: notificationConfigMapName(d.owner), Namespace: d.sde.Namespace}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configmap := &corev1.ConfigMap{}
+		err := n.client.Get(ctx, key, configmap)
+		if err != nil && errors.IsNotFound(err) {
+			configmap = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Data:       map[string]string{state.Endpoint: string(line)},
+			}
+			if err = ctrl.SetControllerReference(d.owner, configmap, n.scheme); err != nil {
+				return err
+			}
+			return n.client.Create(ctx, configmap)
+		} else if err != nil {
+			return err
+		}
+
+		if configmap.Data == nil {
+			configmap.Data = map[string]string{}
+		}
+		configmap.Data[state.Endpoint] = string(line)
+		return n.client.Update(ctx, configmap)
+	})
+}
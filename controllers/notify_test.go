@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestNotificationPayloads(t *testing.T) {
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"}}
+	results := []sdev1beta1.DatabaseResult{
+		{Name: "sde_5.0.0", Outcome: sdev1beta1.DropDropped},
+		{Name: "sde_5.1.0", Outcome: sdev1beta1.DropFailed},
+		{Name: "sde_5.2.0", Outcome: sdev1beta1.DropDropped},
+	}
+	info := map[string]dbInfo{"sde_5.0.0": {size: 100}, "sde_5.1.0": {size: 200}, "sde_5.2.0": {size: 300}}
+
+	payload := runPayload(sde, results, info)
+	assert.Equal(t, []sdev1beta1.NotificationEvent{sdev1beta1.NotifyDropped, sdev1beta1.NotifyFailed}, payload.Events)
+	assert.Equal(t, []string{"sde_5.0.0", "sde_5.2.0"}, payload.Dropped)
+	assert.Equal(t, []string{"sde_5.1.0"}, payload.Failed)
+	assert.Equal(t, int64(400), payload.ReclaimedBytes)
+
+	// Planned is opt-in, the other events are sent by default
+	events := []sdev1beta1.NotificationEvent{sdev1beta1.NotifyPlanned, sdev1beta1.NotifyFailed}
+	assert.Equal(t, []sdev1beta1.NotificationEvent{sdev1beta1.NotifyFailed}, matchingEvents(sdev1beta1.Notification{}, events))
+	assert.Empty(t, matchingEvents(sdev1beta1.Notification{Events: []sdev1beta1.NotificationEvent{sdev1beta1.NotifyDropped}}, events))
+
+	body, err := renderPayload(`{"text": {{ printf "%s dropped %v" .Sde .Dropped | json }}, "bytes": {{ .ReclaimedBytes }}}`, payload)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"text": "sde dropped [sde_5.0.0 sde_5.2.0]", "bytes": 400}`, string(body))
+
+	_, err = renderPayload(`{"text": {{ .Sde }}}`, payload)
+	assert.Error(t, err)
+}
+
+func TestNotifierDelivery(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	var signature, timestamp string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		signature, timestamp = r.Header.Get("X-Sde-Signature"), r.Header.Get("X-Sde-Timestamp")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+	sde := &sdev1beta1.Sde{
+		ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns", UID: "uid"},
+		Spec: sdev1beta1.SdeSpec{Notifications: []sdev1beta1.Notification{{
+			Name: "chat",
+			URL:  server.URL,
+			SigningKey: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "hook"}, Key: "key",
+			},
+		}}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "hook", Namespace: "ns"},
+		Data:       map[string][]byte{"key": []byte("s3cret")},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde, secret).Build()
+
+	notifier := NewNotifier(c, scheme, NotifierOptions{Backoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = notifier.Start(ctx) }()
+
+	r := &SdeReconciler{Client: c, Scheme: scheme, Notifier: notifier}
+	r.notify(sde, runPayload(sde, []sdev1beta1.DatabaseResult{{Name: "sde_5.0.0", Outcome: sdev1beta1.DropDropped}}, nil))
+
+	state := func() deliveryState {
+		var state deliveryState
+		configmap := &corev1.ConfigMap{}
+		if c.Get(ctx, types.NamespacedName{Name: "sde-notifications", Namespace: "ns"}, configmap) == nil {
+			_ = json.Unmarshal([]byte(configmap.Data["chat"]), &state)
+		}
+		return state
+	}
+	assert.Eventually(t, func() bool { return state().State == deliveryDelivered }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, state().Attempts)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "sha256="+signPayload([]byte("s3cret"), timestamp, body), signature)
+	var payload notificationPayload
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, []string{"sde_5.0.0"}, payload.Dropped)
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Databases are owned by the Sde named in their COMMENT ON DATABASE. Several
+// namespaces may share a server, so retention only ever considers databases
+// whose comment names the reconciling Sde.
+const ownerCommentPrefix = "sde.domain/owner="
+
+func ownerComment(sde *sdev1beta1.Sde) string {
+	return fmt.Sprintf("%s%s/%s", ownerCommentPrefix, sde.Namespace, sde.Name)
+}
+
+// listDatabases returns every database named sde_<version> with its comment.
+// Whether <version> parses is up to the Sde's version scheme.
+func listDatabases(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT datname, COALESCE(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database WHERE datname ~ '^sde_.+$';`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dbs := map[string]string{}
+	var name, comment string
+	for rows.Next() {
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, err
+		}
+		dbs[name] = comment
+	}
+	return dbs, rows.Err()
+}
+
+// partitionOwned splits databases into those owned by sde and all others
+func partitionOwned(sde *sdev1beta1.Sde, dbs map[string]string) (owned, unowned []string) {
+	owned, unowned = []string{}, []string{}
+	marker := ownerComment(sde)
+	for name, comment := range dbs {
+		if comment == marker {
+			owned = append(owned, name)
+		} else {
+			unowned = append(unowned, name)
+		}
+	}
+	sortDbs(sde, owned)
+	sortDbs(sde, unowned)
+	return owned, unowned
+}
+
+// stillOwned lists the databases again and keeps the candidates the Sde still
+// owns. Discovery and planning run outside the server lock, so by the time a
+// reconcile holds it another may have dropped or claimed a candidate; the
+// drops therefore call this under the lock and only act on what it keeps.
+// The others come back as skipped results.
+func stillOwned(ctx context.Context, db *sql.DB, sde *sdev1beta1.Sde, candidates []string) ([]string, []sdev1beta1.DatabaseResult, error) {
+	dbs, err := listDatabases(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	owned, _ := partitionOwned(sde, dbs)
+	var kept []string
+	var skipped []sdev1beta1.DatabaseResult
+	for _, name := range candidates {
+		if containsDb(owned, name) {
+			kept = append(kept, name)
+			continue
+		}
+		skipped = append(skipped, sdev1beta1.DatabaseResult{
+			Name:    name,
+			Outcome: sdev1beta1.DropSkipped,
+			Message: "no longer owned by this Sde",
+		})
+	}
+	return kept, skipped, nil
+}
+
+// claimDatabase records the executor's Sde as the owner of a database
+func (e *sqlExecutor) claimDatabase(ctx context.Context, name string) error {
+	return e.exec(ctx, fmt.Sprintf("COMMENT ON DATABASE %s IS %s", pq.QuoteIdentifier(name), pq.QuoteLiteral(ownerComment(e.sde))))
+}
+
+// adoptPattern compiles the Sde's adoption pattern, which AdoptUnowned
+// requires
+func adoptPattern(sde *sdev1beta1.Sde) (*regexp.Regexp, error) {
+	if sde.Spec.AdoptPattern == "" {
+		return nil, configErrorf("adoptUnowned requires adoptPattern to select the databases to adopt")
+	}
+	pattern, err := regexp.Compile("^(?:" + sde.Spec.AdoptPattern + ")$")
+	if err != nil {
+		return nil, configErrorf("invalid adopt pattern %q: %v", sde.Spec.AdoptPattern, err)
+	}
+	return pattern, nil
+}
+
+// adoptUnowned claims databases matching pattern that carry no comment at
+// all. Databases with any other comment may belong to someone else and are
+// left alone, as are the golden template and names the version scheme does
+// not understand.
+func adoptUnowned(ctx context.Context, exec *sqlExecutor, pattern *regexp.Regexp, dbs map[string]string) error {
+	sde := exec.sde
+	template := ""
+	if p := sde.Spec.Provisioning; p != nil {
+		template = p.TemplateDatabase
+	}
+	for name, comment := range dbs {
+		if comment != "" || name == template || !pattern.MatchString(name) || !parsableDb(sde, name) {
+			continue
+		}
+		log.FromContext(ctx).Info(fmt.Sprintf("Adopting unowned database %s", name))
+		if err := exec.claimDatabase(ctx, name); err != nil {
+			return err
+		}
+		dbs[name] = ownerComment(sde)
+	}
+	return nil
+}
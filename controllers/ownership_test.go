@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestPartitionOwned(t *testing.T) {
+	sde := &sdev1beta1.Sde{}
+	sde.Namespace = "team-a"
+	sde.Name = "sde"
+
+	dbs := map[string]string{
+		"sde_5.6.5": "sde.domain/owner=team-a/sde",
+		"sde_5.2.1": "sde.domain/owner=team-a/sde",
+		"sde_5.3.4": "sde.domain/owner=team-b/sde",
+		"sde_5.4.0": "",
+	}
+
+	owned, unowned := partitionOwned(sde, dbs)
+	assert.Equal(t, []string{"sde_5.2.1", "sde_5.6.5"}, owned)
+	assert.Equal(t, []string{"sde_5.3.4", "sde_5.4.0"}, unowned)
+}
+
+func TestAdoptUnowned(t *testing.T) {
+	sde := &sdev1beta1.Sde{}
+	sde.Namespace = "team-a"
+	sde.Name = "sde"
+
+	_, err := adoptPattern(sde)
+	assert.Equal(t, classConfig, classifyError(err))
+	sde.Spec.AdoptPattern = "sde_5("
+	_, err = adoptPattern(sde)
+	assert.Equal(t, classConfig, classifyError(err))
+
+	// Only uncommented databases matching the whole pattern are claimed
+	sde.Spec.AdoptPattern = `sde_5\.[0-9]+\.[0-9]+`
+	pattern, err := adoptPattern(sde)
+	assert.NoError(t, err)
+	db, d := openFakeDB(t)
+	dbs := map[string]string{
+		"sde_5.4.0":       "",
+		"sde_5.4.0_other": "",
+		"sde_6.0.0":       "",
+		"sde_5.3.4":       "sde.domain/owner=team-b/sde",
+	}
+	exec := newExecutor(db, sde, "adoption")
+	assert.NoError(t, adoptUnowned(context.Background(), exec, pattern, dbs))
+	assert.Equal(t, []string{`COMMENT ON DATABASE "sde_5.4.0" IS 'sde.domain/owner=team-a/sde'`}, d.executed)
+	// The claim is audited like any other statement
+	if assert.Len(t, exec.records, 1) {
+		assert.Equal(t, d.executed[0], exec.records[0].Statement)
+	}
+	assert.Equal(t, "sde.domain/owner=team-b/sde", dbs["sde_5.3.4"])
+}
+
+func TestStillOwned(t *testing.T) {
+	sde := &sdev1beta1.Sde{}
+	sde.Namespace = "ns"
+	sde.Name = "sde"
+	db, d := openFakeDB(t)
+	d.comments = map[string]string{
+		"sde_5.0.0": ownerComment(sde),
+		"sde_5.1.0": "sde.domain/owner=other/sde",
+	}
+
+	// sde_5.1.0 was claimed and sde_5.2.0 dropped since the plan was made
+	kept, skipped, err := stillOwned(context.Background(), db, sde, []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sde_5.0.0"}, kept)
+	if assert.Len(t, skipped, 2) {
+		assert.Equal(t, "sde_5.1.0", skipped[0].Name)
+		assert.Equal(t, sdev1beta1.DropSkipped, skipped[1].Outcome)
+	}
+}
@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"time"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// Reasons recorded in the retention plan
+const (
+	reasonCount       = "DatabaseCount"
+	reasonSizeBudget  = "SizeBudget"
+	reasonIdle        = "Idle"
+	reasonReleaseLine = "ReleaseLine"
+	reasonEndOfLife   = "EndOfLife"
+)
+
+// retentionPlan collects the databases selected by each policy. live is
+// sorted oldest first and the plan keeps its drops in that order.
+type retentionPlan struct {
+	live      []string
+	selected  map[string]string
+	protected map[string]bool
+	pinned    map[string]bool
+	lines     []sdev1beta1.ReleaseLine
+}
+
+func newRetentionPlan(live []string) *retentionPlan {
+	return &retentionPlan{live: live, selected: map[string]string{}, protected: map[string]bool{}, pinned: map[string]bool{}}
+}
+
+// add selects name for dropping unless it is pinned, protected or an earlier
+// policy already selected it
+func (p *retentionPlan) add(name, reason string) {
+	if _, ok := p.selected[name]; !ok && !p.protected[name] && !p.pinned[name] {
+		p.selected[name] = reason
+	}
+}
+
+// pin keeps names out of the plan whatever the policies say
+func (p *retentionPlan) pin(names []string) {
+	for _, name := range names {
+		p.pinned[name] = true
+	}
+}
+
+// verdict reports what the plan decided for a live database
+func (p *retentionPlan) verdict(name string) (sdev1beta1.RetentionVerdict, string) {
+	switch {
+	case p.pinned[name]:
+		return sdev1beta1.VerdictPinned, ""
+	case p.protected[name]:
+		return sdev1beta1.VerdictSupported, ""
+	}
+	if reason, ok := p.selected[name]; ok {
+		return sdev1beta1.VerdictDrop, reason
+	}
+	return sdev1beta1.VerdictKeep, ""
+}
+
+// drops returns the selected databases, oldest first
+func (p *retentionPlan) drops() []string {
+	var names []string
+	for _, name := range p.live {
+		if _, ok := p.selected[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (p *retentionPlan) status(sde *sdev1beta1.Sde) *sdev1beta1.RetentionPlan {
+	status := &sdev1beta1.RetentionPlan{Hash: planHash(sde, p.drops()), Lines: p.lines}
+	for _, name := range p.live {
+		if p.protected[name] {
+			status.Supported = append(status.Supported, name)
+		}
+		if p.pinned[name] {
+			status.Pinned = append(status.Pinned, name)
+		}
+	}
+	for _, name := range p.drops() {
+		status.Drop = append(status.Drop, sdev1beta1.PlannedDrop{Name: name, Reason: p.selected[name]})
+	}
+	return status
+}
+
+// planCount selects the oldest of names, sorted oldest first, beyond keep
+func (p *retentionPlan) planCount(names []string, keep int) {
+	for i := 0; i < len(names)-keep; i++ {
+		p.add(names[i], reasonCount)
+	}
+}
+
+// planLifecycle protects databases whose release is supported, selects
+// those past end of life plus the grace period and returns the databases
+// the catalog does not list. Releases with an unreadable end-of-life date
+// count as supported.
+func (p *retentionPlan) planLifecycle(releases []sdev1beta1.SdeRelease, grace time.Duration, now time.Time) []string {
+	eol := map[string]string{}
+	for _, release := range releases {
+		eol[versionDbName(release.Spec.Version)] = release.Spec.EndOfLife
+	}
+
+	var unlisted []string
+	for _, name := range p.live {
+		date, listed := eol[name]
+		if !listed {
+			unlisted = append(unlisted, name)
+			continue
+		}
+		day, err := time.Parse("2006-01-02", date)
+		if date == "" || err != nil || now.Before(day.AddDate(0, 0, 1).Add(grace)) {
+			p.protected[name] = true
+			continue
+		}
+		p.add(name, reasonEndOfLife)
+	}
+	return unlisted
+}
+
+// planReleaseLines groups databases by release line, keeps the newest
+// perLine databases of the newest lines and selects everything else
+func (p *retentionPlan) planReleaseLines(sde *sdev1beta1.Sde) {
+	policy := sde.Spec.Retention
+	if policy == nil || policy.ReleaseLines == nil {
+		return
+	}
+	by, perLine, lines := policy.ReleaseLines.By, 2, 3
+	if policy.ReleaseLines.PerLine != nil {
+		perLine = int(*policy.ReleaseLines.PerLine)
+	}
+	if policy.ReleaseLines.Lines != nil {
+		lines = int(*policy.ReleaseLines.Lines)
+	}
+
+	// Walk newest first so that lines and their members come out newest first
+	index := map[string]int{}
+	for i := len(p.live) - 1; i >= 0; i-- {
+		name := p.live[i]
+		line, ok := releaseLine(sde, name, by)
+		if !ok {
+			continue
+		}
+		n, seen := index[line]
+		if !seen {
+			n = len(p.lines)
+			index[line] = n
+			p.lines = append(p.lines, sdev1beta1.ReleaseLine{Line: line})
+		}
+
+		group := &p.lines[n]
+		if n < lines && len(group.Keep) < perLine {
+			group.Keep = append(group.Keep, name)
+			continue
+		}
+		group.Drop = append(group.Drop, name)
+		p.add(name, reasonReleaseLine)
+	}
+}
+
+// planSize selects the oldest remaining databases until the rest fit in
+// maxBytes, keeping at least minCount. Pinned and protected databases are
+// passed over, never counted as reclaimed. It returns the bytes all selected
+// drops reclaim.
+func (p *retentionPlan) planSize(sizes map[string]int64, total, maxBytes int64, minCount int) int64 {
+	var reclaim int64
+	for name := range p.selected {
+		reclaim += sizes[name]
+	}
+	for _, name := range p.live {
+		if total-reclaim <= maxBytes || len(p.live)-len(p.selected) <= minCount {
+			break
+		}
+		if _, ok := p.selected[name]; ok || p.protected[name] || p.pinned[name] {
+			continue
+		}
+		p.add(name, reasonSizeBudget)
+		reclaim += sizes[name]
+	}
+	return reclaim
+}
+
+// PlanInput is what retention decides on once the server has been read
+type PlanInput struct {
+	// Databases are the databases owned by the Sde
+	Databases []string
+	// Sizes are the database sizes in bytes, used by maxTotalSize
+	Sizes map[string]int64
+	// Pinned databases are never dropped
+	Pinned []string
+	// Releases is the SdeRelease catalog, used by the lifecycle policy
+	Releases []sdev1beta1.SdeRelease
+	// Activity is the recorded use of each database, used by the idle policy
+	Activity []sdev1beta1.DatabaseActivity
+	Now      time.Time
+}
+
+// RetentionPreview is what PlanRetention decided
+type RetentionPreview struct {
+	Plan    *sdev1beta1.RetentionPlan
+	Storage *sdev1beta1.StorageStatus
+	// Databases lists every input database oldest first with its verdict
+	Databases []PlannedDatabase
+}
+
+// PlannedDatabase is the verdict for one database; Reason names the policy
+// behind a Drop
+type PlannedDatabase struct {
+	Name    string                      `json:"name"`
+	Verdict sdev1beta1.RetentionVerdict `json:"verdict"`
+	Reason  string                      `json:"reason,omitempty"`
+}
+
+// PlanRetention makes the plan reconcileDb would make from in, for tools that
+// preview or simulate retention without a database connection. Like the
+// controller it leaves out databases whose migration has not succeeded and
+// unparsable names under the Ignore policy; those get the NotLive verdict.
+func PlanRetention(sde *sdev1beta1.Sde, in PlanInput) *RetentionPreview {
+	names := append([]string(nil), in.Databases...)
+	sortDbs(sde, names)
+	live := LiveDatabases(sde, names)
+	plan, storage := buildPlan(sde, live, in)
+
+	return &RetentionPreview{Plan: plan.status(sde), Storage: storage, Databases: plan.decisions(names)}
+}
+
+// decisions is the verdict on each of names; those the plan did not consider
+// are NotLive
+func (p *retentionPlan) decisions(names []string) []PlannedDatabase {
+	isLive := make(map[string]bool, len(p.live))
+	for _, name := range p.live {
+		isLive[name] = true
+	}
+	var decisions []PlannedDatabase
+	for _, name := range names {
+		verdict, reason := sdev1beta1.VerdictNotLive, ""
+		if isLive[name] {
+			verdict, reason = p.verdict(name)
+		}
+		decisions = append(decisions, PlannedDatabase{Name: name, Verdict: verdict, Reason: reason})
+	}
+	return decisions
+}
+
+// SortDatabases orders names oldest first by the Sde's version scheme
+func SortDatabases(sde *sdev1beta1.Sde, names []string) {
+	sortDbs(sde, names)
+}
+
+// LiveDatabases returns the names retention applies to: those whose
+// migration has succeeded, less unparsable names under the Ignore policy
+func LiveDatabases(sde *sdev1beta1.Sde, names []string) []string {
+	return retainedDbs(sde, liveDbs(sde, names))
+}
+
+// buildPlan applies every retention policy of sde to live, sorted oldest first
+func buildPlan(sde *sdev1beta1.Sde, live []string, in PlanInput) (*retentionPlan, *sdev1beta1.StorageStatus) {
+	plan := newRetentionPlan(live)
+	plan.pin(in.Pinned)
+	counted := live
+	if p := sde.Spec.Retention; p != nil && p.Lifecycle != nil {
+		counted = plan.planLifecycle(in.Releases, p.Lifecycle.GracePeriod.Duration, in.Now)
+	}
+	plan.planCount(counted, int(sde.Spec.DatabaseCount))
+	plan.planReleaseLines(sde)
+	storage := planSizeBudget(sde, in.Sizes, plan, in.Now)
+	if p := sde.Spec.Retention; p != nil && p.Idle != nil && p.Idle.Action == sdev1beta1.IdleDrop {
+		for _, name := range idleDrops(in.Activity, live) {
+			plan.add(name, reasonIdle)
+		}
+	}
+	return plan, storage
+}
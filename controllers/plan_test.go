@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestPlanReleaseLines(t *testing.T) {
+	perLine, lines := int32(2), int32(2)
+	sde := &sdev1beta1.Sde{Spec: sdev1beta1.SdeSpec{Retention: &sdev1beta1.RetentionSpec{
+		ReleaseLines: &sdev1beta1.ReleaseLinesPolicy{By: sdev1beta1.GroupByMinor, PerLine: &perLine, Lines: &lines},
+	}}}
+	live := []string{"sde_5.1.0", "sde_5.1.1", "sde_5.2.0", "sde_5.2.1", "sde_5.2.2", "sde_5.3.0", "sde_latest"}
+	sortDbs(sde, live)
+
+	plan := newRetentionPlan(live)
+	plan.planReleaseLines(sde)
+	assert.Equal(t, []string{"sde_5.1.0", "sde_5.1.1", "sde_5.2.0"}, plan.drops())
+
+	status := plan.status(&sdev1beta1.Sde{})
+	assert.Equal(t, []sdev1beta1.ReleaseLine{
+		{Line: "5.3", Keep: []string{"sde_5.3.0"}},
+		{Line: "5.2", Keep: []string{"sde_5.2.2", "sde_5.2.1"}, Drop: []string{"sde_5.2.0"}},
+		{Line: "5.1", Drop: []string{"sde_5.1.1", "sde_5.1.0"}},
+	}, status.Lines)
+	assert.Equal(t, reasonReleaseLine, status.Drop[0].Reason)
+
+	// An earlier policy's reason wins
+	plan = newRetentionPlan(live)
+	plan.planCount(live, len(live)-1)
+	plan.planReleaseLines(sde)
+	assert.Equal(t, reasonCount, plan.status(&sdev1beta1.Sde{}).Drop[0].Reason)
+
+	// Grouped by major, everything is one line
+	sde.Spec.Retention.ReleaseLines.By = sdev1beta1.GroupByMajor
+	plan = newRetentionPlan(live)
+	plan.planReleaseLines(sde)
+	assert.Equal(t, []string{"sde_5.1.0", "sde_5.1.1", "sde_5.2.0", "sde_5.2.1"}, plan.drops())
+}
+
+func TestPlanLifecycle(t *testing.T) {
+	release := func(version, eol string) sdev1beta1.SdeRelease {
+		return sdev1beta1.SdeRelease{Spec: sdev1beta1.SdeReleaseSpec{Version: version, EndOfLife: eol}}
+	}
+	releases := []sdev1beta1.SdeRelease{
+		release("5.0.0", "2024-01-31"),
+		release("5.1.0", "2026-12-31"),
+		release("5.2.0", ""),
+	}
+	live := []string{"sde_4.8.0", "sde_4.9.0", "sde_5.0.0", "sde_5.1.0", "sde_5.2.0"}
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// Within the grace period the EOL version is still kept
+	plan := newRetentionPlan(live)
+	unlisted := plan.planLifecycle(releases, 30*24*time.Hour, now)
+	assert.Equal(t, []string{"sde_4.8.0", "sde_4.9.0"}, unlisted)
+	plan.planCount(unlisted, 1)
+	plan.planCount(live, 1)
+	assert.Equal(t, []string{"sde_4.8.0", "sde_4.9.0"}, plan.drops())
+	assert.Equal(t, []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.0"}, plan.status(&sdev1beta1.Sde{}).Supported)
+
+	// Without grace it is dropped
+	plan = newRetentionPlan(live)
+	unlisted = plan.planLifecycle(releases, 0, now)
+	plan.planCount(unlisted, 1)
+	assert.Equal(t, []string{"sde_4.8.0", "sde_5.0.0"}, plan.drops())
+	assert.Equal(t, reasonEndOfLife, plan.status(&sdev1beta1.Sde{}).Drop[1].Reason)
+}
+
+func TestPlanPinned(t *testing.T) {
+	live := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.0"}
+	plan := newRetentionPlan(live)
+	plan.pin([]string{"sde_5.0.0"})
+	plan.planCount(live, 1)
+
+	assert.Equal(t, []string{"sde_5.1.0"}, plan.drops())
+	assert.Equal(t, []string{"sde_5.0.0"}, plan.status(&sdev1beta1.Sde{}).Pinned)
+
+	verdict, _ := plan.verdict("sde_5.0.0")
+	assert.Equal(t, sdev1beta1.VerdictPinned, verdict)
+	verdict, reason := plan.verdict("sde_5.1.0")
+	assert.Equal(t, sdev1beta1.VerdictDrop, verdict)
+	assert.Equal(t, reasonCount, reason)
+	verdict, _ = plan.verdict("sde_5.2.0")
+	assert.Equal(t, sdev1beta1.VerdictKeep, verdict)
+}
+
+func TestPlanRetention(t *testing.T) {
+	sde := &sdev1beta1.Sde{Spec: sdev1beta1.SdeSpec{DatabaseCount: 2}}
+	sde.Status.Databases = []sdev1beta1.DatabaseState{{Name: "sde_5.3.0", Phase: sdev1beta1.DatabaseMigrating}}
+
+	preview := PlanRetention(sde, PlanInput{
+		Databases: []string{"sde_5.3.0", "sde_5.10.0", "sde_5.2.0", "sde_5.1.0"},
+		Pinned:    []string{"sde_5.1.0"},
+		Now:       time.Now(),
+	})
+	assert.Equal(t, []PlannedDatabase{
+		{Name: "sde_5.1.0", Verdict: sdev1beta1.VerdictPinned},
+		{Name: "sde_5.2.0", Verdict: sdev1beta1.VerdictKeep},
+		{Name: "sde_5.3.0", Verdict: sdev1beta1.VerdictNotLive},
+		{Name: "sde_5.10.0", Verdict: sdev1beta1.VerdictKeep},
+	}, preview.Databases)
+	assert.Empty(t, preview.Plan.Drop)
+	assert.Nil(t, preview.Storage)
+}
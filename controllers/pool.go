@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// PoolOptions bounds every connection the controller opens
+type PoolOptions struct {
+	ConnectTimeout   time.Duration
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+	MaxOpenConns     int
+	// IdleTimeout closes pools, and connections within a pool, unused for this long
+	IdleTimeout time.Duration
+}
+
+// ServerPools keeps one size-limited *sql.DB per DSN, shared by every Sde
+// that connects with the same details. Rotated credentials produce a new DSN
+// and therefore a new pool; the old one is evicted once it has gone idle.
+// Callers lease a pool from Get and return it with the release func; a pool
+// is only evicted while nobody holds a lease on it.
+type ServerPools struct {
+	opts    PoolOptions
+	connect func(ctx context.Context, conn PGConnector) (*sql.DB, error)
+	mu      sync.Mutex
+	pools   map[string]*serverPool
+}
+
+type serverPool struct {
+	db       *sql.DB
+	leases   int
+	lastUsed time.Time
+}
+
+func NewServerPools(opts PoolOptions) *ServerPools {
+	return &ServerPools{
+		opts:    opts,
+		connect: func(ctx context.Context, conn PGConnector) (*sql.DB, error) { return conn.Connect(ctx) },
+		pools:   map[string]*serverPool{},
+	}
+}
+
+func (p *ServerPools) configure(conn PGConnector) PGConnector {
+	conn.ConnectTimeout = p.opts.ConnectTimeout
+	conn.StatementTimeout = p.opts.StatementTimeout
+	conn.LockTimeout = p.opts.LockTimeout
+	return conn
+}
+
+// poolKey hashes the DSN so credentials are not kept as map keys
+func poolKey(conn PGConnector) string {
+	sum := sha256.Sum256([]byte(conn.DSN()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get leases the pool for conn, opening and pinging it on first use. The
+// returned func ends the lease and must be called once the caller is done
+// with the pool. Opening happens outside the lock so a slow server does not
+// hold up callers of any other.
+func (p *ServerPools) Get(ctx context.Context, conn PGConnector) (*sql.DB, func(), error) {
+	conn = p.configure(conn)
+	key := poolKey(conn)
+
+	if db, release := p.lease(key); db != nil {
+		return db, release, nil
+	}
+
+	db, err := p.connect(ctx, conn)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	if p.opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(p.opts.MaxOpenConns)
+		db.SetMaxIdleConns(p.opts.MaxOpenConns)
+	}
+	db.SetConnMaxIdleTime(p.opts.IdleTimeout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pool, ok := p.pools[key]
+	if ok {
+		// Another caller opened the same pool meanwhile; use theirs
+		db.Close()
+	} else {
+		pool = &serverPool{db: db}
+		p.pools[key] = pool
+	}
+	return pool.db, p.leaseLocked(pool), nil
+}
+
+// Open returns a dedicated connection for conn outside the pools, for work
+// inside a version database. Pooling it would keep idle sessions in a
+// database that may be dropped next, so the returned func closes it.
+func (p *ServerPools) Open(ctx context.Context, conn PGConnector) (*sql.DB, func(), error) {
+	db, err := p.connect(ctx, p.configure(conn))
+	if err != nil {
+		return nil, func() {}, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, func() { db.Close() }, nil
+}
+
+// lease takes a lease on the pool under key, if it is open
+func (p *ServerPools) lease(key string) (*sql.DB, func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pool, ok := p.pools[key]
+	if !ok {
+		return nil, nil
+	}
+	return pool.db, p.leaseLocked(pool)
+}
+
+// leaseLocked takes a lease on pool; p.mu must be held
+func (p *ServerPools) leaseLocked(pool *serverPool) func() {
+	pool.leases++
+	pool.lastUsed = time.Now()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			pool.leases--
+			pool.lastUsed = time.Now()
+		})
+	}
+}
+
+// evictIdle closes pools nobody holds a lease on that have not been used
+// since before cutoff
+func (p *ServerPools) evictIdle(cutoff time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	evicted := 0
+	for key, pool := range p.pools {
+		if pool.leases == 0 && pool.lastUsed.Before(cutoff) {
+			pool.db.Close()
+			delete(p.pools, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// closeAll closes every pool, leased or not
+func (p *ServerPools) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, pool := range p.pools {
+		pool.db.Close()
+		delete(p.pools, key)
+	}
+}
+
+// Start evicts idle pools until ctx is done, then closes every pool. It
+// implements manager.Runnable so pools are closed on manager shutdown.
+func (p *ServerPools) Start(ctx context.Context) error {
+	interval := p.opts.IdleTimeout
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.closeAll()
+			return nil
+		case <-ticker.C:
+			if n := p.evictIdle(time.Now().Add(-interval)); n > 0 {
+				log.FromContext(ctx).Info("Closed idle database pools", "count", n)
+			}
+		}
+	}
+}
@@ -4,23 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"sort"
 	"strings"
+	"time"
 
-	"regexp"
-
-	"github.com/go-logr/logr"
-	ver "github.com/hashicorp/go-version"
 	_ "github.com/lib/pq"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
-var ctxlog logr.Logger
-var re = regexp.MustCompile(`\d+\.\d+\.\d+`)
-
+// DbVersions sorts database names by semantic version, with names that do
+// not parse last. Sdes choose their own scheme with sortDbs.
 type DbVersions []string
 
 func (s DbVersions) Len() int {
@@ -32,41 +28,24 @@ func (s DbVersions) Swap(i, j int) {
 }
 
 func (s DbVersions) Less(i, j int) bool {
-	var v1, v2 *ver.Version
-	rawv1 := re.FindStringSubmatch(s[i])
-	rawv2 := re.FindStringSubmatch(s[j])
-
-	if len(rawv1) == 0 {
-		return false
-	}
-
-	if len(rawv2) == 0 {
-		return true
-	}
-
-	v1, err := ver.NewVersion(rawv1[0])
-	if err != nil {
-		return false
-	}
-
-	v2, err = ver.NewVersion(rawv2[0])
-	if err != nil {
-		return true
-	}
-
-	return v1.LessThan(v2)
+	order := versionOrder{names: s, scheme: parseSemver, unparsable: sdev1beta1.UnparsableKeep}
+	return order.Less(i, j)
 }
 
-type sslMode bool
+type sslMode string
+
+const (
+	sslDisable    sslMode = "disable"
+	sslRequire    sslMode = "require"
+	sslVerifyCA   sslMode = "verify-ca"
+	sslVerifyFull sslMode = "verify-full"
+)
 
 func (s sslMode) String() string {
-	switch s {
-	case true:
-		return "enabled"
-	case false:
-		return "disable"
+	if s == "" {
+		return string(sslDisable)
 	}
-	return "unknown"
+	return string(s)
 }
 
 type PGConnector struct {
@@ -76,103 +55,426 @@ type PGConnector struct {
 	Password string
 	Dbname   string
 	Sslmode  sslMode
+	// SslRootCert is a PEM encoded CA certificate, passed inline to lib/pq
+	SslRootCert string
+
+	ConnectTimeout   time.Duration
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+}
+
+// dsnValue quotes a value for a key/value connection string
+func dsnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+func (p *PGConnector) DSN() string {
+	dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		dsnValue(p.Host), dsnValue(p.Port), dsnValue(p.User), dsnValue(p.Password), dsnValue(p.Dbname), p.Sslmode.String())
+	if p.SslRootCert != "" {
+		dsn += " sslinline=true sslrootcert=" + dsnValue(p.SslRootCert)
+	}
+	// lib/pq sends unknown keys to the server as session parameters
+	if p.ConnectTimeout > 0 {
+		dsn += fmt.Sprintf(" connect_timeout=%d", int(p.ConnectTimeout.Seconds()))
+	}
+	if p.StatementTimeout > 0 {
+		dsn += fmt.Sprintf(" statement_timeout=%d", p.StatementTimeout.Milliseconds())
+	}
+	if p.LockTimeout > 0 {
+		dsn += fmt.Sprintf(" lock_timeout=%d", p.LockTimeout.Milliseconds())
+	}
+	return dsn
 }
 
-func (p *PGConnector) Connect() (*sql.DB, error) {
-	psqlInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		p.Host, p.Port, p.User, p.Password, p.Dbname, p.Sslmode.String())
-	db, err := sql.Open("postgres", psqlInfo)
+func (p *PGConnector) Connect(ctx context.Context) (*sql.DB, error) {
+	db, err := sql.Open("postgres", p.DSN())
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.Ping()
+	err = db.PingContext(ctx)
 	if err != nil {
-		ctxlog.Info("Failed to connect to DB")
-		return nil, err
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to DB: %w", err)
 	}
 
 	return db, nil
 }
 
-func cleanupDB(db *sql.DB, dbList []string, count int) error {
-	var query strings.Builder
+// cleanupDB drops the candidate databases through the executor, in order,
+// together with their subscriptions, replication slots and leftover roles.
+// Blockers are checked first; depending on the blocker policy the database is
+// either reported as blocked or the blockers are resolved before the drop.
+// Each drop is attempted on its own; once more than budget drops have failed,
+// the remaining candidates are skipped. The error wraps the first failure.
+func cleanupDB(ctx context.Context, exec *sqlExecutor, candidates []string, budget int) ([]sdev1beta1.DatabaseResult, error) {
+	var firstErr error
+	results := make([]sdev1beta1.DatabaseResult, 0, len(candidates))
+	failed, blocked := 0, 0
+	resolve := blockerPolicy(exec.sde) == sdev1beta1.BlockerResolve
+
+	for _, name := range candidates {
+		if failed > budget {
+			results = append(results, sdev1beta1.DatabaseResult{
+				Name:    name,
+				Outcome: sdev1beta1.DropSkipped,
+				Message: "failure budget exhausted",
+			})
+			continue
+		}
 
-	for i := 0; i < count; i++ {
-		query.WriteString("DROP DATABASE ")
-		query.WriteString("\"")
-		query.WriteString(dbList[i])
-		query.WriteString("\" ;")
+		blockers, err := exec.findBlockers(ctx, name)
+		if err == nil && len(blockers) > 0 && !resolve {
+			blocked++
+			results = append(results, sdev1beta1.DatabaseResult{
+				Name:     name,
+				Outcome:  sdev1beta1.DropBlocked,
+				Message:  fmt.Sprintf("%d blockers", len(blockers)),
+				Blockers: blockers,
+			})
+			continue
+		}
 
-		_, err := db.Exec(query.String())
+		var steps []sdev1beta1.CleanupStep
+		closed := false
+		if err == nil && len(blockers) > 0 {
+			steps, err = exec.resolveBlockers(ctx, name, blockers)
+		}
+		if err == nil {
+			var s []sdev1beta1.CleanupStep
+			s, err = exec.dropDependents(ctx, name)
+			steps = append(steps, s...)
+		}
+		if err == nil && hasBlocker(blockers, sdev1beta1.BlockerSession) {
+			var s []sdev1beta1.CleanupStep
+			s, err = exec.closeSessions(ctx, name)
+			steps = append(steps, s...)
+			closed = err == nil
+		}
+		if err == nil {
+			err = exec.DropDatabase(ctx, name)
+			steps = append(steps, cleanupStep(actionDropDatabase, name, err))
+		}
+		if err != nil && closed {
+			steps = append(steps, exec.allowConnections(name))
+		}
 		if err != nil {
-			return err
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+			results = append(results, sdev1beta1.DatabaseResult{
+				Name:     name,
+				Outcome:  sdev1beta1.DropFailed,
+				Message:  err.Error(),
+				Blockers: blockers,
+				Steps:    steps,
+			})
+			continue
 		}
 
-		query.Reset()
+		steps = append(steps, exec.dropRoles(ctx, name)...)
+		results = append(results, sdev1beta1.DatabaseResult{
+			Name:     name,
+			Outcome:  sdev1beta1.DropDropped,
+			Blockers: blockers,
+			Steps:    steps,
+		})
 	}
 
-	return nil
+	if firstErr != nil {
+		return results, fmt.Errorf("%d of %d drops failed: %w", failed, len(candidates), firstErr)
+	}
+	if blocked > 0 {
+		return results, fmt.Errorf("%d of %d databases have blockers: %w", blocked, len(candidates), errDropBlocked)
+	}
+	return results, nil
 }
 
-func (r *SdeReconciler) reconcileDb(ctx context.Context, sde *sdev1beta1.Sde) error {
-	ctxlog = log.FromContext(ctx)
-	ctxlog.Info("Reconciling Database...")
+// withoutDbs returns dbList minus the names in remove
+func withoutDbs(dbList, remove []string) []string {
+	kept := make([]string, 0, len(dbList))
+	for _, name := range dbList {
+		if !containsDb(remove, name) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func dbConfigMapName(namespace string) string {
+	return fmt.Sprintf("%s-db-configmap", namespace)
+}
 
-	// Get connection strings
+func dbSecretName(namespace string) string {
+	return fmt.Sprintf("%s-database-secrets", namespace)
+}
+
+// connectorFor returns the admin connection for an Sde, from its
+// SdeDatabaseServer when set or else from the namespace ConfigMap and Secret.
+func connectorFor(ctx context.Context, c client.Client, sde *sdev1beta1.Sde) (PGConnector, error) {
+	if sde.Spec.DatabaseServer != "" {
+		server := &sdev1beta1.SdeDatabaseServer{}
+		err := c.Get(ctx, types.NamespacedName{Name: sde.Spec.DatabaseServer}, server)
+		if err != nil {
+			return PGConnector{}, err
+		}
+
+		allowed, err := namespaceAllowed(ctx, c, server, sde.Namespace)
+		if err != nil {
+			return PGConnector{}, err
+		}
+		if !allowed {
+			return PGConnector{}, configErrorf("namespace %s may not use database server %s", sde.Namespace, server.Name)
+		}
+		return serverConnector(ctx, c, server)
+	}
+
+	return namespaceConnector(ctx, c, sde.Namespace)
+}
+
+// sdeForDatabase finds the Sde in namespace whose SdeDatabase mirrors dbName,
+// or else the only Sde in the namespace. It returns nil when the namespace
+// has no Sde at all.
+func sdeForDatabase(ctx context.Context, c client.Client, namespace, dbName string) (*sdev1beta1.Sde, error) {
+	name := ""
+	objs := &sdev1beta1.SdeDatabaseList{}
+	if err := c.List(ctx, objs, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for _, obj := range objs.Items {
+		if obj.Spec.DatabaseName == dbName {
+			name = obj.Labels["sde.domain/sde"]
+			break
+		}
+	}
+
+	if name == "" {
+		sdes := &sdev1beta1.SdeList{}
+		if err := c.List(ctx, sdes, client.InNamespace(namespace)); err != nil {
+			return nil, err
+		}
+		switch len(sdes.Items) {
+		case 0:
+			return nil, nil
+		case 1:
+			return &sdes.Items[0], nil
+		}
+		return nil, configErrorf("no Sde in namespace %s owns database %s", namespace, dbName)
+	}
+
+	sde := &sdev1beta1.Sde{}
+	if err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, sde); err != nil {
+		return nil, err
+	}
+	return sde, nil
+}
+
+// namespaceConnector reads the connection details of Sdes without a shared
+// database server from their namespace's ConfigMap and Secret
+func namespaceConnector(ctx context.Context, c client.Client, namespace string) (PGConnector, error) {
 	dbSecret := &corev1.Secret{}
 	configMap := &corev1.ConfigMap{}
-	err := r.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("%s-db-configmap", sde.Namespace), Namespace: sde.Namespace}, configMap)
+	err := c.Get(ctx, types.NamespacedName{Name: dbConfigMapName(namespace), Namespace: namespace}, configMap)
 	if err != nil {
-		return err
+		return PGConnector{}, err
 	}
 
-	err = r.Get(ctx, types.NamespacedName{Name: fmt.Sprintf("%s-database-secrets", sde.Namespace), Namespace: sde.Namespace}, dbSecret)
+	err = c.Get(ctx, types.NamespacedName{Name: dbSecretName(namespace), Namespace: namespace}, dbSecret)
 	if err != nil {
-		return err
+		return PGConnector{}, err
 	}
 
-	conn := PGConnector{
+	return PGConnector{
 		Host:     configMap.Data["DATABASE_HOST"],
 		Port:     configMap.Data["DATABASE_PORT"],
 		Password: string(dbSecret.Data["ADMIN_DATABASE_PASSWORD"]),
 		User:     configMap.Data["ADMIN_DATABASE_USER"],
 		Dbname:   "sde_",
-		Sslmode:  false,
+		Sslmode:  sslDisable,
+	}, nil
+}
+
+func (r *SdeReconciler) reconcileDb(ctx context.Context, sde *sdev1beta1.Sde, run *runReport) error {
+	ctxlog := log.FromContext(ctx)
+	ctxlog.Info("Reconciling Database...")
+
+	run.phase("connect")
+	conn, err := connectorFor(ctx, r.Client, sde)
+	if err != nil {
+		return err
 	}
 
-	db, err := conn.Connect()
+	db, release, err := r.Pools.Get(ctx, conn)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer release()
 
 	// Query list of databases
-	dbList := make([]string, 0)
-	rows, err := db.Query(`SELECT datname FROM pg_database WHERE datname ~ '^sde_[0-9]+\.[0-9]+\.[0-9]+.*$';`)
+	run.phase("discover")
+	dbs, err := listDatabases(ctx, db)
 	if err != nil {
 		return err
 	}
 
-	var dbName string
-	for rows.Next() {
-		if err := rows.Scan(&dbName); err != nil {
+	// Adoption and drops are serialized with every other reconcile on the
+	// server; the rest of the run works on databases the Sde already owns, and
+	// the drops re-list them under the lock rather than trust this listing
+	if sde.Spec.AdoptUnowned {
+		pattern, err := adoptPattern(sde)
+		if err != nil {
+			return err
+		}
+		exec := newExecutor(db, sde, "adoption")
+		err = withServerLock(ctx, db, dbPrefix, func() error {
+			// Another reconcile may have claimed some since they were listed
+			if dbs, err = listDatabases(ctx, db); err != nil {
+				return err
+			}
+			return adoptUnowned(ctx, exec, pattern, dbs)
+		})
+		r.audit(ctx, run, exec)
+		if err != nil {
+			return err
+		}
+	}
+
+	dbList, unowned := partitionOwned(sde, dbs)
+	run.Inventory, run.Unowned = dbList, unowned
+	ctxlog.Info(fmt.Sprintf("Owned DBs: %v", dbList))
+	if len(unowned) > 0 {
+		ctxlog.Info(fmt.Sprintf("Ignoring DBs not owned by this Sde: %v", unowned))
+	}
+	if !equalStrings(sde.Status.UnownedDatabases, unowned) {
+		sde.Status.UnownedDatabases = unowned
+		if err = r.Status().Update(ctx, sde); err != nil {
 			return err
 		}
-		dbList = append(dbList, dbName)
 	}
 
-	ctxlog.Info(fmt.Sprintf("Current DBs: %v", dbList))
-	sort.Sort(DbVersions(dbList))
-	ctxlog.Info(fmt.Sprintf("Sorted DBs: %v", dbList))
+	run.phase("migrate")
+	if err = r.reconcileMigrations(ctx, sde, dbList); err != nil {
+		return err
+	}
 
-	count := len(dbList) - int(sde.Spec.DatabaseCount)
-	if count > 0 {
-		err = cleanupDB(db, dbList, count)
+	if sde.Spec.TargetVersion != "" && sde.Status.ProvisionedVersion != sde.Spec.TargetVersion {
+		run.phase("provision")
+		dbList, err = r.provisionDb(ctx, db, conn, sde, run, dbList, unowned)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	run.phase("plan")
+	objs, err := r.listSdeDatabases(ctx, sde)
+	if err != nil {
+		return err
+	}
+	dropped, err := r.dropConfirmed(ctx, db, conn, sde, run, objs, dbList)
+	if err != nil {
+		return err
+	}
+	dbList = withoutDbs(dbList, dropped)
+
+	info, err := databaseInfo(ctx, db, dbList)
+	if err != nil {
+		return err
+	}
+
+	// Databases still migrating or quarantined are neither counted nor dropped
+	owned := dbList
+	dbList = LiveDatabases(sde, dbList)
+	if err = r.reconcileActivity(ctx, db, sde, owned); err != nil {
+		return err
+	}
+	input := PlanInput{Sizes: dbSizes(info), Pinned: pinnedDbs(objs), Activity: sde.Status.Activity, Now: time.Now()}
+	if p := sde.Spec.Retention; p != nil && p.Lifecycle != nil {
+		if input.Releases, err = r.releases(ctx, p.Lifecycle); err != nil {
+			return err
+		}
+	}
+	plan, storage := buildPlan(sde, dbList, input)
+	sde.Status.Storage = storage
+
+	var previousHash string
+	if sde.Status.Plan != nil {
+		previousHash = sde.Status.Plan.Hash
+	}
+	sde.Status.Plan = plan.status(sde)
+	approved, err := r.checkApproval(ctx, sde)
+	if err != nil {
+		return err
+	}
+	run.PlanHash, run.Approved, run.Decisions = sde.Status.Plan.Hash, approved, plan.decisions(owned)
+	if err = r.Status().Update(ctx, sde); err != nil {
+		return err
+	}
+
+	if hash := sde.Status.Plan.Hash; hash != "" && hash != previousHash {
+		r.notify(sde, planPayload(sde))
+	}
+
+	candidates := plan.drops()
+	ctxlog.Info(fmt.Sprintf("Retention plan %s: %v", sde.Status.Plan.Hash, candidates))
+	if !approved {
+		ctxlog.Info("Waiting for the plan to be approved")
+		candidates = nil
+	}
+	var cleanupErr error
+	if len(candidates) > 0 {
+		run.phase("cleanup")
+		exec := newExecutor(db, sde, "retention")
+		exec.connect = r.versionConnector(conn)
+		var results []sdev1beta1.DatabaseResult
+		cleanupErr = withServerLock(ctx, db, dbPrefix, func() error {
+			kept, skipped, err := stillOwned(ctx, db, sde, candidates)
+			if err != nil {
+				return err
+			}
+			results, err = cleanupDB(ctx, exec, kept, failureBudget(sde))
+			results = append(results, skipped...)
+			return err
+		})
+		run.Results = results
+		r.audit(ctx, run, exec)
+		if statusErr := r.recordCleanup(ctx, sde, results); statusErr != nil {
+			ctxlog.Error(statusErr, "Failed to record cleanup results")
+			run.warn(statusErr)
+		}
+		r.notify(sde, runPayload(sde, results, info))
+		for _, res := range results {
+			if res.Outcome == sdev1beta1.DropDropped {
+				owned = withoutDbs(owned, []string{res.Name})
+			}
+		}
+		// An approval covers one run; what is left needs a new one
+		if err := r.removeApproval(ctx, sde); err != nil {
+			ctxlog.Error(err, "Failed to remove the plan approval")
+			run.warn(err)
+		}
+	}
+
+	run.phase("sync")
+	if err = r.syncDatabases(ctx, sde, objs, owned, dbList, info, plan); err != nil {
+		ctxlog.Error(err, "Failed to sync SdeDatabase inventory")
+		if cleanupErr == nil {
+			return err
+		}
+		run.warn(err)
+	}
+	return cleanupErr
 }
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDSN(t *testing.T) {
+	conn := PGConnector{Host: "db", Port: "5432", User: "admin", Password: `p@ss 'w\rd`, Dbname: "postgres"}
+	assert.Equal(t, `host='db' port='5432' user='admin' password='p@ss \'w\\rd' dbname='postgres' sslmode=disable`, conn.DSN())
+
+	conn.Sslmode = sslVerifyFull
+	conn.SslRootCert = "-----BEGIN CERTIFICATE-----"
+	assert.Contains(t, conn.DSN(), `sslmode=verify-full sslinline=true sslrootcert='-----BEGIN CERTIFICATE-----'`)
+}
+
+func TestDSNTimeouts(t *testing.T) {
+	conn := PGConnector{Host: "db", Port: "5432", ConnectTimeout: 10 * time.Second, StatementTimeout: time.Minute, LockTimeout: 5 * time.Second}
+	assert.Contains(t, conn.DSN(), "connect_timeout=10 statement_timeout=60000 lock_timeout=5000")
+}
+
+func TestEvictIdle(t *testing.T) {
+	pools := NewServerPools(PoolOptions{})
+	stale, _ := sql.Open("postgres", "host=stale")
+	fresh, _ := sql.Open("postgres", "host=fresh")
+	pools.pools["stale"] = &serverPool{db: stale, lastUsed: time.Now().Add(-time.Hour)}
+	pools.pools["fresh"] = &serverPool{db: fresh, lastUsed: time.Now()}
+
+	assert.Equal(t, 1, pools.evictIdle(time.Now().Add(-time.Minute)))
+	assert.Contains(t, pools.pools, "fresh")
+	assert.NotContains(t, pools.pools, "stale")
+}
+
+func TestPoolLeases(t *testing.T) {
+	pools := NewServerPools(PoolOptions{})
+	slow := make(chan struct{})
+	pools.connect = func(ctx context.Context, conn PGConnector) (*sql.DB, error) {
+		if conn.Host == "slow" {
+			<-slow
+		}
+		return sql.Open("postgres", "host="+conn.Host)
+	}
+	ctx := context.Background()
+
+	// A server that is slow to connect does not hold up the others
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, release, err := pools.Get(ctx, PGConnector{Host: "slow"})
+		assert.NoError(t, err)
+		release()
+	}()
+	db, release, err := pools.Get(ctx, PGConnector{Host: "fast"})
+	assert.NoError(t, err)
+	again, releaseAgain, err := pools.Get(ctx, PGConnector{Host: "fast"})
+	assert.NoError(t, err)
+	assert.Same(t, db, again)
+	close(slow)
+	<-done
+
+	// Leased pools are never evicted, however long the lease
+	assert.Equal(t, 1, pools.evictIdle(time.Now().Add(time.Hour)))
+	release()
+	release()
+	assert.Equal(t, 0, pools.evictIdle(time.Now().Add(time.Hour)))
+	releaseAgain()
+	assert.Equal(t, 1, pools.evictIdle(time.Now().Add(time.Hour)))
+	assert.Empty(t, pools.pools)
+}
+
+func TestVersionConnectionsAreNotPooled(t *testing.T) {
+	db, _ := openFakeDB(t)
+	pools := NewServerPools(PoolOptions{MaxOpenConns: 4})
+	pools.connect = func(context.Context, PGConnector) (*sql.DB, error) { return db, nil }
+	r := &SdeReconciler{Pools: pools}
+	ctx := context.Background()
+
+	target, release, err := r.versionConnector(PGConnector{Host: "db"})(ctx, "sde_5.0.0")
+	assert.NoError(t, err)
+	assert.NoError(t, target.PingContext(ctx))
+	assert.Equal(t, 1, target.Stats().OpenConnections)
+	release()
+
+	// Nothing keeps a session in the database about to be dropped
+	assert.Empty(t, pools.pools)
+	assert.Equal(t, 0, target.Stats().OpenConnections)
+	assert.Error(t, target.PingContext(ctx))
+}
@@ -0,0 +1,204 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const dbPrefix = "sde_"
+
+// versionDbName returns the database name used for an SDE version
+func versionDbName(version string) string {
+	return dbPrefix + version
+}
+
+func containsDb(dbList []string, name string) bool {
+	for _, n := range dbList {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// templateFor picks the database the new version name is copied from: the
+// configured golden template, or else the newest database of an older
+// version whose migration succeeded. Newer, migrating and quarantined
+// databases are never copied; without an older one it is template0.
+func templateFor(sde *sdev1beta1.Sde, name string, sortedDbs []string) string {
+	if p := sde.Spec.Provisioning; p != nil && p.TemplateDatabase != "" {
+		return p.TemplateDatabase
+	}
+	scheme, policy := versioning(sde)
+	order := versionOrder{scheme: scheme, unparsable: policy}
+	for i := len(sortedDbs) - 1; i >= 0; i-- {
+		candidate := sortedDbs[i]
+		if order.compare(candidate, name) >= 0 {
+			continue
+		}
+		if state := findDbState(sde, candidate); state != nil && state.Phase != sdev1beta1.DatabaseReady {
+			continue
+		}
+		return candidate
+	}
+	return "template0"
+}
+
+func (r *SdeReconciler) setCondition(ctx context.Context, sde *sdev1beta1.Sde, condType string, status metav1.ConditionStatus, reason, message string) error {
+	meta.SetStatusCondition(&sde.Status.Conditions, metav1.Condition{
+		Type:               condType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: sde.Generation,
+	})
+	return r.Status().Update(ctx, sde)
+}
+
+// provisionDb creates the database for sde.Spec.TargetVersion when it does not
+// exist yet and returns the sorted database list including it. A database of
+// that name owned by someone else is reported as a conflict.
+func (r *SdeReconciler) provisionDb(ctx context.Context, db *sql.DB, conn PGConnector, sde *sdev1beta1.Sde, run *runReport, dbList, unowned []string) ([]string, error) {
+	logger := log.FromContext(ctx)
+	name := versionDbName(sde.Spec.TargetVersion)
+	exec := newExecutor(db, sde, "provisioning")
+	defer r.audit(ctx, run, exec)
+
+	if containsDb(unowned, name) {
+		return dbList, r.provisionFailed(ctx, sde, configErrorf("database %s exists but is not owned by this Sde", name))
+	}
+
+	if containsDb(dbList, name) {
+		// A previous run may have created it and then failed, so the
+		// extensions are made sure of again; a migration that failed to start
+		// left the database Migrating, and reconcileMigrations quarantines it
+		logger.Info(fmt.Sprintf("Database %s already exists", name))
+		if err := r.createExtensions(ctx, exec, conn, name, provisioningExtensions(sde)); err != nil {
+			return dbList, r.provisionFailed(ctx, sde, err)
+		}
+		sde.Status.ProvisionedVersion = sde.Spec.TargetVersion
+		return dbList, r.setCondition(ctx, sde, sdev1beta1.ConditionProvisioned, metav1.ConditionTrue,
+			sdev1beta1.ReasonDatabaseCreated, fmt.Sprintf("Database %s exists", name))
+	}
+
+	template := templateFor(sde, name, dbList)
+
+	// The migration Job logs in as the Sde's job role, which therefore owns
+	// the database unless another owner is configured
+	jobConn, err := ensureJobRole(ctx, r.Client, r.Scheme, exec, conn)
+	if err != nil {
+		return dbList, r.provisionFailed(ctx, sde, err)
+	}
+	owner := jobConn.User
+	encoding := "UTF8"
+	if p := sde.Spec.Provisioning; p != nil {
+		if p.Owner != "" {
+			owner = p.Owner
+		}
+		if p.Encoding != "" {
+			encoding = p.Encoding
+		}
+	}
+
+	// The database is Migrating from the moment it exists, so a failure to
+	// start the migration can never leave it live
+	if sde.Spec.Migration != nil {
+		setDbState(sde, sdev1beta1.DatabaseState{
+			Name:  name,
+			Phase: sdev1beta1.DatabaseMigrating,
+			Job:   migrationJobName(sde, name),
+		})
+	}
+	err = r.setCondition(ctx, sde, sdev1beta1.ConditionProvisioning, metav1.ConditionTrue,
+		sdev1beta1.ReasonCreatingDatabase, fmt.Sprintf("Creating %s from %s", name, template))
+	if err != nil {
+		return dbList, err
+	}
+
+	logger.Info(fmt.Sprintf("Creating database %s from template %s", name, template))
+	err = exec.exec(ctx, fmt.Sprintf("CREATE DATABASE %s WITH TEMPLATE %s OWNER %s ENCODING %s",
+		pq.QuoteIdentifier(name), pq.QuoteIdentifier(template), pq.QuoteIdentifier(owner), pq.QuoteLiteral(encoding)))
+	if err != nil {
+		return dbList, r.provisionFailed(ctx, sde, err)
+	}
+
+	if err = exec.claimDatabase(ctx, name); err != nil {
+		return dbList, r.provisionFailed(ctx, sde, err)
+	}
+
+	if err = r.createExtensions(ctx, exec, conn, name, provisioningExtensions(sde)); err != nil {
+		return dbList, r.provisionFailed(ctx, sde, err)
+	}
+
+	message := fmt.Sprintf("Created %s from %s", name, template)
+	if sde.Spec.Migration != nil {
+		if err = r.startMigration(ctx, sde, name, jobConn); err != nil {
+			return dbList, r.provisionFailed(ctx, sde, err)
+		}
+		message += ", migration started"
+	}
+
+	dbList = append(dbList, name)
+	sortDbs(sde, dbList)
+
+	sde.Status.ProvisionedVersion = sde.Spec.TargetVersion
+	meta.SetStatusCondition(&sde.Status.Conditions, metav1.Condition{
+		Type:               sdev1beta1.ConditionProvisioning,
+		Status:             metav1.ConditionFalse,
+		Reason:             sdev1beta1.ReasonDatabaseCreated,
+		ObservedGeneration: sde.Generation,
+	})
+	return dbList, r.setCondition(ctx, sde, sdev1beta1.ConditionProvisioned, metav1.ConditionTrue,
+		sdev1beta1.ReasonDatabaseCreated, message)
+}
+
+func provisioningExtensions(sde *sdev1beta1.Sde) []string {
+	if p := sde.Spec.Provisioning; p != nil {
+		return p.Extensions
+	}
+	return nil
+}
+
+func (r *SdeReconciler) provisionFailed(ctx context.Context, sde *sdev1beta1.Sde, cause error) error {
+	meta.SetStatusCondition(&sde.Status.Conditions, metav1.Condition{
+		Type:               sdev1beta1.ConditionProvisioning,
+		Status:             metav1.ConditionFalse,
+		Reason:             sdev1beta1.ReasonProvisioningError,
+		ObservedGeneration: sde.Generation,
+	})
+	err := r.setCondition(ctx, sde, sdev1beta1.ConditionProvisioned, metav1.ConditionFalse,
+		sdev1beta1.ReasonProvisioningError, cause.Error())
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update status")
+	}
+	return cause
+}
+
+// createExtensions connects to the new database and creates the required extensions
+func (r *SdeReconciler) createExtensions(ctx context.Context, exec *sqlExecutor, conn PGConnector, dbName string, extensions []string) error {
+	if len(extensions) == 0 {
+		return nil
+	}
+
+	conn.Dbname = dbName
+	db, release, err := r.Pools.Open(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for _, ext := range extensions {
+		err = exec.execIn(ctx, db, dbName, fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", pq.QuoteIdentifier(ext)))
+		if err != nil {
+			return fmt.Errorf("creating extension %s in %s: %w", ext, dbName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestTemplateFor(t *testing.T) {
+	sde := &sdev1beta1.Sde{}
+
+	assert.Equal(t, "template0", templateFor(sde, "sde_5.4.0", []string{}))
+	assert.Equal(t, "sde_5.3.4", templateFor(sde, "sde_5.4.0", []string{"sde_5.2.1", "sde_5.3.4"}))
+
+	// Newer, migrating and quarantined databases are never copied
+	sde.Status.Databases = []sdev1beta1.DatabaseState{
+		{Name: "sde_5.3.4", Phase: sdev1beta1.DatabaseQuarantined},
+		{Name: "sde_5.3.5", Phase: sdev1beta1.DatabaseMigrating},
+	}
+	assert.Equal(t, "sde_5.2.1", templateFor(sde, "sde_5.4.0", []string{"sde_5.2.1", "sde_5.3.4", "sde_5.3.5", "sde_6.0.0"}))
+	assert.Equal(t, "template0", templateFor(sde, "sde_5.0.0", []string{"sde_5.2.1", "sde_6.0.0"}))
+
+	sde.Spec.Provisioning = &sdev1beta1.ProvisioningSpec{TemplateDatabase: "sde_golden"}
+	assert.Equal(t, "sde_golden", templateFor(sde, "sde_5.4.0", []string{"sde_5.2.1", "sde_5.3.4"}))
+}
+
+func TestProvisionRecordsMigratingFirst(t *testing.T) {
+	// Without the batch types the migration Job cannot be created
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"}}
+	sde.Spec.TargetVersion = "5.4.0"
+	sde.Spec.Migration = &corev1.PodTemplateSpec{}
+	sde.Spec.Provisioning = &sdev1beta1.ProvisioningSpec{Extensions: []string{"postgis"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde).Build()
+	db, d := openFakeDB(t)
+	pools := NewServerPools(PoolOptions{})
+	pools.connect = func(context.Context, PGConnector) (*sql.DB, error) { return db, nil }
+	r := &SdeReconciler{Client: c, Scheme: scheme, Pools: pools}
+	ctx := context.Background()
+
+	run := &runReport{}
+	_, err := r.provisionDb(ctx, db, PGConnector{User: "admin"}, sde, run, []string{"sde_5.3.4"}, nil)
+	assert.Error(t, err)
+	role := jobRoleName(sde)
+
+	// Every statement shows up in the run report, the role's password masked
+	var statements []string
+	for _, rec := range run.Statements {
+		assert.Equal(t, "provisioning", rec.Trigger)
+		statements = append(statements, rec.Statement)
+	}
+	assert.Equal(t, []string{
+		fmt.Sprintf(`CREATE ROLE "%s" LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE PASSWORD '********'`, role),
+		fmt.Sprintf(`GRANT "%s" TO CURRENT_USER`, role),
+		fmt.Sprintf(`CREATE DATABASE "sde_5.4.0" WITH TEMPLATE "sde_5.3.4" OWNER "%s" ENCODING 'UTF8'`, role),
+		`COMMENT ON DATABASE "sde_5.4.0" IS 'sde.domain/owner=ns/sde'`,
+		`CREATE EXTENSION IF NOT EXISTS "postgis"`,
+	}, statements)
+	assert.Equal(t, "sde_5.4.0", run.Statements[4].Database)
+	assert.Contains(t, d.executed, statements[2])
+
+	// The migration connects as the Sde's job role, never as the admin
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: connectionSecretName(sde), Namespace: "ns"}, secret))
+	assert.Equal(t, role, string(secret.Data["DATABASE_USER"]))
+
+	// The created database stays out of retention until its migration is sorted out
+	stored := &sdev1beta1.Sde{}
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "sde", Namespace: "ns"}, stored))
+	if state := findDbState(stored, "sde_5.4.0"); assert.NotNil(t, state) {
+		assert.Equal(t, sdev1beta1.DatabaseMigrating, state.Phase)
+	}
+	assert.Empty(t, LiveDatabases(stored, []string{"sde_5.4.0"}))
+	assert.Empty(t, stored.Status.ProvisionedVersion)
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// ReadinessPolicy decides how unreachable database servers affect readiness
+type ReadinessPolicy string
+
+const (
+	// ReadyWhenAllReachable fails readiness when any server is unreachable
+	ReadyWhenAllReachable ReadinessPolicy = "all"
+	// ReadyWhenAnyReachable fails readiness only when every server is
+	ReadyWhenAnyReachable ReadinessPolicy = "any"
+	// ReadyIgnoringDatabases keeps checking servers but never fails readiness
+	ReadyIgnoringDatabases ReadinessPolicy = "none"
+)
+
+// ReadinessOptions configures the databases readiness check
+type ReadinessOptions struct {
+	Policy ReadinessPolicy
+	// Interval is how often servers are pinged in the background
+	Interval time.Duration
+	// Timeout bounds a single ping
+	Timeout time.Duration
+}
+
+// DatabaseReadiness pings every database server the Sdes use and serves the
+// cached outcome as a readyz check, so probes never wait on a database. Its
+// error names each server and why it failed; controller-runtime shows it at
+// /readyz/databases. Readiness only takes the pod out of Service endpoints,
+// so a bad server never gets the manager restarted.
+type DatabaseReadiness struct {
+	client client.Client
+	opts   ReadinessOptions
+	ping   func(ctx context.Context, conn PGConnector) error
+
+	mu      sync.Mutex
+	servers []serverReachability
+	checked time.Time
+}
+
+// serverReachability is the outcome of pinging one server. Sdes sharing a
+// connection share an entry.
+type serverReachability struct {
+	name string
+	err  error
+}
+
+func NewDatabaseReadiness(c client.Client, opts ReadinessOptions) *DatabaseReadiness {
+	if opts.Policy == "" {
+		opts.Policy = ReadyWhenAllReachable
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &DatabaseReadiness{
+		client: c,
+		opts:   opts,
+		// Each ping opens its own connection, so a probe neither waits on
+		// nor takes a connection from the pools the reconcilers share
+		ping: func(ctx context.Context, conn PGConnector) error {
+			conn.ConnectTimeout = opts.Timeout
+			db, err := conn.Connect(ctx)
+			if err != nil {
+				return err
+			}
+			return db.Close()
+		},
+	}
+}
+
+func (d *DatabaseReadiness) NeedLeaderElection() bool {
+	return false
+}
+
+func (d *DatabaseReadiness) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+	for {
+		d.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// targets returns the connections in use: every SdeDatabaseServer, and the
+// namespace connection of each namespace with an Sde that has no server.
+// Connections that cannot be built are reported with the error.
+func (d *DatabaseReadiness) targets(ctx context.Context) (map[string]PGConnector, map[string]error, error) {
+	conns := map[string]PGConnector{}
+	failed := map[string]error{}
+
+	servers := &sdev1beta1.SdeDatabaseServerList{}
+	if err := d.client.List(ctx, servers); err != nil {
+		return nil, nil, err
+	}
+	for i := range servers.Items {
+		server := &servers.Items[i]
+		if conn, err := serverConnector(ctx, d.client, server); err != nil {
+			failed[server.Name] = err
+		} else {
+			conns[server.Name] = conn
+		}
+	}
+
+	sdes := &sdev1beta1.SdeList{}
+	if err := d.client.List(ctx, sdes); err != nil {
+		return nil, nil, err
+	}
+	for _, sde := range sdes.Items {
+		name := "namespace/" + sde.Namespace
+		if sde.Spec.DatabaseServer != "" || conns[name] != (PGConnector{}) || failed[name] != nil {
+			continue
+		}
+		if conn, err := namespaceConnector(ctx, d.client, sde.Namespace); err != nil {
+			failed[name] = err
+		} else {
+			conns[name] = conn
+		}
+	}
+	return conns, failed, nil
+}
+
+// refresh pings every target in parallel and replaces the cached results
+func (d *DatabaseReadiness) refresh(ctx context.Context) {
+	conns, failed, err := d.targets(ctx)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list database servers for readiness")
+		return
+	}
+
+	results := make(chan serverReachability, len(conns))
+	for name, conn := range conns {
+		go func(name string, conn PGConnector) {
+			pingCtx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+			defer cancel()
+			results <- serverReachability{name: name, err: d.ping(pingCtx, conn)}
+		}(name, conn)
+	}
+
+	servers := make([]serverReachability, 0, len(conns)+len(failed))
+	for name, err := range failed {
+		servers = append(servers, serverReachability{name: name, err: err})
+	}
+	for range conns {
+		servers = append(servers, <-results)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].name < servers[j].name })
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers, d.checked = servers, time.Now()
+}
+
+// Check is the healthz.Checker. It fails until the first refresh, when the
+// cached results are older than three intervals, or as the policy says.
+func (d *DatabaseReadiness) Check(_ *http.Request) error {
+	d.mu.Lock()
+	servers, checked := d.servers, d.checked
+	d.mu.Unlock()
+
+	if d.opts.Policy == ReadyIgnoringDatabases {
+		return nil
+	}
+	if checked.IsZero() {
+		return fmt.Errorf("database servers not checked yet")
+	}
+	if age := time.Since(checked); age > 3*d.opts.Interval {
+		return fmt.Errorf("database servers last checked %s ago", age.Round(time.Second))
+	}
+
+	var reachable, unreachable []string
+	for _, s := range servers {
+		if s.err == nil {
+			reachable = append(reachable, s.name)
+		} else {
+			unreachable = append(unreachable, fmt.Sprintf("%s: %v", s.name, s.err))
+		}
+	}
+	if len(unreachable) == 0 || (d.opts.Policy == ReadyWhenAnyReachable && len(reachable) > 0) {
+		return nil
+	}
+	return fmt.Errorf("%d of %d database servers unreachable (policy %s); unreachable: %s; reachable: [%s]",
+		len(unreachable), len(servers), d.opts.Policy, strings.Join(unreachable, "; "), strings.Join(reachable, ", "))
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestDatabaseReadiness(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	server := func(name string) *sdev1beta1.SdeDatabaseServer {
+		return &sdev1beta1.SdeDatabaseServer{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: sdev1beta1.SdeDatabaseServerSpec{
+				Host:              name + ".example",
+				CredentialsSecret: sdev1beta1.SecretKeyReference{Name: "creds", Namespace: "ops"},
+			},
+		}
+	}
+	creds := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "ops"}}
+	// An Sde without a server whose namespace has no connection config
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(server("good"), server("bad"), creds, sde).Build()
+
+	readiness := NewDatabaseReadiness(c, ReadinessOptions{Interval: time.Minute})
+	readiness.ping = func(_ context.Context, conn PGConnector) error {
+		if conn.Host == "bad.example" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	assert.EqualError(t, readiness.Check(nil), "database servers not checked yet")
+
+	readiness.refresh(context.Background())
+	err := readiness.Check(nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "2 of 3 database servers unreachable (policy all)")
+		assert.Contains(t, err.Error(), "bad: connection refused")
+		assert.Contains(t, err.Error(), `namespace/ns: configmaps "ns-db-configmap" not found`)
+		assert.Contains(t, err.Error(), "reachable: [good]")
+	}
+
+	readiness.opts.Policy = ReadyWhenAnyReachable
+	assert.NoError(t, readiness.Check(nil))
+
+	readiness.checked = time.Now().Add(-4 * time.Minute)
+	assert.EqualError(t, readiness.Check(nil), "database servers last checked 4m0s ago")
+
+	readiness.opts.Policy = ReadyIgnoringDatabases
+	assert.NoError(t, readiness.Check(nil))
+
+	// With every server down only "none" stays ready
+	readiness.ping = func(context.Context, PGConnector) error { return errors.New("timeout") }
+	readiness.refresh(context.Background())
+	assert.NoError(t, readiness.Check(nil))
+	readiness.opts.Policy = ReadyWhenAnyReachable
+	assert.Error(t, readiness.Check(nil))
+}
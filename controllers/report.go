@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// Triggers a run report attributes a reconcile to
+const (
+	triggerInitial = "initial"
+	triggerSpec    = "spec"
+	triggerRunNow  = "run-now"
+	triggerRetry   = "retry"
+	triggerResync  = "resync"
+)
+
+// maxRunReports bounds the run history; the oldest reports rotate out. They
+// also rotate out early to keep the ConfigMap well below its 1MiB limit.
+const (
+	maxRunReports = 20
+	maxRunBytes   = 768 << 10
+)
+
+// runReport is what one reconcileDb run saw, decided and did, kept so a past
+// run can be reconstructed without the controller logs
+type runReport struct {
+	ID      string `json:"id"`
+	Trigger string `json:"trigger"`
+	// Generation and RunNow are the inputs the next run compares against to
+	// find its trigger
+	Generation int64      `json:"generation"`
+	RunNow     string     `json:"runNow,omitempty"`
+	Started    time.Time  `json:"started"`
+	Finished   time.Time  `json:"finished"`
+	DurationMs int64      `json:"durationMs"`
+	Phases     []runPhase `json:"phases,omitempty"`
+
+	Inventory []string          `json:"inventory,omitempty"`
+	Unowned   []string          `json:"unowned,omitempty"`
+	PlanHash  string            `json:"planHash,omitempty"`
+	Approved  bool              `json:"approved"`
+	Decisions []PlannedDatabase `json:"decisions,omitempty"`
+
+	Statements []auditRecord               `json:"statements,omitempty"`
+	Results    []sdev1beta1.DatabaseResult `json:"results,omitempty"`
+
+	// Error is what failed the run; Warnings are failures it carried on past
+	Error      string   `json:"error,omitempty"`
+	ErrorClass string   `json:"errorClass,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+
+	previous *runReport
+}
+
+// runPhase is how long one step of a run took
+type runPhase struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"durationMs"`
+
+	started time.Time
+}
+
+func runsConfigMapName(sde *sdev1beta1.Sde) string {
+	return sde.Name + "-runs"
+}
+
+// startRun begins the report of a run, attributing it by comparing the Sde
+// with the previous report
+func (r *SdeReconciler) startRun(ctx context.Context, sde *sdev1beta1.Sde) *runReport {
+	now := time.Now().UTC()
+	run := &runReport{
+		ID:         now.Format("20060102-150405") + "-" + rand.String(5),
+		Generation: sde.Generation,
+		RunNow:     sde.Annotations[sdev1beta1.RunNowAnnotation],
+		Started:    now,
+	}
+
+	configmap := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: runsConfigMapName(sde), Namespace: sde.Namespace}, configmap)
+	if err != nil && !errors.IsNotFound(err) {
+		log.FromContext(ctx).Error(err, "Failed to read previous run reports")
+	}
+	reports, err := readRunReports(configmap)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to read previous run reports")
+	}
+	run.Trigger = triggerInitial
+	if len(reports) > 0 {
+		run.previous = &reports[len(reports)-1]
+		run.Trigger = runTrigger(run.previous, run)
+	}
+	return run
+}
+
+func runTrigger(previous, run *runReport) string {
+	switch {
+	case previous.Generation != run.Generation:
+		return triggerSpec
+	case previous.RunNow != run.RunNow:
+		return triggerRunNow
+	case previous.Error != "":
+		return triggerRetry
+	}
+	return triggerResync
+}
+
+// phase ends the current phase, if any, and starts the named one
+func (run *runReport) phase(name string) {
+	now := time.Now()
+	run.endPhase(now)
+	run.Phases = append(run.Phases, runPhase{Name: name, started: now})
+}
+
+func (run *runReport) endPhase(now time.Time) {
+	if n := len(run.Phases); n > 0 && !run.Phases[n-1].started.IsZero() {
+		last := &run.Phases[n-1]
+		last.DurationMs = now.Sub(last.started).Milliseconds()
+		last.started = time.Time{}
+	}
+}
+
+func (run *runReport) warn(err error) {
+	run.Warnings = append(run.Warnings, err.Error())
+}
+
+// audit lists the executor's statements in the run's report and appends
+// them to the Sde's audit
+func (r *SdeReconciler) audit(ctx context.Context, run *runReport, exec *sqlExecutor) {
+	run.Statements = append(run.Statements, exec.records...)
+	if err := writeAudit(ctx, r.Client, r.Scheme, exec); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to write SQL audit records")
+		run.warn(err)
+	}
+}
+
+// idle tells whether a resync found nothing to do and nothing changed since
+// the previous report. Such runs are not kept, so the periodic resyncs do not
+// rotate out the runs that did something.
+func (run *runReport) idle() bool {
+	return run.Trigger == triggerResync && run.previous != nil &&
+		run.Error == "" && len(run.Warnings) == 0 && len(run.Statements) == 0 && len(run.Results) == 0 &&
+		run.PlanHash == run.previous.PlanHash && equalStrings(run.Inventory, run.previous.Inventory)
+}
+
+// finishRun completes the report with the run's outcome and appends it to the
+// Sde's run history, unless it was an idle resync. The statements are those
+// the run's executors recorded.
+func (r *SdeReconciler) finishRun(ctx context.Context, sde *sdev1beta1.Sde, run *runReport, runErr error) {
+	ctxlog := log.FromContext(ctx)
+	now := time.Now()
+	run.endPhase(now)
+	run.Finished = now.UTC()
+	run.DurationMs = run.Finished.Sub(run.Started).Milliseconds()
+	if runErr != nil {
+		run.Error = runErr.Error()
+		run.ErrorClass = string(classifyError(runErr))
+	}
+	if run.idle() {
+		return
+	}
+
+	line, err := json.Marshal(run)
+	if err == nil {
+		err = appendLines(ctx, r.Client, r.Scheme, sde, runsConfigMapName(sde), "runs.jsonl", []string{string(line)}, maxRunReports, maxRunBytes)
+	}
+	if err != nil {
+		ctxlog.Error(err, "Failed to write the run report", "run", run.ID)
+	}
+}
+
+// readRunReports returns the run reports stored for an Sde, oldest first
+func readRunReports(configmap *corev1.ConfigMap) ([]runReport, error) {
+	var reports []runReport
+	for _, line := range strings.Split(configmap.Data["runs.jsonl"], "\n") {
+		if line == "" {
+			continue
+		}
+		var run runReport
+		if err := json.Unmarshal([]byte(line), &run); err != nil {
+			return nil, fmt.Errorf("parsing run report: %w", err)
+		}
+		reports = append(reports, run)
+	}
+	return reports, nil
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestRunTrigger(t *testing.T) {
+	previous := &runReport{Generation: 2, RunNow: "a"}
+	assert.Equal(t, triggerSpec, runTrigger(previous, &runReport{Generation: 3, RunNow: "a"}))
+	assert.Equal(t, triggerRunNow, runTrigger(previous, &runReport{Generation: 2, RunNow: "b"}))
+	assert.Equal(t, triggerResync, runTrigger(previous, &runReport{Generation: 2, RunNow: "a"}))
+	previous.Error = "connection refused"
+	assert.Equal(t, triggerRetry, runTrigger(previous, &runReport{Generation: 2, RunNow: "a"}))
+}
+
+func TestRunReports(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns", UID: "uid", Generation: 1}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde).Build()
+	r := &SdeReconciler{Client: c, Scheme: scheme}
+	ctx := context.Background()
+	key := types.NamespacedName{Name: "sde-runs", Namespace: "ns"}
+
+	run := r.startRun(ctx, sde)
+	assert.Equal(t, triggerInitial, run.Trigger)
+	run.phase("discover")
+	run.Inventory = []string{"sde_5.0.0", "sde_5.1.0"}
+	run.phase("cleanup")
+	// Statements another reconcile audited meanwhile do not belong to the run
+	other := newExecutor(nil, sde, "SdeDatabase sde-4.0.0 deleted")
+	other.records = []auditRecord{{Time: time.Now().UTC(), Statement: `DROP DATABASE "sde_4.0.0"`}}
+	assert.NoError(t, writeAudit(ctx, c, scheme, other))
+	run.Statements = append(run.Statements, auditRecord{Time: time.Now().UTC(), Statement: `DROP DATABASE "sde_5.0.0"`})
+	r.finishRun(ctx, sde, run, errors.New("connection refused"))
+
+	configmap := &corev1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, key, configmap))
+	assert.Equal(t, "sde", configmap.OwnerReferences[0].Name)
+	reports, err := readRunReports(configmap)
+	assert.NoError(t, err)
+	if assert.Len(t, reports, 1) {
+		report := reports[0]
+		assert.Equal(t, run.ID, report.ID)
+		assert.Equal(t, []string{"sde_5.0.0", "sde_5.1.0"}, report.Inventory)
+		assert.Equal(t, "connection refused", report.Error)
+		if assert.Len(t, report.Statements, 1) {
+			assert.Equal(t, `DROP DATABASE "sde_5.0.0"`, report.Statements[0].Statement)
+		}
+		if assert.Len(t, report.Phases, 2) {
+			assert.Equal(t, "discover", report.Phases[0].Name)
+			assert.Equal(t, "cleanup", report.Phases[1].Name)
+		}
+	}
+
+	retry := r.startRun(ctx, sde)
+	assert.Equal(t, triggerRetry, retry.Trigger)
+	r.finishRun(ctx, sde, retry, nil)
+
+	// Resyncs that find nothing to do are not kept
+	for i := 0; i < maxRunReports+2; i++ {
+		r.finishRun(ctx, sde, r.startRun(ctx, sde), nil)
+	}
+	assert.NoError(t, c.Get(ctx, key, configmap))
+	reports, err = readRunReports(configmap)
+	assert.NoError(t, err)
+	assert.Len(t, reports, 2)
+
+	// The history keeps the newest maxRunReports
+	for i := 0; i < maxRunReports+2; i++ {
+		run := r.startRun(ctx, sde)
+		run.Inventory = []string{fmt.Sprintf("sde_5.%d.0", i)}
+		r.finishRun(ctx, sde, run, nil)
+	}
+	assert.NoError(t, c.Get(ctx, key, configmap))
+	reports, err = readRunReports(configmap)
+	assert.NoError(t, err)
+	assert.Len(t, reports, maxRunReports)
+	assert.Equal(t, triggerResync, reports[len(reports)-1].Trigger)
+}
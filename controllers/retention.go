@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+const defaultMinCount = 1
+
+// sizeBudget returns the configured disk budget in bytes and the minimum
+// number of databases it keeps, or ok=false when no budget is set.
+func sizeBudget(sde *sdev1beta1.Sde) (maxBytes int64, minCount int, ok bool) {
+	p := sde.Spec.Retention
+	if p == nil || p.MaxTotalSize == nil {
+		return 0, 0, false
+	}
+	minCount = defaultMinCount
+	if p.MinCount != nil {
+		minCount = int(*p.MinCount)
+	}
+	return p.MaxTotalSize.Value(), minCount, true
+}
+
+// dbInfo is what the server reports about one database
+type dbInfo struct {
+	oid   int64
+	owner string
+	size  int64
+}
+
+// databaseInfo reads the OID, owner and pg_database_size of each database in dbList
+func databaseInfo(ctx context.Context, db *sql.DB, dbList []string) (map[string]dbInfo, error) {
+	rows, err := db.QueryContext(ctx, `SELECT datname, oid::bigint, pg_get_userbyid(datdba), pg_database_size(datname)
+		FROM pg_database WHERE datname = ANY($1)`, pq.Array(dbList))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	info := make(map[string]dbInfo, len(dbList))
+	for rows.Next() {
+		var name string
+		var i dbInfo
+		if err := rows.Scan(&name, &i.oid, &i.owner, &i.size); err != nil {
+			return nil, err
+		}
+		info[name] = i
+	}
+	return info, rows.Err()
+}
+
+// planSizeBudget adds drops to the plan until the owned databases fit the
+// size budget and reports the storage used, or nil without a budget.
+func planSizeBudget(sde *sdev1beta1.Sde, sizes map[string]int64, plan *retentionPlan, now time.Time) *sdev1beta1.StorageStatus {
+	maxBytes, minCount, ok := sizeBudget(sde)
+	if !ok {
+		return nil
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+
+	reclaim := plan.planSize(sizes, total, maxBytes, minCount)
+	return &sdev1beta1.StorageStatus{
+		TotalBytes:            total,
+		MaxTotalBytes:         maxBytes,
+		ProjectedReclaimBytes: reclaim,
+		MeasureTime:           metav1.NewTime(now),
+	}
+}
+
+// dbSizes picks the sizes out of databaseInfo
+func dbSizes(info map[string]dbInfo) map[string]int64 {
+	sizes := make(map[string]int64, len(info))
+	for name, i := range info {
+		sizes[name] = i.size
+	}
+	return sizes
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestSizeRetention(t *testing.T) {
+	live := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.1", "sde_5.3.4"}
+	sizes := map[string]int64{"sde_5.0.0": 100, "sde_5.1.0": 200, "sde_5.2.1": 300, "sde_5.3.4": 400}
+
+	// Under budget: the count from DatabaseCount is kept as is
+	plan := newRetentionPlan(live)
+	plan.planCount(live, 3)
+	reclaim := plan.planSize(sizes, 1000, 2000, 1)
+	assert.Equal(t, []string{"sde_5.0.0"}, plan.drops())
+	assert.Equal(t, int64(100), reclaim)
+
+	// Over budget: drop oldest until the rest fits
+	plan = newRetentionPlan(live)
+	plan.planCount(live, 6)
+	reclaim = plan.planSize(sizes, 1000, 700, 1)
+	assert.Equal(t, []string{"sde_5.0.0", "sde_5.1.0"}, plan.drops())
+	assert.Equal(t, int64(300), reclaim)
+	assert.Equal(t, reasonSizeBudget, plan.status(&sdev1beta1.Sde{}).Drop[0].Reason)
+
+	// The minimum count wins over the budget
+	plan = newRetentionPlan(live)
+	reclaim = plan.planSize(sizes, 1000, 100, 2)
+	assert.Equal(t, []string{"sde_5.0.0", "sde_5.1.0"}, plan.drops())
+	assert.Equal(t, int64(300), reclaim)
+}
+
+func TestSizeRetentionPassesOverKeptDatabases(t *testing.T) {
+	live := []string{"sde_5.0.0", "sde_5.1.0", "sde_5.2.0", "sde_5.3.0"}
+	sizes := map[string]int64{"sde_5.0.0": 5000, "sde_5.1.0": 2000, "sde_5.2.0": 2000, "sde_5.3.0": 1000}
+
+	// A supported release and a pinned database neither count as reclaimed
+	// nor stop the budget from selecting the databases after them
+	plan := newRetentionPlan(live)
+	plan.protected["sde_5.0.0"] = true
+	plan.pin([]string{"sde_5.1.0"})
+	reclaim := plan.planSize(sizes, 10000, 8000, 1)
+	assert.Equal(t, []string{"sde_5.2.0"}, plan.drops())
+	assert.Equal(t, int64(2000), reclaim)
+
+	// Without anything left to select the budget stays unmet
+	plan = newRetentionPlan(live[:2])
+	plan.protected["sde_5.0.0"] = true
+	plan.pin([]string{"sde_5.1.0"})
+	assert.Equal(t, int64(0), plan.planSize(sizes, 7000, 3000, 0))
+	assert.Empty(t, plan.drops())
+}
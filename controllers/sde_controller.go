@@ -19,12 +19,29 @@ package controllers
 import (
 	"context"
 	_ "embed"
+	"strconv"
+	"strings"
+	"time"
 
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
 )
@@ -32,7 +49,14 @@ import (
 // SdeReconciler reconciles a Sde object
 type SdeReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Pools    *ServerPools
+	Recorder record.EventRecorder
+	// Notifier delivers spec.notifications; nil disables them
+	Notifier *Notifier
+
+	// MaxConcurrentReconciles is the number of Sde objects reconciled in parallel
+	MaxConcurrentReconciles int
 }
 
 //go:embed embeds/db_cleanup.sh
@@ -41,8 +65,13 @@ var dbCleanup string
 //+kubebuilder:rbac:groups=sde.sde.domain,resources=sdes,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=sde.sde.domain,resources=sdes/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=sde.sde.domain,resources=sdes/finalizers,verbs=update
-//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdereleases,verbs=get;list;watch
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdedatabases,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdedatabases/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -53,24 +82,200 @@ func (r *SdeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	ctxlog := log.FromContext(ctx)
 	sde := &sdev1beta1.Sde{}
 	err := r.Get(ctx, req.NamespacedName, sde)
-	if err != nil {
+	if err != nil && errors.IsNotFound(err) {
+		idleDatabases.DeleteLabelValues(req.Namespace, req.Name)
+		return ctrl.Result{}, r.releaseOrphans(ctx, req.Namespace, req.Name, "")
+	} else if err != nil {
 		ctxlog.Error(err, "Operator not found")
 		return ctrl.Result{}, err
 	}
+	if err = r.releaseOrphans(ctx, sde.Namespace, sde.Name, sde.UID); err != nil {
+		return ctrl.Result{}, err
+	}
 
-	// Reconcile DB
-	if err = r.reconcileDb(ctx, sde); err != nil {
-		ctxlog.Error(err, "PG Cleanup failed")
+	if sde.Spec.Suspend {
+		ctxlog.Info("Suspended, not reconciling")
+		if c := meta.FindStatusCondition(sde.Status.Conditions, sdev1beta1.ConditionReconciled); c == nil || c.Reason != sdev1beta1.ReasonSuspended {
+			err = r.setCondition(ctx, sde, sdev1beta1.ConditionReconciled, metav1.ConditionFalse, sdev1beta1.ReasonSuspended, "spec.suspend is set")
+		}
 		return ctrl.Result{}, err
 	}
 
+	inputs := r.inputsVersion(ctx, sde)
+	if last := sde.Status.LastError; last != nil && errorClass(last.Class).permanent() &&
+		last.Count >= maxPermanentFailures && last.InputsVersion == inputs {
+		ctxlog.Info("Not retrying until the spec or its secrets change", "class", last.Class, "error", last.Message)
+		return ctrl.Result{}, nil
+	}
+
+	// Reconcile DB
+	run := r.startRun(ctx, sde)
+	err = r.reconcileDb(ctx, sde, run)
+	r.finishRun(ctx, sde, run, err)
+	if err != nil {
+		return r.handleError(ctx, sde, inputs, err)
+	}
+
+	if sde.Status.LastError != nil || !meta.IsStatusConditionTrue(sde.Status.Conditions, sdev1beta1.ConditionReconciled) {
+		sde.Status.LastError = nil
+		err = r.setCondition(ctx, sde, sdev1beta1.ConditionReconciled, metav1.ConditionTrue, sdev1beta1.ReasonSucceeded, "")
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
 	ctxlog.Info("All done")
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: recheckInterval(sde)}, nil
+}
+
+// recheckInterval is how soon an Sde whose policies depend on time passing
+// must be reconciled again, or zero when nothing does
+func recheckInterval(sde *sdev1beta1.Sde) time.Duration {
+	p := sde.Spec.Retention
+	switch {
+	case p == nil:
+		return 0
+	case p.Idle != nil:
+		return activitySampleInterval
+	case p.Lifecycle != nil:
+		return lifecycleRecheckInterval
+	}
+	return 0
+}
+
+// maxPermanentFailures is how many times an Auth, Permission or Config error
+// is retried against unchanged inputs before the controller gives up
+const maxPermanentFailures = 3
+
+// handleError records a classified failure in status and picks the requeue
+// strategy for its class.
+func (r *SdeReconciler) handleError(ctx context.Context, sde *sdev1beta1.Sde, inputs string, cause error) (ctrl.Result, error) {
+	ctxlog := log.FromContext(ctx)
+	class := classifyError(cause)
+
+	last := sde.Status.LastError
+	count := int32(1)
+	if last != nil && last.Class == string(class) && last.InputsVersion == inputs {
+		count = last.Count + 1
+	}
+	sde.Status.LastError = &sdev1beta1.ReconcileError{
+		Class:         string(class),
+		Message:       cause.Error(),
+		Count:         count,
+		InputsVersion: inputs,
+		LastTime:      metav1.Now(),
+	}
+	err := r.setCondition(ctx, sde, sdev1beta1.ConditionReconciled, metav1.ConditionFalse, class.reason(), cause.Error())
+	if err != nil {
+		ctxlog.Error(err, "Failed to update status")
+	}
+
+	switch {
+	case class == classInUse:
+		ctxlog.Info("Database is in use, requeuing", "error", cause.Error())
+		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	case class.permanent() && count >= maxPermanentFailures:
+		ctxlog.Error(cause, "PG Cleanup failed permanently, waiting for the spec or its secrets to change", "class", class)
+		return ctrl.Result{}, nil
+	case class.permanent():
+		ctxlog.Error(cause, "PG Cleanup failed", "class", class)
+		return ctrl.Result{RequeueAfter: time.Minute * time.Duration(count)}, nil
+	}
+
+	ctxlog.Error(cause, "PG Cleanup failed", "class", class)
+	return ctrl.Result{}, cause
+}
+
+// inputsVersion identifies everything a reconcile depends on: the Sde spec,
+// the run-now annotation and the resource versions of the objects holding
+// its connection details.
+func (r *SdeReconciler) inputsVersion(ctx context.Context, sde *sdev1beta1.Sde) string {
+	parts := []string{strconv.FormatInt(sde.Generation, 10), sde.Annotations[sdev1beta1.RunNowAnnotation]}
+	version := func(obj client.Object, name, namespace string) {
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, obj); err != nil {
+			parts = append(parts, "-")
+			return
+		}
+		parts = append(parts, obj.GetResourceVersion())
+	}
+
+	if sde.Spec.DatabaseServer == "" {
+		version(&corev1.ConfigMap{}, dbConfigMapName(sde.Namespace), sde.Namespace)
+		version(&corev1.Secret{}, dbSecretName(sde.Namespace), sde.Namespace)
+		return strings.Join(parts, "/")
+	}
+
+	server := &sdev1beta1.SdeDatabaseServer{}
+	version(server, sde.Spec.DatabaseServer, "")
+	ref := server.Spec.CredentialsSecret
+	version(&corev1.Secret{}, ref.Name, ref.Namespace)
+	if tls := server.Spec.TLS; tls != nil && tls.CA != nil {
+		version(&corev1.Secret{}, tls.CA.Name, tls.CA.Namespace)
+	}
+	return strings.Join(parts, "/")
+}
+
+// sdesForObject maps a changed ConfigMap, Secret or SdeDatabaseServer to the
+// Sde objects that read it, so permanently failing Sdes are retried.
+func (r *SdeReconciler) sdesForObject(obj client.Object) []reconcile.Request {
+	ctx := context.Background()
+	sdes := &sdev1beta1.SdeList{}
+	if err := r.List(ctx, sdes); err != nil {
+		return nil
+	}
+
+	servers := map[string]bool{}
+	switch o := obj.(type) {
+	case *sdev1beta1.SdeDatabaseServer:
+		servers[o.Name] = true
+	case *corev1.Secret:
+		list := &sdev1beta1.SdeDatabaseServerList{}
+		if err := r.List(ctx, list); err == nil {
+			for _, server := range list.Items {
+				ref := server.Spec.CredentialsSecret
+				tls := server.Spec.TLS
+				if (ref.Name == o.Name && ref.Namespace == o.Namespace) ||
+					(tls != nil && tls.CA != nil && tls.CA.Name == o.Name && tls.CA.Namespace == o.Namespace) {
+					servers[server.Name] = true
+				}
+			}
+		}
+	}
+
+	var requests []reconcile.Request
+	for _, sde := range sdes.Items {
+		local := sde.Spec.DatabaseServer == "" && sde.Namespace == obj.GetNamespace() &&
+			(obj.GetName() == dbConfigMapName(sde.Namespace) || obj.GetName() == dbSecretName(sde.Namespace))
+		if local || servers[sde.Spec.DatabaseServer] {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: sde.Name, Namespace: sde.Namespace}})
+		}
+	}
+	return requests
+}
+
+// deletionStarted passes updates that set the deletion timestamp
+func deletionStarted() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectOld.GetDeletionTimestamp().IsZero() && !e.ObjectNew.GetDeletionTimestamp().IsZero()
+		},
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SdeReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&sdev1beta1.Sde{}).
+		// Status writes must not retrigger reconciles, or failures would skip backoff
+		For(&sdev1beta1.Sde{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}, predicate.LabelChangedPredicate{}))).
+		Owns(&batchv1.Job{}).
+		// Only pins and deletions of SdeDatabases matter, not their status
+		Owns(&sdev1beta1.SdeDatabase{}, builder.WithPredicates(predicate.Or(
+			predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{}, deletionStarted()))).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.sdesForObject)).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.sdesForObject)).
+		Watches(&source.Kind{Type: &sdev1beta1.SdeDatabaseServer{}}, handler.EnqueueRequestsFromMapFunc(r.sdesForObject)).
+		Watches(&source.Kind{Type: &sdev1beta1.SdeRelease{}}, handler.EnqueueRequestsFromMapFunc(r.sdesForRelease)).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
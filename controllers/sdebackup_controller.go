@@ -0,0 +1,189 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"path/filepath"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// SdeBackupReconciler reconciles a SdeBackup object
+type SdeBackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Pools  *ServerPools
+}
+
+//go:embed embeds/db_backup.sh
+var dbBackup string
+
+const backupMountPath = "/backup"
+
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdebackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdebackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdebackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+
+// Reconcile runs a pg_dump Job for each SdeBackup and records its outcome.
+func (r *SdeBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctxlog := log.FromContext(ctx)
+	backup := &sdev1beta1.SdeBackup{}
+	err := r.Get(ctx, req.NamespacedName, backup)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if backup.Status.Phase == sdev1beta1.JobSucceeded || backup.Status.Phase == sdev1beta1.JobFailed {
+		return ctrl.Result{}, nil
+	}
+
+	err = ensureScripts(ctx, r.Client, r.Scheme, backup, backup.Name+"-scripts", map[string]string{"db_backup.sh": dbBackup})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: backup.Name + "-pg-dump", Namespace: backup.Namespace}, job)
+	if err != nil && errors.IsNotFound(err) {
+		sde, adminConn, conn, err := jobConnection(ctx, r.Client, r.Scheme, r.Pools, backup.Namespace, backup.Spec.Database,
+			fmt.Sprintf("SdeBackup %s", backup.Name))
+		if err == nil {
+			err = r.checkSource(ctx, backup, sde, adminConn)
+		}
+		if classifyError(err) == classConfig {
+			backup.Status.Phase = sdev1beta1.JobFailed
+			backup.Status.Message = err.Error()
+			return ctrl.Result{}, r.Status().Update(ctx, backup)
+		} else if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err = ensureConnectionSecret(ctx, r.Client, r.Scheme, backup, conn); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		job = makeBackupJob(backup, conn)
+		if err = ctrl.SetControllerReference(backup, job, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		ctxlog.Info("Creating backup Job", "job", job.Name, "database", backup.Spec.Database)
+		if err = r.Create(ctx, job); err != nil {
+			return ctrl.Result{}, err
+		}
+
+		backup.Status.Phase = sdev1beta1.JobPending
+		backup.Status.Job = job.Name
+		backup.Status.Path = backupPath(backup)
+		return ctrl.Result{}, r.Status().Update(ctx, backup)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err = observeJob(ctx, r.Client, job, &backup.Status.JobRunStatus); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, r.Status().Update(ctx, backup)
+}
+
+// checkSource refuses to dump a database the Sde does not own, so a backup
+// cannot read another tenant's database off a shared server
+func (r *SdeBackupReconciler) checkSource(ctx context.Context, backup *sdev1beta1.SdeBackup, sde *sdev1beta1.Sde, conn PGConnector) error {
+	db, release, err := r.Pools.Get(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return newExecutor(db, sde, fmt.Sprintf("SdeBackup %s", backup.Name)).checkOwned(ctx, backup.Spec.Database)
+}
+
+// backupPath is where the dump is written, relative to the storage volume
+func backupPath(backup *sdev1beta1.SdeBackup) string {
+	ext := map[sdev1beta1.BackupFormat]string{
+		sdev1beta1.BackupFormatCustom:    ".dump",
+		sdev1beta1.BackupFormatPlain:     ".sql",
+		sdev1beta1.BackupFormatTar:       ".tar",
+		sdev1beta1.BackupFormatDirectory: "",
+	}[backupFormat(backup)]
+	return filepath.Join(backup.Spec.Storage.SubPath, backup.Name+ext)
+}
+
+func backupFormat(backup *sdev1beta1.SdeBackup) sdev1beta1.BackupFormat {
+	if backup.Spec.Format == "" {
+		return sdev1beta1.BackupFormatCustom
+	}
+	return backup.Spec.Format
+}
+
+// withBackupVolume mounts the backup storage into the pod's task container
+func withBackupVolume(spec *corev1.PodSpec, storage sdev1beta1.BackupStorage, readOnly bool) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "backup-volume",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: storage.PersistentVolumeClaim,
+				ReadOnly:  readOnly,
+			},
+		},
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      "backup-volume",
+		MountPath: backupMountPath,
+		ReadOnly:  readOnly,
+	})
+}
+
+func makeBackupJob(backup *sdev1beta1.SdeBackup, conn PGConnector) *batchv1.Job {
+	spec := scriptPodSpec(backup.Name+"-scripts", connectionSecretName(backup), []string{
+		"/scripts/db_backup.sh", string(backupFormat(backup)), filepath.Join(backupMountPath, backupPath(backup)),
+	})
+	withDbConnection(&spec, connectionSecretName(backup), backup.Spec.Database, conn)
+	withBackupVolume(&spec, backup.Spec.Storage, false)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backup.Name + "-pg-dump",
+			Namespace: backup.Namespace,
+			Labels:    map[string]string{"sde.domain/database": backup.Spec.Database},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{Spec: spec},
+		},
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SdeBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&sdev1beta1.SdeBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
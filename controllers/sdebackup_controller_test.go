@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestBackupJob(t *testing.T) {
+	backup := &sdev1beta1.SdeBackup{}
+	backup.Name = "nightly"
+	backup.Namespace = "team"
+	backup.Spec.Database = "sde_5.3.4"
+	backup.Spec.Storage = sdev1beta1.BackupStorage{PersistentVolumeClaim: "backups", SubPath: "sde"}
+
+	assert.Equal(t, "sde/nightly.dump", backupPath(backup))
+	backup.Spec.Format = sdev1beta1.BackupFormatPlain
+	assert.Equal(t, "sde/nightly.sql", backupPath(backup))
+
+	job := makeBackupJob(backup, PGConnector{})
+	container := job.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, []string{"/scripts/db_backup.sh", "plain", "/backup/sde/nightly.sql"}, container.Command)
+	assert.Equal(t, "backups", job.Spec.Template.Spec.Volumes[2].PersistentVolumeClaim.ClaimName)
+	assert.Equal(t, "/backup", container.VolumeMounts[2].MountPath)
+
+	backup.Status.Path = backupPath(backup)
+	restore := &sdev1beta1.SdeRestore{}
+	restore.Name = "rollback"
+	restore.Namespace = "team"
+	restore.Spec.TargetDatabase = "sde_5.3.4_copy"
+
+	job = makeRestoreJob(restore, backup, PGConnector{})
+	container = job.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, []string{"/scripts/db_restore.sh", "plain", "/backup/sde/nightly.sql"}, container.Command)
+	assert.True(t, container.VolumeMounts[2].ReadOnly)
+	assert.Equal(t, corev1.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+	assert.Equal(t, int32(0), *job.Spec.BackoffLimit)
+}
+
+func TestBackupConnection(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	// The namespace has no <ns>-db-configmap: its Sdes use a shared server
+	server := &sdev1beta1.SdeDatabaseServer{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+		Spec: sdev1beta1.SdeDatabaseServerSpec{
+			Host:              "pg.example",
+			CredentialsSecret: sdev1beta1.SecretKeyReference{Name: "creds", Namespace: "ops"},
+		},
+	}
+	creds := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: "ops"},
+		Data:       map[string][]byte{"username": []byte("admin"), "password": []byte("secret")},
+	}
+	local := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "local", Namespace: "team"}}
+	shared := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "shared", Namespace: "team"}}
+	shared.Spec.DatabaseServer = "shared"
+	mirror := &sdev1beta1.SdeDatabase{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared-5.3.4", Namespace: "team", Labels: map[string]string{"sde.domain/sde": "shared"}},
+		Spec:       sdev1beta1.SdeDatabaseSpec{DatabaseName: "sde_5.3.4"},
+	}
+	backup := &sdev1beta1.SdeBackup{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "team", UID: "uid"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(server, creds, local, shared, mirror, backup).Build()
+	ctx := context.Background()
+
+	db, _ := openFakeDB(t)
+	pools := NewServerPools(PoolOptions{})
+	pools.connect = func(context.Context, PGConnector) (*sql.DB, error) { return db, nil }
+
+	sde, conn, jobConn, err := jobConnection(ctx, c, scheme, pools, "team", "sde_5.3.4", "SdeBackup nightly")
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", sde.Name)
+	assert.Equal(t, "admin", conn.User)
+	assert.Equal(t, "pg.example", jobConn.Host)
+	assert.Equal(t, jobRoleName(shared), jobConn.User)
+
+	// With two Sdes, a database neither mirrors cannot be placed
+	_, _, _, err = jobConnection(ctx, c, scheme, pools, "team", "sde_9.9.9", "SdeBackup nightly")
+	assert.Error(t, err)
+	// Nor can one in a namespace without an Sde
+	_, _, _, err = jobConnection(ctx, c, scheme, pools, "other", "sde_5.3.4", "SdeBackup nightly")
+	assert.Equal(t, classConfig, classifyError(err))
+
+	// The Job's Secret in the tenant namespace carries the job role, never
+	// the server's admin login
+	assert.NoError(t, ensureConnectionSecret(ctx, c, scheme, backup, jobConn))
+	secret := &corev1.Secret{}
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "nightly-db-connection", Namespace: "team"}, secret))
+	assert.Equal(t, jobRoleName(shared), string(secret.Data["DATABASE_USER"]))
+	assert.NotEqual(t, "secret", string(secret.Data["DATABASE_PASSWORD"]))
+	assert.Equal(t, "nightly", secret.OwnerReferences[0].Name)
+
+	// The job role keeps its password across reconciles
+	_, _, again, err := jobConnection(ctx, c, scheme, pools, "team", "sde_5.3.4", "SdeBackup nightly")
+	assert.NoError(t, err)
+	assert.Equal(t, jobConn.Password, again.Password)
+
+	// The role's statements are audited without its password
+	configmap := &corev1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "shared-sql-audit", Namespace: "team"}, configmap))
+	assert.Contains(t, configmap.Data["audit.jsonl"], "CREATE ROLE")
+	assert.NotContains(t, configmap.Data["audit.jsonl"], jobConn.Password)
+
+	jobConn.Password = "rotated"
+	assert.NoError(t, ensureConnectionSecret(ctx, c, scheme, backup, jobConn))
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "nightly-db-connection", Namespace: "team"}, secret))
+	assert.Equal(t, "rotated", string(secret.Data["DATABASE_PASSWORD"]))
+}
+
+func TestBackupForeignDatabase(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, batchv1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "team", UID: "uid"}}
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: dbConfigMapName("team"), Namespace: "team"}}
+	dbSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: dbSecretName("team"), Namespace: "team"}}
+	backup := &sdev1beta1.SdeBackup{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "team", UID: "uid"}}
+	backup.Spec.Database = "sde_5.3.4"
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde, configMap, dbSecret, backup).Build()
+	ctx := context.Background()
+
+	// Another tenant's Sde owns the database on the shared server
+	db, d := openFakeDB(t)
+	d.comments = map[string]string{"sde_5.3.4": "sde.domain/owner=other/sde"}
+	pools := NewServerPools(PoolOptions{})
+	pools.connect = func(context.Context, PGConnector) (*sql.DB, error) { return db, nil }
+	r := &SdeBackupReconciler{Client: c, Scheme: scheme, Pools: pools}
+
+	_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "nightly", Namespace: "team"}})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "nightly", Namespace: "team"}, backup))
+	assert.Equal(t, sdev1beta1.JobFailed, backup.Status.Phase)
+	assert.Contains(t, backup.Status.Message, "not owned by team/sde")
+	jobs := &batchv1.JobList{}
+	assert.NoError(t, c.List(ctx, jobs))
+	assert.Empty(t, jobs.Items)
+
+	// The owning Sde's backup goes ahead
+	owned := &sdev1beta1.SdeBackup{ObjectMeta: metav1.ObjectMeta{Name: "owned", Namespace: "team", UID: "uid2"}}
+	owned.Spec.Database = "sde_5.3.4"
+	assert.NoError(t, c.Create(ctx, owned))
+	d.comments["sde_5.3.4"] = ownerComment(sde)
+	_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "owned", Namespace: "team"}})
+	assert.NoError(t, err)
+	assert.NoError(t, c.List(ctx, jobs))
+	assert.Len(t, jobs.Items, 1)
+}
+
+func TestRestoreReplace(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "team", UID: "uid"}}
+	restore := &sdev1beta1.SdeRestore{ObjectMeta: metav1.ObjectMeta{Name: "rollback", Namespace: "team"}}
+	restore.Spec.TargetDatabase = "sde_5.3.4"
+	restore.Spec.OverwritePolicy = sdev1beta1.OverwriteReplace
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde, restore).Build()
+	ctx := context.Background()
+
+	db, d := openFakeDB(t)
+	d.names = map[string][]string{"EXISTS": {"true"}}
+	pools := NewServerPools(PoolOptions{})
+	pools.connect = func(context.Context, PGConnector) (*sql.DB, error) { return db, nil }
+	r := &SdeRestoreReconciler{Client: c, Scheme: scheme, Pools: pools}
+	role := jobRoleName(sde)
+
+	// A database the Sde did not create is refused
+	err := r.prepareTarget(ctx, restore, sde, PGConnector{}, role)
+	assert.Equal(t, classConfig, classifyError(err))
+	assert.NotContains(t, d.executed, `DROP DATABASE "sde_5.3.4"`)
+	assert.NotContains(t, d.executed, `CREATE DATABASE "sde_5.3.4" OWNER "`+role+`"`)
+
+	// The drop is audited on the owning Sde, and the empty database the Job
+	// restores into is owned by the job role and claimed for the Sde
+	d.comments = map[string]string{"sde_5.3.4": ownerComment(sde)}
+	assert.NoError(t, r.prepareTarget(ctx, restore, sde, PGConnector{}, role))
+	assert.Equal(t, []string{
+		`DROP DATABASE "sde_5.3.4"`,
+		`CREATE DATABASE "sde_5.3.4" OWNER "` + role + `"`,
+		`COMMENT ON DATABASE "sde_5.3.4" IS 'sde.domain/owner=team/sde'`,
+	}, d.executed[len(d.executed)-4:len(d.executed)-1])
+	configmap := &corev1.ConfigMap{}
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "sde-sql-audit", Namespace: "team"}, configmap))
+	records, err := readAudit(configmap)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 4) {
+		assert.NotEmpty(t, records[0].Error)
+		assert.Equal(t, "SdeRestore rollback", records[1].Trigger)
+		assert.Contains(t, records[3].Statement, "COMMENT ON DATABASE")
+	}
+
+	// Without Replace an existing target fails the restore
+	restore.Spec.OverwritePolicy = sdev1beta1.OverwriteNever
+	d.executed = nil
+	err = r.prepareTarget(ctx, restore, sde, PGConnector{}, role)
+	assert.Equal(t, classConfig, classifyError(err))
+	assert.NotContains(t, d.executed, `DROP DATABASE "sde_5.3.4"`)
+}
+
+func TestRestoreReplaceKeepsOwner(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, batchv1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "team", UID: "uid"}}
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: dbConfigMapName("team"), Namespace: "team"}}
+	dbSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: dbSecretName("team"), Namespace: "team"}}
+	backup := &sdev1beta1.SdeBackup{ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "team"}}
+	backup.Status.Phase = sdev1beta1.JobSucceeded
+	restore := &sdev1beta1.SdeRestore{ObjectMeta: metav1.ObjectMeta{Name: "rollback", Namespace: "team", UID: "uid2"}}
+	restore.Spec.BackupName = "nightly"
+	restore.Spec.TargetDatabase = "sde_5.3.4"
+	restore.Spec.OverwritePolicy = sdev1beta1.OverwriteReplace
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sde, configMap, dbSecret, backup, restore).Build()
+	ctx := context.Background()
+
+	db, d := openFakeDB(t)
+	d.names = map[string][]string{"EXISTS": {"true"}}
+	d.comments = map[string]string{"sde_5.3.4": ownerComment(sde)}
+	pools := NewServerPools(PoolOptions{})
+	pools.connect = func(context.Context, PGConnector) (*sql.DB, error) { return db, nil }
+	r := &SdeRestoreReconciler{Client: c, Scheme: scheme, Pools: pools}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "rollback", Namespace: "team"}}
+
+	_, err := r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.Contains(t, d.executed, `DROP DATABASE "sde_5.3.4"`)
+
+	// The restored dump brings no owner comment along
+	d.comments["sde_5.3.4"] = ""
+	job := &batchv1.Job{}
+	assert.NoError(t, c.Get(ctx, types.NamespacedName{Name: "rollback-pg-restore", Namespace: "team"}, job))
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	assert.NoError(t, c.Status().Update(ctx, job))
+
+	_, err = r.Reconcile(ctx, req)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Get(ctx, req.NamespacedName, restore))
+	assert.Equal(t, sdev1beta1.JobSucceeded, restore.Status.Phase)
+	assert.NoError(t, newExecutor(db, sde, "test").checkOwned(ctx, "sde_5.3.4"))
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// SdeDatabaseServerReconciler health-checks SdeDatabaseServer objects
+type SdeDatabaseServerReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Pools  *ServerPools
+}
+
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdedatabaseservers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdedatabaseservers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sdedatabaseservers/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+// Reconcile checks that the server is reachable with its credentials and
+// records the outcome in the Ready condition.
+func (r *SdeDatabaseServerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctxlog := log.FromContext(ctx)
+	server := &sdev1beta1.SdeDatabaseServer{}
+	err := r.Get(ctx, req.NamespacedName, server)
+	if err != nil {
+		// Pools of deleted servers are evicted once idle.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	interval := time.Minute
+	if server.Spec.HealthCheckInterval != nil {
+		interval = server.Spec.HealthCheckInterval.Duration
+	}
+
+	now := metav1.Now()
+	server.Status.LastCheckTime = &now
+	condition := metav1.Condition{
+		Type:               sdev1beta1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             sdev1beta1.ReasonConnected,
+		ObservedGeneration: server.Generation,
+	}
+
+	conn, err := serverConnector(ctx, r.Client, server)
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = sdev1beta1.ReasonCredentialsError
+		condition.Message = err.Error()
+	} else if version, err := r.checkServer(ctx, conn); err != nil {
+		ctxlog.Info("Database server is unreachable", "server", server.Name, "error", err.Error())
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = sdev1beta1.ReasonConnectionFailed
+		condition.Message = err.Error()
+	} else {
+		server.Status.ServerVersion = version
+	}
+
+	meta.SetStatusCondition(&server.Status.Conditions, condition)
+	if err := r.Status().Update(ctx, server); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+func (r *SdeDatabaseServerReconciler) checkServer(ctx context.Context, conn PGConnector) (string, error) {
+	db, release, err := r.Pools.Get(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	if err = db.PingContext(ctx); err != nil {
+		return "", err
+	}
+
+	var version string
+	err = db.QueryRowContext(ctx, "SHOW server_version").Scan(&version)
+	return version, err
+}
+
+// serverConnector builds the admin connection for a server from its
+// credentials and CA Secrets
+func serverConnector(ctx context.Context, c client.Client, server *sdev1beta1.SdeDatabaseServer) (PGConnector, error) {
+	creds := &corev1.Secret{}
+	ref := server.Spec.CredentialsSecret
+	err := c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, creds)
+	if err != nil {
+		return PGConnector{}, err
+	}
+
+	port := server.Spec.Port
+	if port == 0 {
+		port = 5432
+	}
+	dbname := server.Spec.Database
+	if dbname == "" {
+		dbname = "postgres"
+	}
+
+	conn := PGConnector{
+		Host:     server.Spec.Host,
+		Port:     strconv.Itoa(int(port)),
+		User:     string(creds.Data["username"]),
+		Password: string(creds.Data["password"]),
+		Dbname:   dbname,
+		Sslmode:  sslDisable,
+	}
+
+	if tls := server.Spec.TLS; tls != nil {
+		conn.Sslmode = sslMode(tls.Mode)
+		if tls.Mode == "" {
+			conn.Sslmode = sslRequire
+		}
+		if tls.CA != nil {
+			ca := &corev1.Secret{}
+			err = c.Get(ctx, types.NamespacedName{Name: tls.CA.Name, Namespace: tls.CA.Namespace}, ca)
+			if err != nil {
+				return PGConnector{}, err
+			}
+			key := tls.CA.Key
+			if key == "" {
+				key = "ca.crt"
+			}
+			conn.SslRootCert = string(ca.Data[key])
+			if conn.SslRootCert == "" {
+				return PGConnector{}, configErrorf("secret %s/%s has no key %s", tls.CA.Namespace, tls.CA.Name, key)
+			}
+		}
+	}
+	return conn, nil
+}
+
+// namespaceAllowed reports whether the server's namespace selector admits namespace
+func namespaceAllowed(ctx context.Context, c client.Client, server *sdev1beta1.SdeDatabaseServer, namespace string) (bool, error) {
+	if server.Spec.NamespaceSelector == nil {
+		return true, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(server.Spec.NamespaceSelector)
+	if err != nil {
+		return false, err
+	}
+
+	ns := &corev1.Namespace{}
+	err = c.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(ns.Labels)), nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SdeDatabaseServerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		// Status writes of the health check must not trigger the next one
+		For(&sdev1beta1.SdeDatabaseServer{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Complete(r)
+}
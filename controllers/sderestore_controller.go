@@ -0,0 +1,257 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/lib/pq"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// SdeRestoreReconciler reconciles a SdeRestore object
+type SdeRestoreReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	Pools  *ServerPools
+}
+
+//go:embed embeds/db_restore.sh
+var dbRestore string
+
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sderestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sderestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=sde.sde.domain,resources=sderestores/finalizers,verbs=update
+
+// Reconcile runs a pg_restore Job once the referenced SdeBackup has succeeded.
+func (r *SdeRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctxlog := log.FromContext(ctx)
+	restore := &sdev1beta1.SdeRestore{}
+	err := r.Get(ctx, req.NamespacedName, restore)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if restore.Status.Phase == sdev1beta1.JobSucceeded || restore.Status.Phase == sdev1beta1.JobFailed {
+		return ctrl.Result{}, nil
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, types.NamespacedName{Name: restore.Name + "-pg-restore", Namespace: restore.Namespace}, job)
+	if err == nil {
+		if err = observeJob(ctx, r.Client, job, &restore.Status.JobRunStatus); err != nil {
+			return ctrl.Result{}, err
+		}
+		// A dump may carry a comment of its own for the database, so the
+		// restored database is claimed again before the restore counts as done
+		if restore.Status.Phase == sdev1beta1.JobSucceeded {
+			err = r.claimTarget(ctx, restore)
+			if classifyError(err) == classConfig {
+				restore.Status.Phase = sdev1beta1.JobFailed
+				restore.Status.Message = err.Error()
+			} else if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return ctrl.Result{}, r.Status().Update(ctx, restore)
+	} else if !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	backup := &sdev1beta1.SdeBackup{}
+	err = r.Get(ctx, types.NamespacedName{Name: restore.Spec.BackupName, Namespace: restore.Namespace}, backup)
+	if err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+
+	if errors.IsNotFound(err) || backup.Status.Phase != sdev1beta1.JobSucceeded {
+		if err == nil && backup.Status.Phase == sdev1beta1.JobFailed {
+			restore.Status.Phase = sdev1beta1.JobFailed
+			restore.Status.Message = fmt.Sprintf("backup %s failed", backup.Name)
+			return ctrl.Result{}, r.Status().Update(ctx, restore)
+		}
+
+		// Requeue until the backup has completed.
+		ctxlog.Info("Waiting for backup to complete", "backup", restore.Spec.BackupName)
+		restore.Status.Phase = sdev1beta1.JobPending
+		restore.Status.Message = fmt.Sprintf("waiting for backup %s", restore.Spec.BackupName)
+		if err := r.Status().Update(ctx, restore); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: time.Second * 15}, nil
+	}
+
+	err = ensureScripts(ctx, r.Client, r.Scheme, restore, restore.Name+"-scripts", map[string]string{"db_restore.sh": dbRestore})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	sde, conn, jobConn, err := jobConnection(ctx, r.Client, r.Scheme, r.Pools, restore.Namespace, restore.Spec.TargetDatabase,
+		fmt.Sprintf("SdeRestore %s", restore.Name))
+	if classifyError(err) == classConfig {
+		restore.Status.Phase = sdev1beta1.JobFailed
+		restore.Status.Message = err.Error()
+		return ctrl.Result{}, r.Status().Update(ctx, restore)
+	} else if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err = ensureConnectionSecret(ctx, r.Client, r.Scheme, restore, jobConn); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	job = makeRestoreJob(restore, backup, jobConn)
+	// Status.Job records that the target was prepared, so a Job that failed
+	// to be created does not see its own empty database as taken
+	if restore.Status.Job == "" {
+		err = r.prepareTarget(ctx, restore, sde, conn, jobConn.User)
+		if classifyError(err) == classConfig {
+			restore.Status.Phase = sdev1beta1.JobFailed
+			restore.Status.Message = err.Error()
+			return ctrl.Result{}, r.Status().Update(ctx, restore)
+		} else if err != nil {
+			return ctrl.Result{}, err
+		}
+		restore.Status.Phase = sdev1beta1.JobPending
+		restore.Status.Job = job.Name
+		restore.Status.Message = ""
+		if err = r.Status().Update(ctx, restore); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err = ctrl.SetControllerReference(restore, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	ctxlog.Info("Creating restore Job", "job", job.Name, "backup", backup.Name, "database", restore.Spec.TargetDatabase)
+	return ctrl.Result{}, r.Create(ctx, job)
+}
+
+// prepareTarget creates the empty target database the restore Job fills,
+// owned by the Sde's job role, which cannot create databases itself. An
+// existing target fails the restore unless the policy is Replace, when it is
+// dropped through the Sde's executor: only a database the Sde owns is
+// dropped, and the drop is audited.
+func (r *SdeRestoreReconciler) prepareTarget(ctx context.Context, restore *sdev1beta1.SdeRestore, sde *sdev1beta1.Sde, conn PGConnector, owner string) error {
+	name := restore.Spec.TargetDatabase
+	db, release, err := r.Pools.Get(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var exists bool
+	err = db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists && restore.Spec.OverwritePolicy != sdev1beta1.OverwriteReplace {
+		return configErrorf("database %s already exists", name)
+	}
+
+	exec := newExecutor(db, sde, fmt.Sprintf("SdeRestore %s", restore.Name))
+	err = withServerLock(ctx, db, dbPrefix, func() error {
+		if exists {
+			log.FromContext(ctx).Info("Dropping database to replace it", "database", name, "sde", sde.Name)
+			if err := exec.DropDatabase(ctx, name); err != nil {
+				return err
+			}
+		}
+		err := exec.exec(ctx, fmt.Sprintf("CREATE DATABASE %s OWNER %s", pq.QuoteIdentifier(name), pq.QuoteIdentifier(owner)))
+		if err != nil {
+			return err
+		}
+		return exec.claimDatabase(ctx, name)
+	})
+	if auditErr := writeAudit(ctx, r.Client, r.Scheme, exec); auditErr != nil {
+		log.FromContext(ctx).Error(auditErr, "Failed to write SQL audit records")
+	}
+	return err
+}
+
+// claimTarget records the restored database as owned by its Sde
+func (r *SdeRestoreReconciler) claimTarget(ctx context.Context, restore *sdev1beta1.SdeRestore) error {
+	name := restore.Spec.TargetDatabase
+	sde, err := sdeForDatabase(ctx, r.Client, restore.Namespace, name)
+	if err != nil {
+		return err
+	}
+	if sde == nil {
+		return configErrorf("restored %s, but no Sde in namespace %s is left to own it", name, restore.Namespace)
+	}
+	conn, err := connectorFor(ctx, r.Client, sde)
+	if err != nil {
+		return err
+	}
+	db, release, err := r.Pools.Get(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer release()
+	exec := newExecutor(db, sde, fmt.Sprintf("SdeRestore %s", restore.Name))
+	err = exec.claimDatabase(ctx, name)
+	if auditErr := writeAudit(ctx, r.Client, r.Scheme, exec); auditErr != nil {
+		log.FromContext(ctx).Error(auditErr, "Failed to write SQL audit records")
+	}
+	return err
+}
+
+func makeRestoreJob(restore *sdev1beta1.SdeRestore, backup *sdev1beta1.SdeBackup, conn PGConnector) *batchv1.Job {
+	spec := scriptPodSpec(restore.Name+"-scripts", connectionSecretName(restore), []string{
+		"/scripts/db_restore.sh", string(backupFormat(backup)), filepath.Join(backupMountPath, backup.Status.Path),
+	})
+	withDbConnection(&spec, connectionSecretName(restore), restore.Spec.TargetDatabase, conn)
+	withBackupVolume(&spec, backup.Spec.Storage, true)
+	// A rerun would find the database it half restored, so a failed restore
+	// is left for the user to retry with a new SdeRestore
+	spec.RestartPolicy = corev1.RestartPolicyNever
+	backoffLimit := int32(0)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restore.Name + "-pg-restore",
+			Namespace: restore.Namespace,
+			Labels:    map[string]string{"sde.domain/database": restore.Spec.TargetDatabase},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template:     corev1.PodTemplateSpec{Spec: spec},
+		},
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *SdeRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&sdev1beta1.SdeRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
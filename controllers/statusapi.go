@@ -0,0 +1,413 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// StatusServerOptions configures the read-only status API
+type StatusServerOptions struct {
+	BindAddress string
+	// TokenFile holds the accepted bearer tokens, one per line. It is read
+	// again whenever it changes, so tokens rotate with the mounted Secret.
+	TokenFile string
+	// CertFile and KeyFile switch the server to TLS when both are set
+	CertFile string
+	KeyFile  string
+	// AuditEntries is how many of the newest audit records are served per Sde
+	AuditEntries int
+}
+
+// StatusServer serves each Sde's inventory, plan, last cleanup and recent
+// audit records as JSON under /api/v1/ and as an HTML page under /, to
+// clients presenting one of the configured tokens. It only reads from the
+// manager's cache and runs on every replica, leader or not.
+type StatusServer struct {
+	client client.Reader
+	opts   StatusServerOptions
+
+	mu       sync.Mutex
+	tokens   [][]byte
+	tokenMod time.Time
+}
+
+func NewStatusServer(c client.Reader, opts StatusServerOptions) (*StatusServer, error) {
+	if opts.TokenFile == "" {
+		return nil, errors.New("the status API needs a token file")
+	}
+	if opts.AuditEntries <= 0 {
+		opts.AuditEntries = 50
+	}
+	s := &StatusServer{client: c, opts: opts}
+	if _, err := s.currentTokens(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *StatusServer) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *StatusServer) Start(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.opts.BindAddress,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if s.opts.CertFile != "" && s.opts.KeyFile != "" {
+			errs <- server.ListenAndServeTLS(s.opts.CertFile, s.opts.KeyFile)
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	log.FromContext(ctx).Info("Serving the status API", "address", s.opts.BindAddress)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdown)
+	}
+}
+
+// Handler routes the API and the status page behind token authentication
+func (s *StatusServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/sdes", s.serveList)
+	mux.HandleFunc("/api/v1/sdes/", s.serveSde)
+	mux.HandleFunc("/", s.servePage)
+	return s.authenticate(mux)
+}
+
+// currentTokens returns the tokens in the token file, re-reading it when its
+// modification time changed
+func (s *StatusServer) currentTokens() ([][]byte, error) {
+	info, err := os.Stat(s.opts.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens != nil && info.ModTime().Equal(s.tokenMod) {
+		return s.tokens, nil
+	}
+	data, err := os.ReadFile(s.opts.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	var tokens [][]byte
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			tokens = append(tokens, []byte(line))
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token file %s holds no tokens", s.opts.TokenFile)
+	}
+	s.tokens, s.tokenMod = tokens, info.ModTime()
+	return tokens, nil
+}
+
+// authenticate accepts a token as "Authorization: Bearer <token>" or as the
+// basic auth password, which lets browsers open the status page. Only GET
+// and HEAD are served.
+func (s *StatusServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read-only API", http.StatusMethodNotAllowed)
+			return
+		}
+
+		given := ""
+		if _, password, ok := r.BasicAuth(); ok {
+			given = password
+		} else if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+			given = token
+		}
+
+		tokens, err := s.currentTokens()
+		if err != nil {
+			log.FromContext(r.Context()).Error(err, "Failed to read status API tokens")
+			http.Error(w, "authentication unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		valid := 0
+		for _, token := range tokens {
+			valid |= subtle.ConstantTimeCompare([]byte(given), token)
+		}
+		if given == "" || valid != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sde-status"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sdeSummary is one Sde in the list
+type sdeSummary struct {
+	Namespace     string                    `json:"namespace"`
+	Name          string                    `json:"name"`
+	DatabaseCount int64                     `json:"databaseCount"`
+	Suspended     bool                      `json:"suspended,omitempty"`
+	Databases     int                       `json:"databases"`
+	PlanHash      string                    `json:"planHash,omitempty"`
+	PlannedDrops  int                       `json:"plannedDrops"`
+	LastCleanup   *metav1.Time              `json:"lastCleanup,omitempty"`
+	Storage       *sdev1beta1.StorageStatus `json:"storage,omitempty"`
+	Conditions    []metav1.Condition        `json:"conditions,omitempty"`
+}
+
+// sdeDetail is everything served about one Sde
+type sdeDetail struct {
+	sdeSummary
+	Inventory  []inventoryEntry          `json:"inventory"`
+	Plan       *sdev1beta1.RetentionPlan `json:"plan,omitempty"`
+	Cleanup    *sdev1beta1.CleanupResult `json:"cleanup,omitempty"`
+	Audit      []auditRecord             `json:"audit,omitempty"`
+	Unowned    []string                  `json:"unownedDatabases,omitempty"`
+	AuditError string                    `json:"auditError,omitempty"`
+}
+
+// inventoryEntry is an SdeDatabase as served
+type inventoryEntry struct {
+	Database     string                      `json:"database"`
+	Version      string                      `json:"version,omitempty"`
+	SizeBytes    int64                       `json:"sizeBytes"`
+	Pinned       bool                        `json:"pinned,omitempty"`
+	Verdict      sdev1beta1.RetentionVerdict `json:"verdict,omitempty"`
+	Reason       string                      `json:"reason,omitempty"`
+	LastActivity *metav1.Time                `json:"lastActivity,omitempty"`
+}
+
+func summarize(sde *sdev1beta1.Sde, databases int) sdeSummary {
+	summary := sdeSummary{
+		Namespace:     sde.Namespace,
+		Name:          sde.Name,
+		DatabaseCount: sde.Spec.DatabaseCount,
+		Suspended:     sde.Spec.Suspend,
+		Databases:     databases,
+		Storage:       sde.Status.Storage,
+		Conditions:    sde.Status.Conditions,
+	}
+	if p := sde.Status.Plan; p != nil {
+		summary.PlanHash, summary.PlannedDrops = p.Hash, len(p.Drop)
+	}
+	if c := sde.Status.LastCleanup; c != nil {
+		summary.LastCleanup = &c.Time
+	}
+	return summary
+}
+
+// inventory lists the SdeDatabases of sde oldest first
+func (s *StatusServer) inventory(ctx context.Context, sde *sdev1beta1.Sde) ([]inventoryEntry, error) {
+	list := &sdev1beta1.SdeDatabaseList{}
+	err := s.client.List(ctx, list, client.InNamespace(sde.Namespace), client.MatchingLabels{"sde.domain/sde": sde.Name})
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]sdev1beta1.SdeDatabase{}
+	var names []string
+	for _, obj := range list.Items {
+		if metav1.IsControlledBy(&obj, sde) {
+			byName[obj.Spec.DatabaseName] = obj
+			names = append(names, obj.Spec.DatabaseName)
+		}
+	}
+	sortDbs(sde, names)
+
+	entries := make([]inventoryEntry, 0, len(names))
+	for _, name := range names {
+		obj := byName[name]
+		entries = append(entries, inventoryEntry{
+			Database:     name,
+			Version:      obj.Status.Version,
+			SizeBytes:    obj.Status.SizeBytes,
+			Pinned:       obj.Spec.Pinned,
+			Verdict:      obj.Status.Verdict,
+			Reason:       obj.Status.Reason,
+			LastActivity: obj.Status.LastActivity,
+		})
+	}
+	return entries, nil
+}
+
+func (s *StatusServer) detail(ctx context.Context, sde *sdev1beta1.Sde) (*sdeDetail, error) {
+	inventory, err := s.inventory(ctx, sde)
+	if err != nil {
+		return nil, err
+	}
+	detail := &sdeDetail{
+		sdeSummary: summarize(sde, len(inventory)),
+		Inventory:  inventory,
+		Plan:       sde.Status.Plan,
+		Cleanup:    sde.Status.LastCleanup,
+		Unowned:    sde.Status.UnownedDatabases,
+	}
+
+	configmap := &corev1.ConfigMap{}
+	err = s.client.Get(ctx, types.NamespacedName{Name: auditConfigMapName(sde), Namespace: sde.Namespace}, configmap)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	} else if err == nil {
+		records, err := readAudit(configmap)
+		if err != nil {
+			detail.AuditError = err.Error()
+		}
+		if len(records) > s.opts.AuditEntries {
+			records = records[len(records)-s.opts.AuditEntries:]
+		}
+		detail.Audit = records
+	}
+	return detail, nil
+}
+
+func (s *StatusServer) serveList(w http.ResponseWriter, r *http.Request) {
+	sdes := &sdev1beta1.SdeList{}
+	if err := s.client.List(r.Context(), sdes); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	summaries := make([]sdeSummary, 0, len(sdes.Items))
+	for i := range sdes.Items {
+		inventory, err := s.inventory(r.Context(), &sdes.Items[i])
+		if err != nil {
+			s.fail(w, r, err)
+			return
+		}
+		summaries = append(summaries, summarize(&sdes.Items[i], len(inventory)))
+	}
+	writeJSON(w, summaries)
+}
+
+// serveSde answers /api/v1/sdes/<namespace>/<name>
+func (s *StatusServer) serveSde(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/sdes/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	sde := &sdev1beta1.Sde{}
+	if err := s.client.Get(r.Context(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, sde); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	detail, err := s.detail(r.Context(), sde)
+	if err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	writeJSON(w, detail)
+}
+
+func (s *StatusServer) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	sdes := &sdev1beta1.SdeList{}
+	if err := s.client.List(r.Context(), sdes); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	var details []*sdeDetail
+	for i := range sdes.Items {
+		detail, err := s.detail(r.Context(), &sdes.Items[i])
+		if err != nil {
+			s.fail(w, r, err)
+			return
+		}
+		details = append(details, detail)
+	}
+
+	var buf bytes.Buffer
+	if err := statusPage.Execute(&buf, details); err != nil {
+		s.fail(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+func (s *StatusServer) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if apierrors.IsNotFound(err) {
+		http.NotFound(w, r)
+		return
+	}
+	log.FromContext(r.Context()).Error(err, "Status API request failed", "path", r.URL.Path)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Sde retention</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.Drop { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Sde retention</h1>
+{{- range . }}
+<h2>{{ .Namespace }}/{{ .Name }}{{ if .Suspended }} (suspended){{ end }}</h2>
+<p>Keeping {{ .DatabaseCount }} of {{ .Databases }} databases.
+{{- if .PlanHash }} Plan {{ .PlanHash }} drops {{ .PlannedDrops }}.{{ end }}
+{{- with .Cleanup }} Last cleanup {{ .Time }}: {{ .Dropped }} dropped, {{ .Failed }} failed, {{ .Skipped }} skipped, {{ .Blocked }} blocked.{{ end }}</p>
+<table>
+<tr><th>Database</th><th>Version</th><th>Size (bytes)</th><th>Pinned</th><th>Verdict</th><th>Last activity</th></tr>
+{{- range .Inventory }}
+<tr class="{{ .Verdict }}"><td>{{ .Database }}</td><td>{{ .Version }}</td><td>{{ .SizeBytes }}</td><td>{{ .Pinned }}</td><td>{{ .Verdict }}{{ with .Reason }} ({{ . }}){{ end }}</td><td>{{ with .LastActivity }}{{ . }}{{ end }}</td></tr>
+{{- end }}
+</table>
+{{- if .Audit }}
+<details><summary>Recent SQL ({{ len .Audit }})</summary>
+<table>
+<tr><th>Time</th><th>Trigger</th><th>Statement</th><th>Error</th></tr>
+{{- range .Audit }}
+<tr><td>{{ .Time }}</td><td>{{ .Trigger }}</td><td><code>{{ .Statement }}</code></td><td>{{ .Error }}</td></tr>
+{{- end }}
+</table>
+</details>
+{{- end }}
+{{- else }}
+<p>No Sdes found.</p>
+{{- end }}
+</body>
+</html>
+`))
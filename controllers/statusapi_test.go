@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func TestStatusServer(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, corev1.AddToScheme(scheme))
+	assert.NoError(t, sdev1beta1.AddToScheme(scheme))
+
+	sde := &sdev1beta1.Sde{ObjectMeta: metav1.ObjectMeta{Name: "sde", Namespace: "ns", UID: "uid"}}
+	sde.Status.Plan = &sdev1beta1.RetentionPlan{Hash: "0123456789abcdef", Drop: []sdev1beta1.PlannedDrop{{Name: "sde_5.2.0", Reason: reasonCount}}}
+	database := func(name string) *sdev1beta1.SdeDatabase {
+		return &sdev1beta1.SdeDatabase{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "sde-" + name[4:], Namespace: "ns",
+				Labels: map[string]string{"sde.domain/sde": "sde"},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: sdev1beta1.GroupVersion.String(), Kind: "Sde", Name: "sde", UID: "uid", Controller: pointer.Bool(true),
+				}},
+			},
+			Spec: sdev1beta1.SdeDatabaseSpec{DatabaseName: name},
+		}
+	}
+	audit := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "sde-sql-audit", Namespace: "ns"},
+		Data: map[string]string{"audit.jsonl": `{"time":"2024-01-01T00:00:00Z","sde":"ns/sde","actor":"sde-controller","trigger":"retention","statement":"DROP DATABASE \"sde_5.0.0\""}
+{"time":"2024-01-02T00:00:00Z","sde":"ns/sde","actor":"sde-controller","trigger":"retention","statement":"DROP DATABASE \"sde_5.1.0\""}
+`},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(sde, database("sde_5.10.0"), database("sde_5.2.0"), audit).Build()
+
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("first\nsecond\n"), 0o600))
+	server, err := NewStatusServer(c, StatusServerOptions{TokenFile: tokenFile, AuditEntries: 1})
+	assert.NoError(t, err)
+	handler := server.Handler()
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("/api/v1/sdes", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("/api/v1/sdes", "third").Code)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sdes", nil)
+	req.Header.Set("Authorization", "Bearer first")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = get("/api/v1/sdes", "second")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var summaries []sdeSummary
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &summaries))
+	assert.Equal(t, []sdeSummary{{Namespace: "ns", Name: "sde", Databases: 2, PlanHash: "0123456789abcdef", PlannedDrops: 1}}, summaries)
+
+	rec = get("/api/v1/sdes/ns/sde", "first")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var detail sdeDetail
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail))
+	assert.Equal(t, "sde_5.2.0", detail.Inventory[0].Database)
+	assert.Equal(t, "sde_5.10.0", detail.Inventory[1].Database)
+	if assert.Len(t, detail.Audit, 1) {
+		assert.Equal(t, `DROP DATABASE "sde_5.1.0"`, detail.Audit[0].Statement)
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/api/v1/sdes/ns/other", "first").Code)
+
+	// Browsers send the token as the basic auth password
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("anyone", "first")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<h2>ns/sde</h2>")
+	assert.Contains(t, rec.Body.String(), "DROP DATABASE &#34;sde_5.1.0&#34;")
+}
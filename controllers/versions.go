@@ -0,0 +1,304 @@
+package controllers
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+// A version is parsed from the part of a database name after dbPrefix.
+// Numeric components are kept as digit strings so that arbitrarily long
+// numbers compare correctly.
+type version struct {
+	parts []string
+	// kind is -1 for pre-releases, 0 for releases and 1 for hotfixes
+	kind   int
+	suffix []string
+	// text is used by the lexical scheme only
+	text string
+}
+
+// versionScheme parses versions; ok is false for names it does not understand
+type versionScheme func(v string) (version, bool)
+
+var (
+	semverCore  = regexp.MustCompile(`^[vV]?(\d+)\.(\d+)\.(\d+)`)
+	calverCore  = regexp.MustCompile(`^(\d{4})(?:[._-]?(\d{1,2}))?(?:[._-]?(\d{1,2}))?`)
+	numericCore = regexp.MustCompile(`^(\d+)`)
+)
+
+// preReleaseTags start suffixes that sort before the release they belong to.
+// Any other suffix, such as _hf1 or .1, is a hotfix and sorts after it.
+var preReleaseTags = []string{"alpha", "beta", "rc", "pre", "dev", "snapshot"}
+
+func trimZeros(digits string) string {
+	trimmed := strings.TrimLeft(digits, "0")
+	if trimmed == "" {
+		return "0"
+	}
+	return trimmed
+}
+
+// withSuffix completes a version from whatever follows its numeric core
+func withSuffix(parts []string, rest string) (version, bool) {
+	v := version{parts: parts}
+	rest = strings.ToLower(strings.TrimLeft(rest, "._-+"))
+	if rest == "" {
+		return v, true
+	}
+
+	v.kind = 1
+	for _, tag := range preReleaseTags {
+		if strings.HasPrefix(rest, tag) {
+			v.kind = -1
+			break
+		}
+	}
+
+	// Split into runs of digits and of letters, dropping separators. Anything
+	// else, including non-ASCII letters, makes the name unparsable.
+	for rest != "" {
+		c := rest[0]
+		if strings.IndexByte("._-+", c) >= 0 {
+			rest = rest[1:]
+			continue
+		}
+		class := charClass(c)
+		if class == 0 {
+			return version{}, false
+		}
+		end := 1
+		for end < len(rest) && charClass(rest[end]) == class {
+			end++
+		}
+		token := rest[:end]
+		if class == 'd' {
+			token = trimZeros(token)
+		}
+		v.suffix = append(v.suffix, token)
+		rest = rest[end:]
+	}
+	return v, true
+}
+
+// charClass is 'd' for ASCII digits, 'a' for ASCII letters and 0 otherwise
+func charClass(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return 'd'
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return 'a'
+	}
+	return 0
+}
+
+func parseSemver(s string) (version, bool) {
+	m := semverCore.FindStringSubmatch(s)
+	if m == nil {
+		return version{}, false
+	}
+	return withSuffix([]string{trimZeros(m[1]), trimZeros(m[2]), trimZeros(m[3])}, s[len(m[0]):])
+}
+
+// parseCalver accepts YYYY, YYYY.MM and YYYY.MM.DD, with ".", "_", "-" or no
+// separator, followed by the same suffixes as semver
+func parseCalver(s string) (version, bool) {
+	m := calverCore.FindStringSubmatch(s)
+	if m == nil {
+		return version{}, false
+	}
+	parts := []string{m[1]}
+	for i, limit := range []int{12, 31} {
+		if m[i+2] == "" {
+			break
+		}
+		n, _ := strconv.Atoi(m[i+2])
+		if n < 1 || n > limit {
+			return version{}, false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return withSuffix(parts, s[len(m[0]):])
+}
+
+func parseNumeric(s string) (version, bool) {
+	m := numericCore.FindStringSubmatch(s)
+	if m == nil {
+		return version{}, false
+	}
+	return withSuffix([]string{trimZeros(m[1])}, s[len(m[0]):])
+}
+
+func parseLexical(s string) (version, bool) {
+	return version{text: s}, true
+}
+
+var versionSchemes = map[sdev1beta1.VersionScheme]versionScheme{
+	sdev1beta1.SchemeSemver:  parseSemver,
+	sdev1beta1.SchemeCalver:  parseCalver,
+	sdev1beta1.SchemeNumeric: parseNumeric,
+	sdev1beta1.SchemeLexical: parseLexical,
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if charClass(s[i]) != 'd' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// compareNumbers compares digit strings without leading zeros
+func compareNumbers(a, b string) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareTokens orders numbers numerically, before words, and words lexically
+func compareTokens(a, b string) int {
+	an, bn := isDigits(a), isDigits(b)
+	switch {
+	case an && bn:
+		return compareNumbers(a, b)
+	case an:
+		return -1
+	case bn:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareLists compares element by element; a prefix sorts first
+func compareLists(a, b []string, cmp func(a, b string) int) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := cmp(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareVersions(a, b version) int {
+	if c := compareLists(a.parts, b.parts, compareNumbers); c != 0 {
+		return c
+	}
+	if a.kind != b.kind {
+		return a.kind - b.kind
+	}
+	if c := compareLists(a.suffix, b.suffix, compareTokens); c != 0 {
+		return c
+	}
+	return strings.Compare(a.text, b.text)
+}
+
+// versionOrder sorts database names from oldest to newest
+type versionOrder struct {
+	names      []string
+	scheme     versionScheme
+	unparsable sdev1beta1.UnparsablePolicy
+}
+
+func (o versionOrder) Len() int      { return len(o.names) }
+func (o versionOrder) Swap(i, j int) { o.names[i], o.names[j] = o.names[j], o.names[i] }
+
+func (o versionOrder) Less(i, j int) bool {
+	return o.compare(o.names[i], o.names[j]) < 0
+}
+
+// compare orders two names. Unparsable names sort after every version, or
+// before them with DropFirst. Names that compare equal are ordered by name
+// so that the order is total.
+func (o versionOrder) compare(a, b string) int {
+	va, okA := o.scheme(strings.TrimPrefix(a, dbPrefix))
+	vb, okB := o.scheme(strings.TrimPrefix(b, dbPrefix))
+
+	c := 0
+	switch {
+	case okA && okB:
+		c = compareVersions(va, vb)
+	case okA != okB:
+		c = 1
+		if okA {
+			c = -1
+		}
+		if o.unparsable == sdev1beta1.UnparsableDropFirst {
+			c = -c
+		}
+	}
+	if c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func versioning(sde *sdev1beta1.Sde) (versionScheme, sdev1beta1.UnparsablePolicy) {
+	scheme, policy := sdev1beta1.SchemeSemver, sdev1beta1.UnparsableKeep
+	if v := sde.Spec.Versioning; v != nil {
+		if v.Scheme != "" {
+			scheme = v.Scheme
+		}
+		if v.Unparsable != "" {
+			policy = v.Unparsable
+		}
+	}
+	parse, ok := versionSchemes[scheme]
+	if !ok {
+		parse = parseSemver
+	}
+	return parse, policy
+}
+
+// sortDbs orders names from oldest to newest using the Sde's version scheme
+func sortDbs(sde *sdev1beta1.Sde, names []string) {
+	scheme, policy := versioning(sde)
+	sort.Sort(versionOrder{names: names, scheme: scheme, unparsable: policy})
+}
+
+// parsableDb reports whether the Sde's version scheme understands name
+func parsableDb(sde *sdev1beta1.Sde, name string) bool {
+	scheme, _ := versioning(sde)
+	_, ok := scheme(strings.TrimPrefix(name, dbPrefix))
+	return ok
+}
+
+// retainedDbs drops unparsable names from the retention list when the policy
+// says to ignore them
+func retainedDbs(sde *sdev1beta1.Sde, names []string) []string {
+	if _, policy := versioning(sde); policy != sdev1beta1.UnparsableIgnore {
+		return names
+	}
+	kept := make([]string, 0, len(names))
+	for _, name := range names {
+		if parsableDb(sde, name) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// releaseLine returns the major or minor line of a database, e.g. "5" or
+// "5.3". ok is false when the scheme yields no numeric components.
+func releaseLine(sde *sdev1beta1.Sde, name string, by sdev1beta1.LineGrouping) (string, bool) {
+	scheme, _ := versioning(sde)
+	v, ok := scheme(strings.TrimPrefix(name, dbPrefix))
+	if !ok || len(v.parts) == 0 {
+		return "", false
+	}
+	n := 2
+	if by == sdev1beta1.GroupByMajor {
+		n = 1
+	}
+	if n > len(v.parts) {
+		n = len(v.parts)
+	}
+	return strings.Join(v.parts[:n], "."), true
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	sdev1beta1 "sde.domain/sdeController/api/v1beta1"
+)
+
+func sdeWithVersioning(scheme sdev1beta1.VersionScheme, unparsable sdev1beta1.UnparsablePolicy) *sdev1beta1.Sde {
+	return &sdev1beta1.Sde{Spec: sdev1beta1.SdeSpec{
+		Versioning: &sdev1beta1.VersioningSpec{Scheme: scheme, Unparsable: unparsable},
+	}}
+}
+
+func TestVersionSchemes(t *testing.T) {
+	tests := []struct {
+		name       string
+		scheme     sdev1beta1.VersionScheme
+		unparsable sdev1beta1.UnparsablePolicy
+		in         []string
+		want       []string
+	}{
+		{
+			name:   "semver pre-releases and hotfixes",
+			scheme: sdev1beta1.SchemeSemver,
+			in:     []string{"sde_5.3.4_hf1", "sde_5.3.4", "sde_5.3.4_rc10", "sde_5.3.4_rc2", "sde_5.3.4_beta1", "sde_5.3.3"},
+			want:   []string{"sde_5.3.3", "sde_5.3.4_beta1", "sde_5.3.4_rc2", "sde_5.3.4_rc10", "sde_5.3.4", "sde_5.3.4_hf1"},
+		},
+		{
+			name:   "semver numeric components",
+			scheme: sdev1beta1.SchemeSemver,
+			in:     []string{"sde_10.0.0", "sde_9.10.0", "sde_9.9.99", "sde_9.10.0.1"},
+			want:   []string{"sde_9.9.99", "sde_9.10.0", "sde_9.10.0.1", "sde_10.0.0"},
+		},
+		{
+			name:   "semver unparsable kept",
+			scheme: sdev1beta1.SchemeSemver,
+			in:     []string{"sde_latest", "sde_5.3.4", "sde_5.2.0"},
+			want:   []string{"sde_5.2.0", "sde_5.3.4", "sde_latest"},
+		},
+		{
+			name:       "semver unparsable dropped first",
+			scheme:     sdev1beta1.SchemeSemver,
+			unparsable: sdev1beta1.UnparsableDropFirst,
+			in:         []string{"sde_5.3.4", "sde_latest", "sde_5.2.0", "sde_broken"},
+			want:       []string{"sde_broken", "sde_latest", "sde_5.2.0", "sde_5.3.4"},
+		},
+		{
+			name:   "calver",
+			scheme: sdev1beta1.SchemeCalver,
+			in:     []string{"sde_2024.10", "sde_20240517", "sde_2024.05_rc1", "sde_2023.12.31", "sde_2024.05"},
+			want:   []string{"sde_2023.12.31", "sde_2024.05_rc1", "sde_2024.05", "sde_20240517", "sde_2024.10"},
+		},
+		{
+			name:   "calver rejects invalid months",
+			scheme: sdev1beta1.SchemeCalver,
+			in:     []string{"sde_2024.13", "sde_2024.01"},
+			want:   []string{"sde_2024.01", "sde_2024.13"},
+		},
+		{
+			name:   "numeric",
+			scheme: sdev1beta1.SchemeNumeric,
+			in:     []string{"sde_100", "sde_20", "sde_3", "sde_20_hf1"},
+			want:   []string{"sde_3", "sde_20", "sde_20_hf1", "sde_100"},
+		},
+		{
+			name:   "lexical",
+			scheme: sdev1beta1.SchemeLexical,
+			in:     []string{"sde_b", "sde_10", "sde_a", "sde_9"},
+			want:   []string{"sde_10", "sde_9", "sde_a", "sde_b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := append([]string(nil), tt.in...)
+			sortDbs(sdeWithVersioning(tt.scheme, tt.unparsable), names)
+			assert.Equal(t, tt.want, names)
+		})
+	}
+}
+
+func TestRetainedDbs(t *testing.T) {
+	names := []string{"sde_5.2.0", "sde_latest", "sde_5.3.4"}
+	assert.Equal(t, names, retainedDbs(sdeWithVersioning(sdev1beta1.SchemeSemver, sdev1beta1.UnparsableKeep), names))
+	assert.Equal(t, []string{"sde_5.2.0", "sde_5.3.4"},
+		retainedDbs(sdeWithVersioning(sdev1beta1.SchemeSemver, sdev1beta1.UnparsableIgnore), names))
+}
+
+func FuzzVersionOrder(f *testing.F) {
+	for _, seed := range [][2]string{
+		{"5.3.4", "5.3.4_rc1"},
+		{"2024.05.17", "20240517"},
+		{"5.3.4_hf1", "5.3.4-HF.1"},
+		{"00001.0.0", "1.0.0"},
+		{"v1.2.3+build", "1.2.3"},
+		{"", "latest"},
+	} {
+		f.Add(seed[0], seed[1])
+	}
+
+	f.Fuzz(func(t *testing.T, a, b string) {
+		for scheme, parse := range versionSchemes {
+			for _, policy := range []sdev1beta1.UnparsablePolicy{sdev1beta1.UnparsableKeep, sdev1beta1.UnparsableDropFirst} {
+				o := versionOrder{scheme: parse, unparsable: policy}
+				ab, ba := o.compare(dbPrefix+a, dbPrefix+b), o.compare(dbPrefix+b, dbPrefix+a)
+				if (ab < 0) != (ba > 0) || (ab == 0) != (a == b) {
+					t.Fatalf("%s: inconsistent order of %q and %q: %d, %d", scheme, a, b, ab, ba)
+				}
+				names := []string{dbPrefix + a, dbPrefix + b, dbPrefix + "1.0.0"}
+				sort.Sort(versionOrder{names: names, scheme: parse, unparsable: policy})
+				if !sort.IsSorted(versionOrder{names: names, scheme: parse, unparsable: policy}) {
+					t.Fatalf("%s: %v not sorted", scheme, names)
+				}
+			}
+		}
+	})
+}
@@ -18,7 +18,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -52,11 +54,47 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxConcurrentReconciles int
+	var poolOpts controllers.PoolOptions
+	var notifyOpts controllers.NotifierOptions
+	var statusOpts controllers.StatusServerOptions
+	var readinessOpts controllers.ReadinessOptions
+	var readinessPolicy string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "Thhttps://book.kubebuilder.io/cronjob-tutorial/gvks.htmle address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of Sde objects reconciled in parallel.")
+	flag.DurationVar(&poolOpts.ConnectTimeout, "db-connect-timeout", 10*time.Second,
+		"Timeout for establishing a database connection.")
+	flag.DurationVar(&poolOpts.StatementTimeout, "db-statement-timeout", 5*time.Minute,
+		"Server-side statement_timeout for controller sessions. CREATE DATABASE from a large template must fit in it.")
+	flag.DurationVar(&poolOpts.LockTimeout, "db-lock-timeout", 10*time.Second,
+		"Server-side lock_timeout for controller sessions.")
+	flag.IntVar(&poolOpts.MaxOpenConns, "db-max-open-conns", 5,
+		"Maximum open connections per database pool.")
+	flag.DurationVar(&poolOpts.IdleTimeout, "db-idle-timeout", 5*time.Minute,
+		"Close database pools and connections that have been idle this long.")
+	flag.DurationVar(&notifyOpts.Timeout, "notification-timeout", 10*time.Second,
+		"Timeout for a single webhook notification request.")
+	flag.IntVar(&notifyOpts.MaxAttempts, "notification-max-attempts", 5,
+		"How often a webhook notification is tried before it is given up.")
+	flag.StringVar(&statusOpts.BindAddress, "status-bind-address", "0",
+		"The address the read-only status API binds to. Set to 0 to disable it.")
+	flag.StringVar(&statusOpts.TokenFile, "status-token-file", "",
+		"File with the bearer tokens accepted by the status API, one per line.")
+	flag.StringVar(&statusOpts.CertFile, "status-tls-cert-file", "",
+		"TLS certificate for the status API. Without it the API is served over plain HTTP.")
+	flag.StringVar(&statusOpts.KeyFile, "status-tls-key-file", "",
+		"TLS key for the status API.")
+	flag.StringVar(&readinessPolicy, "readiness-databases", "all",
+		"Which database servers must be reachable for the manager to be ready: all, any or none.")
+	flag.DurationVar(&readinessOpts.Interval, "readiness-interval", 30*time.Second,
+		"How often database servers are pinged for the readiness check.")
+	flag.DurationVar(&readinessOpts.Timeout, "readiness-timeout", 5*time.Second,
+		"Timeout for a single readiness ping of a database server.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,6 +103,14 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	readinessOpts.Policy = controllers.ReadinessPolicy(readinessPolicy)
+	switch readinessOpts.Policy {
+	case controllers.ReadyWhenAllReachable, controllers.ReadyWhenAnyReachable, controllers.ReadyIgnoringDatabases:
+	default:
+		setupLog.Error(fmt.Errorf("unknown policy %q", readinessPolicy), "invalid --readiness-databases")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -89,15 +135,66 @@ func main() {
 		os.Exit(1)
 	}
 
+	pools := controllers.NewServerPools(poolOpts)
+	if err = mgr.Add(pools); err != nil {
+		setupLog.Error(err, "unable to set up database pools")
+		os.Exit(1)
+	}
+	notifier := controllers.NewNotifier(mgr.GetClient(), mgr.GetScheme(), notifyOpts)
+	if err = mgr.Add(notifier); err != nil {
+		setupLog.Error(err, "unable to set up notifications")
+		os.Exit(1)
+	}
 	if err = (&controllers.SdeReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Pools:    pools,
+		Recorder: mgr.GetEventRecorderFor("sde-controller"),
+		Notifier: notifier,
+
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Sde")
+		os.Exit(1)
+	}
+	if err = (&controllers.SdeBackupReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
+		Pools:  pools,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Sde")
+		setupLog.Error(err, "unable to create controller", "controller", "SdeBackup")
+		os.Exit(1)
+	}
+	if err = (&controllers.SdeRestoreReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		Pools:  pools,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "SdeRestore")
+		os.Exit(1)
+	}
+	if err = (&controllers.SdeDatabaseServerReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		Pools:  pools,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "SdeDatabaseServer")
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
 
+	if statusOpts.BindAddress != "0" && statusOpts.BindAddress != "" {
+		status, err := controllers.NewStatusServer(mgr.GetClient(), statusOpts)
+		if err != nil {
+			setupLog.Error(err, "unable to set up the status API")
+			os.Exit(1)
+		}
+		if err = mgr.Add(status); err != nil {
+			setupLog.Error(err, "unable to set up the status API")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -106,6 +203,15 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	readiness := controllers.NewDatabaseReadiness(mgr.GetClient(), readinessOpts)
+	if err = mgr.Add(readiness); err != nil {
+		setupLog.Error(err, "unable to set up database readiness")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("databases", readiness.Check); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {